@@ -19,14 +19,19 @@ package agentpools
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
 	"k8s.io/klog"
 	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
 )
 
+// maxWindowsPoolNameLength is the longest name AKS accepts for a Windows agent pool.
+const maxWindowsPoolNameLength = 6
+
 // Spec contains properties to create a agent pool.
 type Spec struct {
 	Name          string
@@ -36,6 +41,31 @@ type Spec struct {
 	SKU           string
 	Replicas      int32
 	OSDiskSizeGB  int32
+
+	// OSType is the operating system of the pool's nodes. Possible values include: 'Linux', 'Windows'. Defaults to Linux.
+	// It can't be changed after the pool is created.
+	OSType string
+
+	// EnableAutoScaling lets the cluster autoscaler manage the pool's node count between MinCount and MaxCount.
+	// Replicas is then only the initial node count, and updates keep the pool's current count.
+	EnableAutoScaling *bool
+	MinCount          *int32
+	MaxCount          *int32
+
+	// VnetSubnetID is the resource ID of an existing subnet the pool's nodes join. It can't be changed after the pool is created.
+	VnetSubnetID string
+
+	// MaxPods is the maximum number of pods per node. It can't be changed after the pool is created.
+	MaxPods *int32
+
+	// EnableNodePublicIP assigns each node its own public IP address. It can't be changed after the pool is created.
+	EnableNodePublicIP *bool
+
+	// AvailabilityZones are the zones the pool's nodes are spread across. They can't be changed after the pool is created.
+	AvailabilityZones []string
+
+	// NodeTaints are the taints added to the pool's nodes, in the form key=value:Effect.
+	NodeTaints []string
 }
 
 // Get fetches a agent pool from Azure.
@@ -54,6 +84,10 @@ func (s *Service) Reconcile(ctx context.Context, spec interface{}) error {
 		return errors.New("expected agent pool specification")
 	}
 
+	if strings.EqualFold(agentPoolSpec.OSType, string(containerservice.Windows)) && len(agentPoolSpec.Name) > maxWindowsPoolNameLength {
+		return errors.Errorf("invalid agent pool name '%s': must be at most %d characters for Windows pools", agentPoolSpec.Name, maxWindowsPoolNameLength)
+	}
+
 	profile := containerservice.AgentPool{
 		ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
 			VMSize:              containerservice.VMSizeTypes(agentPoolSpec.SKU),
@@ -63,6 +97,40 @@ func (s *Service) Reconcile(ctx context.Context, spec interface{}) error {
 			OrchestratorVersion: agentPoolSpec.Version,
 		},
 	}
+	if agentPoolSpec.OSType != "" {
+		profile.OsType = containerservice.OSType(agentPoolSpec.OSType)
+	}
+	if agentPoolSpec.EnableAutoScaling != nil {
+		profile.EnableAutoScaling = to.BoolPtr(*agentPoolSpec.EnableAutoScaling)
+		if *agentPoolSpec.EnableAutoScaling {
+			if agentPoolSpec.MinCount == nil || agentPoolSpec.MaxCount == nil {
+				return errors.New("min and max count are required with autoscaling enabled")
+			}
+			profile.MinCount = agentPoolSpec.MinCount
+			profile.MaxCount = agentPoolSpec.MaxCount
+		}
+	}
+
+	if agentPoolSpec.VnetSubnetID != "" {
+		profile.VnetSubnetID = to.StringPtr(agentPoolSpec.VnetSubnetID)
+	}
+
+	if agentPoolSpec.MaxPods != nil {
+		profile.MaxPods = to.Int32Ptr(*agentPoolSpec.MaxPods)
+	}
+
+	if agentPoolSpec.EnableNodePublicIP != nil {
+		profile.EnableNodePublicIP = to.BoolPtr(*agentPoolSpec.EnableNodePublicIP)
+	}
+
+	if len(agentPoolSpec.AvailabilityZones) > 0 {
+		zones := agentPoolSpec.AvailabilityZones
+		profile.AvailabilityZones = &zones
+	}
+
+	// Always send the taints, so removing them from the spec removes them from the pool.
+	nodeTaints := append([]string{}, agentPoolSpec.NodeTaints...)
+	profile.NodeTaints = &nodeTaints
 
 	existingSpec, err := s.Get(ctx, spec)
 	if err != nil && !azure.ResourceNotFound(err) {
@@ -94,6 +162,38 @@ func (s *Service) Reconcile(ctx context.Context, spec interface{}) error {
 				OrchestratorVersion: existingPool.ManagedClusterAgentPoolProfileProperties.OrchestratorVersion,
 			},
 		}
+		if profile.OsType != "" {
+			existingProfile.OsType = existingPool.OsType
+		}
+		if profile.EnableAutoScaling != nil {
+			// AKS omits the setting on pools that were never autoscaled.
+			existingProfile.EnableAutoScaling = to.BoolPtr(to.Bool(existingPool.EnableAutoScaling))
+			existingProfile.MinCount = existingPool.MinCount
+			existingProfile.MaxCount = existingPool.MaxCount
+		}
+		if profile.VnetSubnetID != nil {
+			existingProfile.VnetSubnetID = existingPool.VnetSubnetID
+		}
+		if profile.MaxPods != nil {
+			existingProfile.MaxPods = existingPool.MaxPods
+		}
+		if profile.EnableNodePublicIP != nil {
+			// AKS omits the setting on pools without node public IPs.
+			existingProfile.EnableNodePublicIP = to.BoolPtr(to.Bool(existingPool.EnableNodePublicIP))
+		}
+		if profile.AvailabilityZones != nil {
+			existingProfile.AvailabilityZones = existingPool.AvailabilityZones
+		}
+		// AKS omits the taints of a pool without any.
+		existingTaints := []string{}
+		if existingPool.NodeTaints != nil {
+			existingTaints = append(existingTaints, *existingPool.NodeTaints...)
+		}
+		existingProfile.NodeTaints = &existingTaints
+		if to.Bool(profile.EnableAutoScaling) {
+			// The cluster autoscaler owns the node count, so keep the current one rather than fight it.
+			profile.Count = existingPool.Count
+		}
 
 		// Diff and check if we require an update
 		diff := cmp.Diff(profile, existingProfile)
@@ -0,0 +1,294 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentpools
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/agentpools/mock_agentpools"
+)
+
+const subnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+
+func TestReconcile(t *testing.T) {
+	notFound := autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found")
+
+	spec := func(modify func(*Spec)) *Spec {
+		s := &Spec{
+			Name:          "pool1",
+			ResourceGroup: "my-rg",
+			Cluster:       "my-cluster",
+			Version:       to.StringPtr("1.17.7"),
+			SKU:           "Standard_D2s_v3",
+			Replicas:      2,
+			OSDiskSizeGB:  128,
+		}
+		if modify != nil {
+			modify(s)
+		}
+		return s
+	}
+
+	// existing is the pool AKS returns for spec(nil), with the defaults and read-only values it adds.
+	existing := func(modify func(*containerservice.ManagedClusterAgentPoolProfileProperties)) containerservice.AgentPool {
+		pool := containerservice.AgentPool{
+			Name: to.StringPtr("pool1"),
+			ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+				VMSize:              containerservice.VMSizeTypes("Standard_D2s_v3"),
+				OsDiskSizeGB:        to.Int32Ptr(128),
+				Count:               to.Int32Ptr(2),
+				Type:                containerservice.VirtualMachineScaleSets,
+				OrchestratorVersion: to.StringPtr("1.17.7"),
+				OsType:              containerservice.Linux,
+				MaxPods:             to.Int32Ptr(110),
+				ProvisioningState:   to.StringPtr("Succeeded"),
+			},
+		}
+		if modify != nil {
+			modify(pool.ManagedClusterAgentPoolProfileProperties)
+		}
+		return pool
+	}
+
+	testcases := []struct {
+		name          string
+		spec          *Spec
+		expect        func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "create",
+			spec: spec(func(s *Spec) {
+				s.EnableAutoScaling = to.BoolPtr(true)
+				s.MinCount = to.Int32Ptr(1)
+				s.MaxCount = to.Int32Ptr(5)
+				s.VnetSubnetID = subnetID
+				s.MaxPods = to.Int32Ptr(30)
+				s.EnableNodePublicIP = to.BoolPtr(true)
+				s.AvailabilityZones = []string{"1", "2"}
+				s.NodeTaints = []string{"dedicated=infra:NoSchedule"}
+			}),
+			expect: func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(containerservice.AgentPool{}, notFound)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.VMSize).To(Equal(containerservice.VMSizeTypes("Standard_D2s_v3")))
+						g.Expect(pool.Count).To(Equal(to.Int32Ptr(2)))
+						g.Expect(pool.EnableAutoScaling).To(Equal(to.BoolPtr(true)))
+						g.Expect(pool.MinCount).To(Equal(to.Int32Ptr(1)))
+						g.Expect(pool.MaxCount).To(Equal(to.Int32Ptr(5)))
+						g.Expect(pool.VnetSubnetID).To(Equal(to.StringPtr(subnetID)))
+						g.Expect(pool.MaxPods).To(Equal(to.Int32Ptr(30)))
+						g.Expect(pool.EnableNodePublicIP).To(Equal(to.BoolPtr(true)))
+						g.Expect(pool.AvailabilityZones).To(Equal(&[]string{"1", "2"}))
+						g.Expect(pool.NodeTaints).To(Equal(&[]string{"dedicated=infra:NoSchedule"}))
+					})
+			},
+		},
+		{
+			name: "no change",
+			spec: spec(nil),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existing(nil), nil)
+			},
+		},
+		{
+			name: "scaled",
+			spec: spec(func(s *Spec) { s.Replicas = 3 }),
+			expect: func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existing(nil), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.Count).To(Equal(to.Int32Ptr(3)))
+					})
+			},
+		},
+		{
+			name: "taints removed",
+			spec: spec(nil),
+			expect: func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(existing(func(p *containerservice.ManagedClusterAgentPoolProfileProperties) {
+						p.NodeTaints = &[]string{"dedicated=infra:NoSchedule"}
+					}), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.NodeTaints).To(Equal(&[]string{}))
+					})
+			},
+		},
+		{
+			name: "unchanged taints",
+			spec: spec(func(s *Spec) { s.NodeTaints = []string{"dedicated=infra:NoSchedule"} }),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(existing(func(p *containerservice.ManagedClusterAgentPoolProfileProperties) {
+						p.NodeTaints = &[]string{"dedicated=infra:NoSchedule"}
+					}), nil)
+			},
+		},
+		{
+			name: "autoscaled count is kept",
+			spec: spec(func(s *Spec) {
+				s.EnableAutoScaling = to.BoolPtr(true)
+				s.MinCount = to.Int32Ptr(1)
+				s.MaxCount = to.Int32Ptr(5)
+			}),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(existing(func(p *containerservice.ManagedClusterAgentPoolProfileProperties) {
+						p.Count = to.Int32Ptr(4)
+						p.EnableAutoScaling = to.BoolPtr(true)
+						p.MinCount = to.Int32Ptr(1)
+						p.MaxCount = to.Int32Ptr(5)
+					}), nil)
+			},
+		},
+		{
+			name: "autoscaler range changed",
+			spec: spec(func(s *Spec) {
+				s.EnableAutoScaling = to.BoolPtr(true)
+				s.MinCount = to.Int32Ptr(1)
+				s.MaxCount = to.Int32Ptr(10)
+			}),
+			expect: func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(existing(func(p *containerservice.ManagedClusterAgentPoolProfileProperties) {
+						p.Count = to.Int32Ptr(4)
+						p.EnableAutoScaling = to.BoolPtr(true)
+						p.MinCount = to.Int32Ptr(1)
+						p.MaxCount = to.Int32Ptr(5)
+					}), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.Count).To(Equal(to.Int32Ptr(4)))
+						g.Expect(pool.MaxCount).To(Equal(to.Int32Ptr(10)))
+					})
+			},
+		},
+		{
+			name: "settings AKS omits when disabled",
+			spec: spec(func(s *Spec) {
+				s.EnableAutoScaling = to.BoolPtr(false)
+				s.EnableNodePublicIP = to.BoolPtr(false)
+			}),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existing(nil), nil)
+			},
+		},
+		{
+			name: "unchanged zones, max pods and subnet",
+			spec: spec(func(s *Spec) {
+				s.VnetSubnetID = subnetID
+				s.MaxPods = to.Int32Ptr(30)
+				s.AvailabilityZones = []string{"1", "2"}
+			}),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(existing(func(p *containerservice.ManagedClusterAgentPoolProfileProperties) {
+						p.VnetSubnetID = to.StringPtr(subnetID)
+						p.MaxPods = to.Int32Ptr(30)
+						p.AvailabilityZones = &[]string{"1", "2"}
+					}), nil)
+			},
+		},
+		{
+			name: "node public IP enabled",
+			spec: spec(func(s *Spec) { s.EnableNodePublicIP = to.BoolPtr(true) }),
+			expect: func(g *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existing(nil), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.EnableNodePublicIP).To(Equal(to.BoolPtr(true)))
+					})
+			},
+		},
+		{
+			name: "windows pool name at the limit",
+			spec: spec(func(s *Spec) {
+				s.Name = "win001"
+				s.OSType = "Windows"
+			}),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "win001").Return(containerservice.AgentPool{}, notFound)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "win001", gomock.Any())
+			},
+		},
+		{
+			name: "windows pool name too long",
+			spec: spec(func(s *Spec) {
+				s.Name = "windows"
+				s.OSType = "Windows"
+			}),
+			expect:        func(_ *GomegaWithT, _ *mock_agentpools.MockClientMockRecorder) {},
+			expectedError: "invalid agent pool name 'windows': must be at most 6 characters for Windows pools",
+		},
+		{
+			name: "linux pool name longer than the windows limit",
+			spec: spec(func(s *Spec) { s.Name = "linuxpool" }),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "linuxpool").Return(containerservice.AgentPool{}, notFound)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "linuxpool", gomock.Any())
+			},
+		},
+		{
+			name:          "autoscaling without a count range",
+			spec:          spec(func(s *Spec) { s.EnableAutoScaling = to.BoolPtr(true) }),
+			expect:        func(_ *GomegaWithT, _ *mock_agentpools.MockClientMockRecorder) {},
+			expectedError: "min and max count are required with autoscaling enabled",
+		},
+		{
+			name: "get fails",
+			spec: spec(nil),
+			expect: func(_ *GomegaWithT, m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(containerservice.AgentPool{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get existing agent pool: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(g, agentPoolsMock.EXPECT())
+
+			s := &Service{
+				Client: agentPoolsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), tc.spec)
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
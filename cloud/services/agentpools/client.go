@@ -28,6 +28,7 @@ import (
 // Client wraps go-sdk
 type Client interface {
 	Get(context.Context, string, string, string) (containerservice.AgentPool, error)
+	List(context.Context, string, string) ([]containerservice.AgentPool, error)
 	CreateOrUpdate(context.Context, string, string, string, containerservice.AgentPool) error
 	Delete(context.Context, string, string, string) error
 }
@@ -58,6 +59,24 @@ func (ac *AzureClient) Get(ctx context.Context, resourceGroupName, cluster, name
 	return ac.agentpools.Get(ctx, resourceGroupName, cluster, name)
 }
 
+// List lists the agent pools of a managed cluster.
+func (ac *AzureClient) List(ctx context.Context, resourceGroupName, cluster string) ([]containerservice.AgentPool, error) {
+	var pools []containerservice.AgentPool
+
+	// Prefer ListComplete() over List() to automatically traverse pages via iterator.
+	res, err := ac.agentpools.ListComplete(ctx, resourceGroupName, cluster)
+	if err != nil {
+		return nil, err
+	}
+	for res.NotDone() {
+		pools = append(pools, res.Value())
+		if err := res.NextWithContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "could not iterate agent pools")
+		}
+	}
+	return pools, nil
+}
+
 // CreateOrUpdate creates or updates an agent pool.
 func (ac *AzureClient) CreateOrUpdate(ctx context.Context, resourceGroupName, cluster, name string, properties containerservice.AgentPool) error {
 	future, err := ac.agentpools.CreateOrUpdate(ctx, resourceGroupName, cluster, name, properties)
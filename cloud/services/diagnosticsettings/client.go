@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnosticsettings
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
+)
+
+// Client wraps go-sdk
+type Client interface {
+	Get(context.Context, string, string) (insights.DiagnosticSettingsResource, error)
+	CreateOrUpdate(context.Context, string, string, insights.DiagnosticSettingsResource) error
+	Delete(context.Context, string, string) error
+}
+
+// AzureClient contains the Azure go-sdk Client
+type AzureClient struct {
+	diagnosticsettings insights.DiagnosticSettingsClient
+}
+
+var _ Client = &AzureClient{}
+
+// NewClient creates a new diagnostic settings client from subscription ID.
+func NewClient(subscriptionID string, authorizer autorest.Authorizer) *AzureClient {
+	c := newDiagnosticSettingsClient(subscriptionID, authorizer)
+	return &AzureClient{c}
+}
+
+// newDiagnosticSettingsClient creates a new diagnostic settings client from subscription ID.
+func newDiagnosticSettingsClient(subscriptionID string, authorizer autorest.Authorizer) insights.DiagnosticSettingsClient {
+	diagnosticSettingsClient := insights.NewDiagnosticSettingsClient(subscriptionID)
+	diagnosticSettingsClient.Authorizer = authorizer
+	diagnosticSettingsClient.AddToUserAgent(azure.UserAgent)
+	return diagnosticSettingsClient
+}
+
+// Get gets the diagnostic setting of a resource.
+func (ac *AzureClient) Get(ctx context.Context, resourceURI, name string) (insights.DiagnosticSettingsResource, error) {
+	return ac.diagnosticsettings.Get(ctx, resourceURI, name)
+}
+
+// CreateOrUpdate creates or updates the diagnostic setting of a resource.
+func (ac *AzureClient) CreateOrUpdate(ctx context.Context, resourceURI, name string, parameters insights.DiagnosticSettingsResource) error {
+	_, err := ac.diagnosticsettings.CreateOrUpdate(ctx, resourceURI, parameters, name)
+	return err
+}
+
+// Delete deletes the diagnostic setting of a resource.
+func (ac *AzureClient) Delete(ctx context.Context, resourceURI, name string) error {
+	_, err := ac.diagnosticsettings.Delete(ctx, resourceURI, name)
+	return err
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnosticsettings
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
+)
+
+// DefaultLogCategories are the control plane log categories streamed when a spec doesn't list any.
+var DefaultLogCategories = []string{"kube-apiserver", "kube-audit", "kube-controller-manager"}
+
+// Spec contains properties to create a diagnostic setting.
+type Spec struct {
+	Name string
+
+	// ResourceURI is the ID of the resource whose logs are streamed, e.g. a managed cluster.
+	ResourceURI string
+
+	// WorkspaceID and StorageAccountID are the resource IDs of the Log Analytics workspace and storage account
+	// the logs are sent to. At least one of them is required.
+	WorkspaceID      string
+	StorageAccountID string
+
+	// Logs are the log categories to stream. Categories left out are disabled. Defaults to DefaultLogCategories.
+	Logs []string
+}
+
+// Get fetches a diagnostic setting from Azure.
+func (s *Service) Get(ctx context.Context, spec interface{}) (interface{}, error) {
+	diagnosticSettingSpec, ok := spec.(*Spec)
+	if !ok {
+		return insights.DiagnosticSettingsResource{}, errors.New("expected diagnostic setting specification")
+	}
+	return s.Client.Get(ctx, diagnosticSettingSpec.ResourceURI, diagnosticSettingSpec.Name)
+}
+
+// Reconcile idempotently creates or updates a diagnostic setting, if possible.
+func (s *Service) Reconcile(ctx context.Context, spec interface{}) error {
+	diagnosticSettingSpec, ok := spec.(*Spec)
+	if !ok {
+		return errors.New("expected diagnostic setting specification")
+	}
+
+	if diagnosticSettingSpec.WorkspaceID == "" && diagnosticSettingSpec.StorageAccountID == "" {
+		return errors.Errorf("invalid diagnostic setting %s: a workspace or storage account is required", diagnosticSettingSpec.Name)
+	}
+
+	categories := diagnosticSettingSpec.Logs
+	if len(categories) == 0 {
+		categories = DefaultLogCategories
+	}
+	logs := make([]insights.LogSettings, 0, len(categories))
+	for _, category := range categories {
+		logs = append(logs, insights.LogSettings{
+			Category: to.StringPtr(category),
+			Enabled:  to.BoolPtr(true),
+		})
+	}
+
+	setting := insights.DiagnosticSettingsResource{
+		DiagnosticSettings: &insights.DiagnosticSettings{
+			Logs: &logs,
+		},
+	}
+	if diagnosticSettingSpec.WorkspaceID != "" {
+		setting.WorkspaceID = to.StringPtr(diagnosticSettingSpec.WorkspaceID)
+	}
+	if diagnosticSettingSpec.StorageAccountID != "" {
+		setting.StorageAccountID = to.StringPtr(diagnosticSettingSpec.StorageAccountID)
+	}
+
+	existingSpec, err := s.Get(ctx, spec)
+	if err != nil && !azure.ResourceNotFound(err) {
+		return errors.Wrapf(err, "failed to get existing diagnostic setting")
+	}
+	if existing, ok := existingSpec.(insights.DiagnosticSettingsResource); ok && err == nil && isUpToDate(setting, existing) {
+		klog.V(2).Infof("diagnostic setting %s is up to date", diagnosticSettingSpec.Name)
+		return nil
+	}
+
+	klog.V(2).Infof("creating or updating diagnostic setting %s", diagnosticSettingSpec.Name)
+	if err := s.Client.CreateOrUpdate(ctx, diagnosticSettingSpec.ResourceURI, diagnosticSettingSpec.Name, setting); err != nil {
+		return errors.Wrapf(err, "failed to create or update diagnostic setting %s", diagnosticSettingSpec.Name)
+	}
+	klog.V(2).Infof("successfully created or updated diagnostic setting %s", diagnosticSettingSpec.Name)
+	return nil
+}
+
+// Delete deletes the diagnostic setting with the provided name.
+func (s *Service) Delete(ctx context.Context, spec interface{}) error {
+	diagnosticSettingSpec, ok := spec.(*Spec)
+	if !ok {
+		return errors.New("expected diagnostic setting specification")
+	}
+
+	klog.V(2).Infof("deleting diagnostic setting %s", diagnosticSettingSpec.Name)
+	err := s.Client.Delete(ctx, diagnosticSettingSpec.ResourceURI, diagnosticSettingSpec.Name)
+	if err != nil && azure.ResourceNotFound(err) {
+		// already deleted
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete diagnostic setting %s", diagnosticSettingSpec.Name)
+	}
+
+	klog.V(2).Infof("successfully deleted diagnostic setting %s", diagnosticSettingSpec.Name)
+	return nil
+}
+
+// isUpToDate reports whether an existing diagnostic setting sends the desired logs to the desired destinations.
+// Azure may return resource IDs in a different case, and categories it knows about but which aren't enabled.
+func isUpToDate(desired, existing insights.DiagnosticSettingsResource) bool {
+	if existing.DiagnosticSettings == nil {
+		return false
+	}
+	if !strings.EqualFold(to.String(desired.WorkspaceID), to.String(existing.WorkspaceID)) ||
+		!strings.EqualFold(to.String(desired.StorageAccountID), to.String(existing.StorageAccountID)) {
+		return false
+	}
+	desiredLogs, existingLogs := enabledCategories(desired.Logs), enabledCategories(existing.Logs)
+	if len(desiredLogs) != len(existingLogs) {
+		return false
+	}
+	for i := range desiredLogs {
+		if desiredLogs[i] != existingLogs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// enabledCategories returns the sorted categories of the enabled log settings.
+func enabledCategories(logs *[]insights.LogSettings) []string {
+	if logs == nil {
+		return nil
+	}
+	var categories []string
+	for _, log := range *logs {
+		if to.Bool(log.Enabled) && log.Category != nil {
+			categories = append(categories, strings.ToLower(*log.Category))
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
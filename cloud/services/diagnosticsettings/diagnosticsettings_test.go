@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnosticsettings
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/diagnosticsettings/mock_diagnosticsettings"
+)
+
+const (
+	resourceURI = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.ContainerService/managedClusters/my-cluster"
+	workspaceID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.OperationalInsights/workspaces/my-workspace"
+)
+
+func setting(workspace string, categories ...string) insights.DiagnosticSettingsResource {
+	logs := make([]insights.LogSettings, 0, len(categories))
+	for _, category := range categories {
+		logs = append(logs, insights.LogSettings{
+			Category: to.StringPtr(category),
+			Enabled:  to.BoolPtr(true),
+		})
+	}
+	return insights.DiagnosticSettingsResource{
+		DiagnosticSettings: &insights.DiagnosticSettings{
+			WorkspaceID: to.StringPtr(workspace),
+			Logs:        &logs,
+		},
+	}
+}
+
+func TestReconcileDiagnosticSettings(t *testing.T) {
+	notFound := autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found")
+
+	testcases := []struct {
+		name          string
+		spec          Spec
+		expectedError string
+		expect        func(m *mock_diagnosticsettings.MockClientMockRecorder)
+	}{
+		{
+			name:          "no destination",
+			spec:          Spec{Name: "my-setting", ResourceURI: resourceURI},
+			expectedError: "invalid diagnostic setting my-setting: a workspace or storage account is required",
+			expect:        func(m *mock_diagnosticsettings.MockClientMockRecorder) {},
+		},
+		{
+			name: "create with default categories",
+			spec: Spec{Name: "my-setting", ResourceURI: resourceURI, WorkspaceID: workspaceID},
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Get(context.TODO(), resourceURI, "my-setting").Return(insights.DiagnosticSettingsResource{}, notFound)
+				m.CreateOrUpdate(context.TODO(), resourceURI, "my-setting", setting(workspaceID, "kube-apiserver", "kube-audit", "kube-controller-manager"))
+			},
+		},
+		{
+			name: "up to date",
+			spec: Spec{Name: "my-setting", ResourceURI: resourceURI, WorkspaceID: workspaceID, Logs: []string{"kube-audit", "kube-apiserver"}},
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				existing := setting(strings.ToUpper(workspaceID), "kube-apiserver", "kube-audit")
+				*existing.Logs = append(*existing.Logs, insights.LogSettings{Category: to.StringPtr("kube-scheduler"), Enabled: to.BoolPtr(false)})
+				m.Get(context.TODO(), resourceURI, "my-setting").Return(existing, nil)
+			},
+		},
+		{
+			name: "update categories",
+			spec: Spec{Name: "my-setting", ResourceURI: resourceURI, WorkspaceID: workspaceID, Logs: []string{"kube-audit"}},
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Get(context.TODO(), resourceURI, "my-setting").Return(setting(workspaceID, "kube-apiserver", "kube-audit"), nil)
+				m.CreateOrUpdate(context.TODO(), resourceURI, "my-setting", setting(workspaceID, "kube-audit"))
+			},
+		},
+		{
+			name:          "get fails",
+			spec:          Spec{Name: "my-setting", ResourceURI: resourceURI, WorkspaceID: workspaceID},
+			expectedError: "failed to get existing diagnostic setting: #: Internal Server Error: StatusCode=500",
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Get(context.TODO(), resourceURI, "my-setting").Return(insights.DiagnosticSettingsResource{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			diagnosticSettingsMock := mock_diagnosticsettings.NewMockClient(mockCtrl)
+
+			tc.expect(diagnosticSettingsMock.EXPECT())
+
+			s := &Service{
+				Client: diagnosticSettingsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &tc.spec)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestDeleteDiagnosticSettings(t *testing.T) {
+	testcases := []struct {
+		name          string
+		expectedError string
+		expect        func(m *mock_diagnosticsettings.MockClientMockRecorder)
+	}{
+		{
+			name: "delete existing setting",
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Delete(context.TODO(), resourceURI, "my-setting")
+			},
+		},
+		{
+			name: "setting already deleted",
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Delete(context.TODO(), resourceURI, "my-setting").Return(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+		},
+		{
+			name:          "delete fails",
+			expectedError: "failed to delete diagnostic setting my-setting: #: Internal Server Error: StatusCode=500",
+			expect: func(m *mock_diagnosticsettings.MockClientMockRecorder) {
+				m.Delete(context.TODO(), resourceURI, "my-setting").Return(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			diagnosticSettingsMock := mock_diagnosticsettings.NewMockClient(mockCtrl)
+
+			tc.expect(diagnosticSettingsMock.EXPECT())
+
+			s := &Service{
+				Client: diagnosticSettingsMock,
+			}
+
+			err := s.Delete(context.TODO(), &Spec{Name: "my-setting", ResourceURI: resourceURI})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
 	"github.com/Azure/go-autorest/autorest"
+	azureautorest "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/pkg/errors"
 	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
 )
@@ -29,8 +30,14 @@ import (
 type Client interface {
 	Get(context.Context, string, string) (containerservice.ManagedCluster, error)
 	GetCredentials(context.Context, string, string) ([]byte, error)
+	GetUpgradeProfile(context.Context, string, string) (containerservice.ManagedClusterUpgradeProfile, error)
 	CreateOrUpdate(context.Context, string, string, containerservice.ManagedCluster) error
+	CreateOrUpdateAsync(context.Context, string, string, containerservice.ManagedCluster) (azureautorest.Future, error)
+	IsDone(context.Context, azureautorest.Future) (bool, error)
 	Delete(context.Context, string, string) error
+	RotateClusterCertificates(context.Context, string, string) error
+	RotateClusterCertificatesAsync(context.Context, string, string) (azureautorest.Future, error)
+	ResetServicePrincipalProfile(context.Context, string, string, containerservice.ManagedClusterServicePrincipalProfile) error
 }
 
 // AzureClient contains the Azure go-sdk Client
@@ -74,6 +81,11 @@ func (ac *AzureClient) GetCredentials(ctx context.Context, resourceGroupName, na
 	return *(*credentialList.Kubeconfigs)[0].Value, nil
 }
 
+// GetUpgradeProfile gets the versions a managed cluster's control plane and agent pools can upgrade to.
+func (ac *AzureClient) GetUpgradeProfile(ctx context.Context, resourceGroupName, name string) (containerservice.ManagedClusterUpgradeProfile, error) {
+	return ac.managedclusters.GetUpgradeProfile(ctx, resourceGroupName, name)
+}
+
 // CreateOrUpdate creates or updates a managed cluster.
 func (ac *AzureClient) CreateOrUpdate(ctx context.Context, resourceGroupName, name string, cluster containerservice.ManagedCluster) error {
 	future, err := ac.managedclusters.CreateOrUpdate(ctx, resourceGroupName, name, cluster)
@@ -87,6 +99,20 @@ func (ac *AzureClient) CreateOrUpdate(ctx context.Context, resourceGroupName, na
 	return err
 }
 
+// CreateOrUpdateAsync starts creating or updating a managed cluster and returns the operation without waiting for it.
+func (ac *AzureClient) CreateOrUpdateAsync(ctx context.Context, resourceGroupName, name string, cluster containerservice.ManagedCluster) (azureautorest.Future, error) {
+	future, err := ac.managedclusters.CreateOrUpdate(ctx, resourceGroupName, name, cluster)
+	if err != nil {
+		return azureautorest.Future{}, errors.Wrapf(err, "failed to begin operation")
+	}
+	return future.Future, nil
+}
+
+// IsDone polls an operation on a managed cluster and reports whether it completed. A failed operation is an error.
+func (ac *AzureClient) IsDone(ctx context.Context, future azureautorest.Future) (bool, error) {
+	return future.DoneWithContext(ctx, ac.managedclusters)
+}
+
 // Delete deletes a managed cluster.
 func (ac *AzureClient) Delete(ctx context.Context, resourceGroupName, name string) error {
 	future, err := ac.managedclusters.Delete(ctx, resourceGroupName, name)
@@ -99,3 +125,39 @@ func (ac *AzureClient) Delete(ctx context.Context, resourceGroupName, name strin
 	_, err = future.Result(ac.managedclusters)
 	return err
 }
+
+// RotateClusterCertificates rotates the certificates of a managed cluster, waiting for the operation to complete.
+func (ac *AzureClient) RotateClusterCertificates(ctx context.Context, resourceGroupName, name string) error {
+	future, err := ac.managedclusters.RotateClusterCertificates(ctx, resourceGroupName, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to begin operation")
+	}
+	if err := future.WaitForCompletionRef(ctx, ac.managedclusters.Client); err != nil {
+		return errors.Wrapf(err, "failed to end operation")
+	}
+	_, err = future.Result(ac.managedclusters)
+	return err
+}
+
+// RotateClusterCertificatesAsync starts rotating the certificates of a managed cluster and returns the operation
+// without waiting for it.
+func (ac *AzureClient) RotateClusterCertificatesAsync(ctx context.Context, resourceGroupName, name string) (azureautorest.Future, error) {
+	future, err := ac.managedclusters.RotateClusterCertificates(ctx, resourceGroupName, name)
+	if err != nil {
+		return azureautorest.Future{}, errors.Wrapf(err, "failed to begin operation")
+	}
+	return future.Future, nil
+}
+
+// ResetServicePrincipalProfile replaces the service principal credential of a managed cluster, waiting for the operation to complete.
+func (ac *AzureClient) ResetServicePrincipalProfile(ctx context.Context, resourceGroupName, name string, profile containerservice.ManagedClusterServicePrincipalProfile) error {
+	future, err := ac.managedclusters.ResetServicePrincipalProfile(ctx, resourceGroupName, name, profile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to begin operation")
+	}
+	if err := future.WaitForCompletionRef(ctx, ac.managedclusters.Client); err != nil {
+		return errors.Wrapf(err, "failed to end operation")
+	}
+	_, err = future.Result(ac.managedclusters)
+	return err
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package managedclusters
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
+)
+
+var (
+	// subnetExhaustedReasons are the error codes and messages Azure returns when a subnet
+	// cannot hold the IP addresses required by the cluster's nodes and pods.
+	subnetExhaustedReasons = []string{
+		"subnetisfull",
+		"insufficientsubnetsize",
+		"does not have enough capacity",
+		"insufficient ip addresses",
+	}
+
+	// dependencyNotFoundReasons are the error codes Azure returns when a resource the cluster
+	// depends on, such as a subnet or identity, has not yet propagated after being created.
+	dependencyNotFoundReasons = []string{
+		"subnetnotfound",
+		"principalnotfound",
+		"invalidresourcereference",
+	}
+
+	subnetIDRegex = regexp.MustCompile(`(?i)/subscriptions/[^/]+/resourceGroups/([^/]+)/providers/Microsoft\.Network/virtualNetworks/([^/]+)/subnets/([^/\s'",]+)`)
+)
+
+// ErrManagedClusterNotFound is matched, using errors.Is, by the error Get returns when the managed cluster doesn't exist.
+var ErrManagedClusterNotFound = errors.New("managed cluster not found")
+
+// managedClusterNotFoundError wraps the 404 returned by Azure for a missing managed cluster.
+type managedClusterNotFoundError struct {
+	name string
+	err  error
+}
+
+func (e *managedClusterNotFoundError) Error() string {
+	return fmt.Sprintf("managed cluster %s not found: %v", e.name, e.err)
+}
+
+func (e *managedClusterNotFoundError) Is(target error) bool {
+	return target == ErrManagedClusterNotFound
+}
+
+func (e *managedClusterNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// ErrAgentPoolNotFound is matched, using errors.Is, by the error GetAgentPool returns when the agent pool doesn't exist.
+var ErrAgentPoolNotFound = errors.New("agent pool not found")
+
+// agentPoolNotFoundError wraps the 404 returned by Azure for a missing agent pool.
+type agentPoolNotFoundError struct {
+	cluster string
+	name    string
+	err     error
+}
+
+func (e *agentPoolNotFoundError) Error() string {
+	return fmt.Sprintf("agent pool %s not found in managed cluster %s: %v", e.name, e.cluster, e.err)
+}
+
+func (e *agentPoolNotFoundError) Is(target error) bool {
+	return target == ErrAgentPoolNotFound
+}
+
+func (e *agentPoolNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// ErrSubnetExhausted is returned when a subnet has run out of free IP addresses.
+// Retrying will not help until the subnet's address range is expanded.
+type ErrSubnetExhausted struct {
+	// SubnetID is the resource ID of the exhausted subnet, if Azure reported it.
+	SubnetID string
+	Err      error
+}
+
+func (e *ErrSubnetExhausted) Error() string {
+	subnet := e.SubnetID
+	if subnet == "" {
+		subnet = "the node subnet"
+	}
+	return fmt.Sprintf("%s has no free IP addresses left, expand the subnet address range: %v", subnet, e.Err)
+}
+
+func (e *ErrSubnetExhausted) Unwrap() error {
+	return e.Err
+}
+
+// subnetExhausted returns an ErrSubnetExhausted if err reports a subnet without free IP addresses.
+func subnetExhausted(err error) (*ErrSubnetExhausted, bool) {
+	if err == nil {
+		return nil, false
+	}
+	message := err.Error()
+	lower := strings.ToLower(message)
+	for _, reason := range subnetExhaustedReasons {
+		if strings.Contains(lower, reason) {
+			return &ErrSubnetExhausted{
+				SubnetID: strings.TrimRight(subnetIDRegex.FindString(message), "."),
+				Err:      err,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// dependencyNotFound reports whether err is caused by a dependent resource Azure cannot see yet.
+// A 404 for the managed cluster itself is a genuinely missing resource and is not matched.
+func dependencyNotFound(err error) bool {
+	if err == nil || azure.ResourceNotFound(errors.Cause(err)) {
+		return false
+	}
+	lower := strings.ToLower(err.Error())
+	for _, reason := range dependencyNotFoundReasons {
+		if strings.Contains(lower, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttled reports whether err is an ARM throttling response, and how long Azure asked
+// callers to wait before retrying. Without a Retry-After header, defaultThrottleRetryAfter is used.
+func throttled(err error) (time.Duration, bool) {
+	var derr autorest.DetailedError
+	if !errors.As(err, &derr) || derr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if derr.Response != nil {
+		if seconds, err := strconv.Atoi(derr.Response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return defaultThrottleRetryAfter, true
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package managedclusters
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/managedclusters/mock_managedclusters"
+)
+
+const exhaustedSubnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+
+func TestSubnetExhausted(t *testing.T) {
+	testcases := []struct {
+		name             string
+		err              error
+		expectExhausted  bool
+		expectedSubnetID string
+	}{
+		{
+			name:             "insufficient subnet size",
+			err:              errors.New(`Code="InsufficientSubnetSize" Message="Pre-allocated IPs 93 exceeds IPs available 11 in Subnet Cidr 10.240.0.0/28, Subnet Name ` + exhaustedSubnetID + `."`),
+			expectExhausted:  true,
+			expectedSubnetID: exhaustedSubnetID,
+		},
+		{
+			name:            "subnet is full",
+			err:             errors.New(`Code="SubnetIsFull" Message="Subnet my-subnet with address prefix 10.240.0.0/28 does not have enough capacity for 5 IP addresses."`),
+			expectExhausted: true,
+		},
+		{
+			name:            "unrelated error",
+			err:             errors.New(`Code="QuotaExceeded" Message="Operation results in exceeding quota limits of Core."`),
+			expectExhausted: false,
+		},
+		{
+			name:            "no error",
+			expectExhausted: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			exhausted, ok := subnetExhausted(tc.err)
+			g.Expect(ok).To(Equal(tc.expectExhausted))
+			if tc.expectExhausted {
+				g.Expect(exhausted.SubnetID).To(Equal(tc.expectedSubnetID))
+				g.Expect(errors.Is(exhausted, tc.err)).To(BeTrue())
+			}
+		})
+	}
+}
+
+func TestReconcileSubnetExhausted(t *testing.T) {
+	g := NewWithT(t)
+
+	mockCtrl := gomock.NewController(t)
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	azureErr := autorest.NewErrorWithResponse("containerservice.ManagedClustersClient", "CreateOrUpdate", &http.Response{StatusCode: 400},
+		`Code="InsufficientSubnetSize" Message="Pre-allocated IPs 93 exceeds IPs available 11 in Subnet Cidr 10.240.0.0/28, Subnet Name `+exhaustedSubnetID+`."`)
+	managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+		Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+	managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).Return(azureErr)
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	err := s.Reconcile(context.TODO(), &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})
+	g.Expect(err).To(HaveOccurred())
+
+	var exhausted *ErrSubnetExhausted
+	g.Expect(errors.As(err, &exhausted)).To(BeTrue())
+	g.Expect(exhausted.SubnetID).To(Equal(exhaustedSubnetID))
+}
+
+func TestDependencyNotFound(t *testing.T) {
+	testcases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "subnet not propagated",
+			err:      autorest.NewErrorWithResponse("containerservice.ManagedClustersClient", "CreateOrUpdate", &http.Response{StatusCode: 400}, `Code="SubnetNotFound" Message="Subnet my-subnet not found."`),
+			expected: true,
+		},
+		{
+			name:     "identity not propagated",
+			err:      autorest.NewErrorWithResponse("containerservice.ManagedClustersClient", "CreateOrUpdate", &http.Response{StatusCode: 400}, `Code="ServicePrincipalNotFound" Message="Service principal clientID not found in Active Directory tenant."`),
+			expected: true,
+		},
+		{
+			name:     "missing managed cluster",
+			err:      autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"),
+			expected: false,
+		},
+		{
+			name:     "wrapped missing managed cluster",
+			err:      errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, `Code="InvalidResourceReference"`), "failed to get managed cluster"),
+			expected: false,
+		},
+		{
+			name:     "unrelated error",
+			err:      autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"),
+			expected: false,
+		},
+		{
+			name:     "no error",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(dependencyNotFound(tc.err)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestReconcileDependencyNotFound(t *testing.T) {
+	backoff := dependencyRetryBackoff
+	dependencyRetryBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	defer func() { dependencyRetryBackoff = backoff }()
+
+	notFound := autorest.NewErrorWithResponse("containerservice.ManagedClustersClient", "CreateOrUpdate", &http.Response{StatusCode: 400},
+		`Code="SubnetNotFound" Message="Subnet `+exhaustedSubnetID+` not found."`)
+
+	testcases := []struct {
+		name      string
+		expect    func(m *mock_managedclusters.MockClientMockRecorder)
+		cancelled bool
+		errors    bool
+	}{
+		{
+			name: "retries until the dependency propagates",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				gomock.InOrder(
+					m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(notFound).Times(2),
+					m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(nil),
+				)
+			},
+		},
+		{
+			name: "gives up after the retry window",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(notFound).Times(3)
+			},
+			errors: true,
+		},
+		{
+			name: "stops retrying once the context is done",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(notFound)
+			},
+			cancelled: true,
+			errors:    true,
+		},
+		{
+			name: "other errors are not retried",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).
+					Return(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			errors: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+			err := s.Reconcile(ctx, &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			})
+			if tc.errors {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func throttledError(retryAfter string) error {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return autorest.NewErrorWithResponse("containerservice.ManagedClustersClient", "CreateOrUpdate", resp, "Too Many Requests")
+}
+
+func TestThrottled(t *testing.T) {
+	testcases := []struct {
+		name               string
+		err                error
+		expectedRetryAfter time.Duration
+		expectedThrottled  bool
+	}{
+		{
+			name:               "throttled with Retry-After",
+			err:                throttledError("7"),
+			expectedRetryAfter: 7 * time.Second,
+			expectedThrottled:  true,
+		},
+		{
+			name:               "throttled without Retry-After",
+			err:                throttledError(""),
+			expectedRetryAfter: defaultThrottleRetryAfter,
+			expectedThrottled:  true,
+		},
+		{
+			name:               "wrapped throttling error",
+			err:                errors.Wrap(throttledError("3"), "failed to begin operation"),
+			expectedRetryAfter: 3 * time.Second,
+			expectedThrottled:  true,
+		},
+		{
+			name: "other error",
+			err:  autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"),
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			retryAfter, ok := throttled(tc.err)
+			g.Expect(ok).To(Equal(tc.expectedThrottled))
+			g.Expect(retryAfter).To(Equal(tc.expectedRetryAfter))
+		})
+	}
+}
+
+func TestReconcileThrottled(t *testing.T) {
+	waitFn := waitForRetry
+	defer func() { waitForRetry = waitFn }()
+
+	testcases := []struct {
+		name          string
+		maxRetries    int
+		timeout       time.Duration
+		expect        func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedWaits []time.Duration
+		errors        bool
+	}{
+		{
+			name:       "succeeds after two throttled requests",
+			maxRetries: 3,
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				gomock.InOrder(
+					m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(throttledError("2")).Times(2),
+					m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(nil),
+				)
+			},
+			expectedWaits: []time.Duration{2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:       "gives up after max retries",
+			maxRetries: 1,
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(throttledError("2")).Times(2)
+			},
+			expectedWaits: []time.Duration{2 * time.Second},
+			errors:        true,
+		},
+		{
+			name:       "does not wait past the context deadline",
+			maxRetries: 3,
+			timeout:    time.Second,
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).Return(throttledError("60"))
+			},
+			errors: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			tc.expect(managedClustersMock.EXPECT())
+
+			var waits []time.Duration
+			waitForRetry = func(_ context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			ctx := context.Background()
+			if tc.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			s := &Service{
+				Client:     managedClustersMock,
+				MaxRetries: tc.maxRetries,
+			}
+
+			err := s.Reconcile(ctx, &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			})
+			if tc.errors {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+			g.Expect(waits).To(Equal(tc.expectedWaits))
+		})
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	testcases := []struct {
+		name             string
+		err              error
+		expectedNotFound bool
+		expectedError    string
+	}{
+		{
+			name:             "not found",
+			err:              autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"),
+			expectedNotFound: true,
+			expectedError:    "managed cluster my-cluster not found: #: Not found: StatusCode=404",
+		},
+		{
+			name:          "other error",
+			err:           autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"),
+			expectedError: "#: Internal Server Error: StatusCode=500",
+		},
+		{
+			name: "found",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			existing := containerservice.ManagedCluster{Name: to.StringPtr("my-cluster")}
+			if tc.err != nil {
+				existing = containerservice.ManagedCluster{}
+			}
+			managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").Return(existing, tc.err)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			result, err := s.Get(context.TODO(), &Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			g.Expect(errors.Is(err, ErrManagedClusterNotFound)).To(Equal(tc.expectedNotFound))
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+				// The SDK error stays reachable for callers that need its details.
+				var derr autorest.DetailedError
+				g.Expect(errors.As(err, &derr)).To(BeTrue())
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(result).To(Equal(existing))
+			}
+		})
+	}
+}
@@ -18,19 +18,94 @@ package managedclusters
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	azureautorest "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
-	"k8s.io/klog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/klogr"
 	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
+	infrav1exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
 )
 
 var (
-	defaultUser     string = "azureuser"
-	managedIdentity string = "msi"
+	// waitForRetry blocks for the given duration, returning early with an error if ctx is done first.
+	waitForRetry = func(ctx context.Context, d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+
+	// dependencyRetryBackoff bounds how long CreateOrUpdate is retried while a newly created
+	// dependency, such as a subnet or identity, propagates through Azure.
+	dependencyRetryBackoff = wait.Backoff{
+		Duration: 5 * time.Second,
+		Factor:   2,
+		Steps:    5,
+	}
+)
+
+const (
+	// defaultUser is the admin username of the cluster's Linux nodes.
+	defaultUser = "azureuser"
+
+	// managedIdentity is the client ID that tells AKS to use a managed identity instead of a service principal.
+	managedIdentity = "msi"
+
+	// scaleSetPriorityRegular is the default priority of an agent pool.
+	scaleSetPriorityRegular = "Regular"
+	// scaleSetPrioritySpot runs an agent pool on spot virtual machines. The 2020-02-01 API calls this priority
+	// Low, so it is sent to AKS as containerservice.Low and read back as Spot.
+	scaleSetPrioritySpot = "Spot"
+
+	// provisioningStateSucceeded and provisioningStateFailed are the terminal provisioning states of a managed cluster.
+	provisioningStateSucceeded = "Succeeded"
+	provisioningStateFailed    = "Failed"
+
+	// dnsServiceIPOffset is the host offset in the service CIDR used for the cluster DNS service IP.
+	dnsServiceIPOffset = 10
+
+	// defaultThrottleRetryAfter is how long to wait before retrying a throttled request without a Retry-After header.
+	defaultThrottleRetryAfter = 10 * time.Second
+	// defaultMaxThrottleRetries is how many times a throttled request is retried by a new service.
+	defaultMaxThrottleRetries = 3
+
+	// httpApplicationRoutingAddon is the name of the HTTP application routing addon profile.
+	httpApplicationRoutingAddon = "httpApplicationRouting"
+	// azurePolicyAddon is the name of the Azure Policy addon profile.
+	azurePolicyAddon = "azurepolicy"
+
+	// ingressAppGatewayAddon is the name of the application gateway ingress controller addon profile.
+	ingressAppGatewayAddon = "ingressApplicationGateway"
+)
+
+// ReconcileResult describes the change a reconcile applied to a managed cluster.
+type ReconcileResult string
+
+const (
+	// Created means the managed cluster did not exist and was created.
+	Created ReconcileResult = "Created"
+	// Updated means the existing managed cluster differed from its specification and was updated.
+	Updated ReconcileResult = "Updated"
+	// NoChange means the existing managed cluster already matched its specification.
+	NoChange ReconcileResult = "NoChange"
 )
 
 // Spec contains properties to create a managed cluster.
@@ -44,25 +119,51 @@ type Spec struct {
 	// Location is a string matching one of the canonical Azure region names. Examples: "westus2", "eastus".
 	Location string
 
+	// DNSPrefix is the DNS prefix of the cluster's API server FQDN. Defaults to the cluster name, with characters
+	// that are invalid in a DNS prefix removed, on create and to the existing cluster's prefix on update.
+	DNSPrefix string
+
+	// NodeResourceGroup is the name of the resource group AKS creates for the cluster's node resources.
+	// Defaults to a name generated by AKS. It is immutable after the cluster is created.
+	NodeResourceGroup string
+
 	// Tags is a set of tags to add to this cluster.
 	Tags map[string]string
 
+	// CreateResourceGroup creates ResourceGroup, in Location and with Tags, when it doesn't exist.
+	// When false a missing resource group is an error.
+	CreateResourceGroup bool
+
 	// Version defines the desired Kubernetes version.
 	Version string
 
 	// LoadBalancerSKU for the managed cluster. Possible values include: 'Standard', 'Basic'. Defaults to standard.
 	LoadBalancerSKU *string
 
+	// LoadBalancerProfile configures the outbound connectivity of the cluster's Standard load balancer.
+	// Defaults to a single managed outbound IP with ports allocated by AKS.
+	LoadBalancerProfile *LoadBalancerProfile
+
 	// NetworkPlugin used for building Kubernetes network. Possible values include: 'Azure', 'Kubenet'. Defaults to Azure.
 	NetworkPlugin *string
 
 	// NetworkPolicy used for building Kubernetes network. Possible values include: 'Calico', 'Azure'. Defaults to Azure.
 	NetworkPolicy *string
 
+	// OutboundType is how the cluster's egress traffic leaves the virtual network. Possible values include: 'loadBalancer',
+	// 'userDefinedRouting'. Defaults to loadBalancer. userDefinedRouting sends egress through the route tables of the
+	// agent pools' existing subnets, for example to an Azure Firewall.
+	OutboundType *string
+
 	// SSHPublicKey is a string literal containing an ssh public key. Will autogenerate and discard if not provided.
 	SSHPublicKey string
 
-	// AgentPools is the list of agent pool specifications in this cluster.
+	// WindowsProfile holds the administrator credentials of the cluster's Windows nodes. It is required
+	// when any agent pool runs Windows.
+	WindowsProfile *WindowsProfile
+
+	// AgentPools is the list of agent pool specifications in this cluster. The first pool is the cluster's
+	// system pool, which runs the system pods, so it can't be a spot pool.
 	AgentPools []PoolSpec
 
 	// PodCIDR is the CIDR block for IP addresses distributed to pods
@@ -70,22 +171,297 @@ type Spec struct {
 
 	// ServiceCIDR is the CIDR block for IP addresses distributed to services
 	ServiceCIDR string
+
+	// DNSServiceIP is the IP address of the cluster DNS service. It must be a host address of the service CIDR,
+	// and defaults to its .10 address.
+	DNSServiceIP string
+
+	// DockerBridgeCIDR is the address and prefix of the docker bridge on each node, for example 172.17.0.1/16.
+	// It must not overlap the pod and service CIDRs.
+	DockerBridgeCIDR string
+
+	// EnablePrivateCluster exposes the API server through a private endpoint in the node subnet instead of a public FQDN.
+	EnablePrivateCluster *bool
+
+	// APIServerAccessProfile restricts which addresses can reach the API server. When nil the existing
+	// restrictions are left unchanged.
+	APIServerAccessProfile *APIServerAccessProfile
+
+	// ManageAgentPools controls whether Reconcile owns the cluster's agent pools. When false, AgentPools are only
+	// sent to create the cluster, and existing pools are left to be managed out-of-band. Defaults to true.
+	ManageAgentPools *bool
+
+	// EnableHTTPApplicationRouting deploys the HTTP application routing addon, an ingress controller with
+	// automatically created DNS records. It is intended for development clusters and is not recommended for production.
+	EnableHTTPApplicationRouting *bool
+
+	// EnableAzurePolicy deploys the Azure Policy addon, which enforces policies with Gatekeeper. When nil the addon is left unset.
+	EnableAzurePolicy *bool
+
+	// IngressAppGateway deploys the application gateway ingress controller addon. When nil the addon is omitted.
+	IngressAppGateway *IngressAppGateway
+
+	// AddonProfiles enables or disables addons by name, for example "omsagent" with a logAnalyticsWorkspaceResourceID config.
+	// Addons it doesn't set are left unchanged, unless they are listed in PreviousAddons. An addon can't be set both here
+	// and by a field above.
+	AddonProfiles map[string]AddonProfile
+
+	// PreviousAddons are the names of the addons AddonProfiles set when the cluster was last reconciled. Those that
+	// AddonProfiles no longer sets are disabled, while addons enabled outside of this spec are left alone.
+	PreviousAddons []string
+}
+
+// AddonProfile contains the settings of a managed cluster addon.
+type AddonProfile struct {
+	// Enabled deploys the addon when true and removes it when false.
+	Enabled bool
+
+	// Config is the addon specific configuration.
+	Config map[string]string
+}
+
+// IngressAppGateway selects the application gateway used by the ingress controller addon. Exactly one field must be set.
+type IngressAppGateway struct {
+	// ApplicationGatewayID is the resource ID of an existing application gateway.
+	ApplicationGatewayID string
+
+	// SubnetCIDR is the address range of a subnet AKS creates in the cluster's virtual network for a new application gateway.
+	SubnetCIDR string
+}
+
+// WindowsProfile contains the administrator account created on Windows nodes.
+type WindowsProfile struct {
+	// AdminUsername is the name of the administrator account.
+	AdminUsername string
+
+	// AdminPassword is the password of the administrator account. AKS doesn't return it, so changing
+	// it alone doesn't update an existing cluster.
+	AdminPassword string
+}
+
+// APIServerAccessProfile contains the access settings of a managed cluster's API server.
+type APIServerAccessProfile struct {
+	// AuthorizedIPRanges are the IP addresses and CIDRs allowed to reach the public API server.
+	// An empty list removes every restriction. It can't be used with private clusters.
+	AuthorizedIPRanges []string
+}
+
+// LoadBalancerProfile contains the outbound settings of a managed cluster's load balancer.
+// At most one of ManagedOutboundIPCount, OutboundIPs and OutboundIPPrefixes can be set.
+type LoadBalancerProfile struct {
+	// ManagedOutboundIPCount is the number of outbound public IPs AKS creates for the load balancer, from 1 to 100.
+	ManagedOutboundIPCount *int32
+
+	// OutboundIPs are the resource IDs of existing public IPs used for outbound traffic.
+	OutboundIPs []string
+
+	// OutboundIPPrefixes are the resource IDs of existing public IP prefixes used for outbound traffic.
+	OutboundIPPrefixes []string
+
+	// IdleTimeoutInMinutes is how long an idle outbound flow is kept open, from 4 to 120 minutes. Defaults to 30 minutes.
+	IdleTimeoutInMinutes *int32
+
+	// AllocatedOutboundPorts is the number of SNAT ports allocated to each node, a multiple of 8 from 0 to 64000.
+	// 0 lets Azure allocate ports based on the size of the backend pool.
+	AllocatedOutboundPorts *int32
 }
 
 type PoolSpec struct {
-	Name         string
-	SKU          string
-	Replicas     int32
+	Name     string
+	SKU      string
+	Replicas int32
+
+	// Version is the Kubernetes version of the pool's nodes, which can't be newer than the cluster's.
+	// Defaults to the cluster's version.
+	Version string
+
+	// OSDiskSizeGB is the size of each node's OS disk, from 30 to 2048 GB. 0 means the default size for the VM size.
 	OSDiskSizeGB int32
+
+	// OSType is the operating system of the pool's nodes. Possible values include: 'Linux', 'Windows'. Defaults to Linux.
+	OSType string
+
+	// VnetSubnetID is the resource ID of an existing subnet the pool's nodes join. Defaults to a subnet in an AKS managed virtual network.
+	VnetSubnetID string
+
+	// MaxPods is the maximum number of pods per node, from 10 to 250. With Azure CNI every pod takes an address
+	// in the node subnet, so it controls the subnet's IP consumption. Defaults to 30 with Azure CNI and 110 with kubenet.
+	// It can't be changed after the pool is created.
+	MaxPods *int32
+
+	// NodeTaints are the taints added to new nodes in this pool, in the form key=value:Effect.
+	NodeTaints []string
+
+	// ScaleSetPriority is the priority of the pool's virtual machine scale set. Possible values include: 'Regular', 'Spot'. Defaults to Regular.
+	ScaleSetPriority string
+
+	// ScaleSetEvictionPolicy is the eviction policy for spot pools. Possible values include: 'Delete', 'Deallocate'. Defaults to Delete.
+	ScaleSetEvictionPolicy string
+
+	// EnableNodePublicIP assigns each node in the pool its own public IP address. When nil the setting is left to AKS, which disables it.
+	EnableNodePublicIP *bool
+
+	// EnableAutoScaling lets the cluster autoscaler manage the pool's node count between MinCount and MaxCount.
+	// Replicas is then only the initial node count, and updates keep the pool's current count.
+	EnableAutoScaling *bool
+
+	// MinCount and MaxCount bound the node count of an autoscaled pool.
+	MinCount *int32
+	MaxCount *int32
+
+	// AvailabilityZones are the zones the pool's nodes are spread across, for example "1", "2" and "3".
+	// They need the Standard load balancer SKU and can't be changed after the pool is created.
+	AvailabilityZones []string
+}
+
+// PoolStatus summarizes the observed state of an agent pool.
+type PoolStatus struct {
+	Name              string
+	Count             int32
+	ProvisioningState string
+
+	// PowerState is whether the pool's nodes are running or stopped. The AKS API in use doesn't report
+	// power state yet, so it is always empty.
+	PowerState string
 }
 
-// Get fetches a managed cluster from Azure.
+// Get fetches a managed cluster from Azure. When the cluster doesn't exist the error matches ErrManagedClusterNotFound.
 func (s *Service) Get(ctx context.Context, spec interface{}) (interface{}, error) {
 	managedClusterSpec, ok := spec.(*Spec)
 	if !ok {
 		return nil, errors.New("expected managed cluster specification")
 	}
-	return s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	managedCluster, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	if err != nil && azure.ResourceNotFound(err) {
+		return managedCluster, &managedClusterNotFoundError{name: managedClusterSpec.Name, err: err}
+	}
+	return managedCluster, err
+}
+
+// GetKubeconfig fetches a managed cluster's admin kubeconfig from Azure and parses it.
+func (s *Service) GetKubeconfig(ctx context.Context, group, name string) (*clientcmdapi.Config, error) {
+	data, err := s.Client.GetCredentials(ctx, group, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get credentials for managed cluster %s", name)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse kubeconfig of managed cluster %s", name)
+	}
+	// An error blob from ARM can still decode into an empty config.
+	if len(config.Clusters) == 0 {
+		return nil, errors.Errorf("failed to parse kubeconfig of managed cluster %s: no clusters found", name)
+	}
+	return config, nil
+}
+
+// GetFQDN fetches the fully qualified domain name of a managed cluster's API server from Azure.
+// Private clusters return their private FQDN.
+func (s *Service) GetFQDN(ctx context.Context, spec interface{}) (string, error) {
+	managedClusterSpec, ok := spec.(*Spec)
+	if !ok {
+		return "", errors.New("expected managed cluster specification")
+	}
+
+	cluster, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get managed cluster %s", managedClusterSpec.Name)
+	}
+	if cluster.ManagedClusterProperties == nil {
+		return "", errors.Errorf("managed cluster %s has no properties", managedClusterSpec.Name)
+	}
+
+	fqdn := APIServerFQDN(cluster)
+	if fqdn == "" {
+		return "", errors.Errorf("managed cluster %s has no FQDN yet, provisioning state is %s", managedClusterSpec.Name, to.String(cluster.ProvisioningState))
+	}
+	return fqdn, nil
+}
+
+// APIServerFQDN returns the FQDN of a managed cluster's API server, which is the private FQDN for private clusters.
+// It is empty until AKS has assigned one.
+func APIServerFQDN(cluster containerservice.ManagedCluster) string {
+	if cluster.ManagedClusterProperties == nil {
+		return ""
+	}
+	if cluster.APIServerAccessProfile != nil && to.Bool(cluster.APIServerAccessProfile.EnablePrivateCluster) {
+		return to.String(cluster.PrivateFQDN)
+	}
+	return to.String(cluster.Fqdn)
+}
+
+// GetUpgradeProfile fetches the versions a managed cluster's control plane and agent pools can upgrade to.
+// When the cluster doesn't exist the error matches ErrManagedClusterNotFound.
+func (s *Service) GetUpgradeProfile(ctx context.Context, group, name string) (containerservice.ManagedClusterUpgradeProfile, error) {
+	profile, err := s.Client.GetUpgradeProfile(ctx, group, name)
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			return containerservice.ManagedClusterUpgradeProfile{}, &managedClusterNotFoundError{name: name, err: err}
+		}
+		return containerservice.ManagedClusterUpgradeProfile{}, errors.Wrapf(err, "failed to get upgrade profile of managed cluster %s", name)
+	}
+	return profile, nil
+}
+
+// WaitForReady polls a managed cluster every pollInterval until it has provisioned successfully. It fails when
+// provisioning fails, or when ctx is done first.
+func (s *Service) WaitForReady(ctx context.Context, spec interface{}, pollInterval time.Duration) error {
+	managedClusterSpec, ok := spec.(*Spec)
+	if !ok {
+		return errors.New("expected managed cluster specification")
+	}
+
+	log := s.clusterLogger(managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	for {
+		cluster, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get managed cluster %s", managedClusterSpec.Name)
+		}
+
+		state := ""
+		if cluster.ManagedClusterProperties != nil {
+			state = to.String(cluster.ProvisioningState)
+		}
+		switch state {
+		case provisioningStateSucceeded:
+			return nil
+		case provisioningStateFailed:
+			return errors.Errorf("managed cluster %s failed to provision, provisioning state is %s", managedClusterSpec.Name, state)
+		}
+
+		log.V(4).Info("waiting for managed cluster to be ready", "provisioningState", state)
+		if err := waitForRetry(ctx, pollInterval); err != nil {
+			return errors.Wrapf(err, "managed cluster %s is not ready, provisioning state is %s", managedClusterSpec.Name, state)
+		}
+	}
+}
+
+// GetIdentityPrincipalID fetches the principal ID of a managed cluster's system assigned identity, for role
+// assignments that can only be made once the cluster exists.
+func (s *Service) GetIdentityPrincipalID(ctx context.Context, spec interface{}) (string, error) {
+	managedClusterSpec, ok := spec.(*Spec)
+	if !ok {
+		return "", errors.New("expected managed cluster specification")
+	}
+
+	cluster, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			return "", &managedClusterNotFoundError{name: managedClusterSpec.Name, err: err}
+		}
+		return "", errors.Wrapf(err, "failed to get managed cluster %s", managedClusterSpec.Name)
+	}
+	if !usesManagedIdentity(cluster) {
+		return "", errors.Errorf("managed cluster %s uses a service principal, not a managed identity", managedClusterSpec.Name)
+	}
+	if cluster.Identity == nil || to.String(cluster.Identity.PrincipalID) == "" {
+		state := ""
+		if cluster.ManagedClusterProperties != nil {
+			state = to.String(cluster.ProvisioningState)
+		}
+		return "", errors.Errorf("managed cluster %s has no identity principal ID yet, provisioning state is %s", managedClusterSpec.Name, state)
+	}
+	return *cluster.Identity.PrincipalID, nil
 }
 
 // Get fetches a managed cluster kubeconfig from Azure.
@@ -95,114 +471,1342 @@ func (s *Service) GetCredentials(ctx context.Context, group, name string) ([]byt
 
 // Reconcile idempotently creates or updates a managed cluster, if possible.
 func (s *Service) Reconcile(ctx context.Context, spec interface{}) error {
+	_, err := s.ReconcileWithResult(ctx, spec)
+	return err
+}
+
+// ReconcileWithResult idempotently creates or updates a managed cluster, if possible,
+// and reports which change was applied.
+func (s *Service) ReconcileWithResult(ctx context.Context, spec interface{}) (ReconcileResult, error) {
 	managedClusterSpec, ok := spec.(*Spec)
 	if !ok {
-		return errors.New("expected managed cluster specification")
+		return NoChange, errors.New("expected managed cluster specification")
 	}
 
-	properties := containerservice.ManagedCluster{
-		Identity: &containerservice.ManagedClusterIdentity{
-			Type: containerservice.SystemAssigned,
-		},
-		Location: &managedClusterSpec.Location,
-		ManagedClusterProperties: &containerservice.ManagedClusterProperties{
-			DNSPrefix:         &managedClusterSpec.Name,
-			KubernetesVersion: &managedClusterSpec.Version,
-			LinuxProfile: &containerservice.LinuxProfile{
-				AdminUsername: &defaultUser,
-				SSH: &containerservice.SSHConfiguration{
-					PublicKeys: &[]containerservice.SSHPublicKey{
-						{
-							KeyData: &managedClusterSpec.SSHPublicKey,
-						},
-					},
-				},
-			},
-			ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
-				ClientID: &managedIdentity,
-			},
-			AgentPoolProfiles: &[]containerservice.ManagedClusterAgentPoolProfile{},
-			NetworkProfile: &containerservice.NetworkProfileType{
-				NetworkPlugin:   containerservice.Azure,
-				LoadBalancerSku: containerservice.Standard,
-			},
-		},
+	return s.ReconcileWithExisting(ctx, managedClusterSpec, nil)
+}
+
+// ReconcileWithExisting is ReconcileWithResult for callers that already hold the live managed cluster, for example
+// from a prior status fetch, and saves fetching it again. When existing is nil the cluster is fetched from Azure.
+func (s *Service) ReconcileWithExisting(ctx context.Context, managedClusterSpec *Spec, existing *containerservice.ManagedCluster) (ReconcileResult, error) {
+	log := s.clusterLogger(managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	log.V(2).Info("reconciling managed cluster")
+	result, err := s.reconcile(ctx, log, managedClusterSpec, existing, func(properties containerservice.ManagedCluster) error {
+		return s.createOrUpdate(ctx, log, managedClusterSpec, properties)
+	})
+	if err != nil {
+		return result, err
 	}
+	log.V(2).Info("successfully reconciled managed cluster", "result", result)
+	return result, nil
+}
 
-	if managedClusterSpec.NetworkPlugin != nil {
-		properties.NetworkProfile.NetworkPlugin = containerservice.NetworkPlugin(*managedClusterSpec.NetworkPlugin)
+// ReconcileAsync is ReconcileWithExisting that only starts the create or update, so callers aren't blocked while AKS
+// provisions the cluster. The returned future is nil when no change was needed; otherwise poll it with IsDone.
+// The result reports the change that was started.
+func (s *Service) ReconcileAsync(ctx context.Context, managedClusterSpec *Spec, existing *containerservice.ManagedCluster) (ReconcileResult, *azureautorest.Future, error) {
+	log := s.clusterLogger(managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	log.V(2).Info("reconciling managed cluster asynchronously")
+	var future *azureautorest.Future
+	result, err := s.reconcile(ctx, log, managedClusterSpec, existing, func(properties containerservice.ManagedCluster) error {
+		return s.retryThrottled(ctx, log, func() error {
+			started, err := s.Client.CreateOrUpdateAsync(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, properties)
+			if err != nil {
+				return err
+			}
+			future = &started
+			return nil
+		})
+	})
+	if err != nil {
+		return result, nil, err
 	}
+	log.V(2).Info("successfully started reconciling managed cluster", "result", result)
+	return result, future, nil
+}
 
-	if managedClusterSpec.PodCIDR != "" {
-		properties.NetworkProfile.PodCidr = &managedClusterSpec.PodCIDR
+// IsDone reports whether an operation started by ReconcileAsync or RotateClusterCertificatesAsync has completed.
+// A failed operation is an error, which is an ErrSubnetExhausted when AKS ran out of addresses in a node subnet.
+func (s *Service) IsDone(ctx context.Context, future azureautorest.Future) (bool, error) {
+	done, err := s.Client.IsDone(ctx, future)
+	if err != nil {
+		if exhausted, ok := subnetExhausted(err); ok {
+			return false, errors.Wrap(exhausted, "managed cluster operation failed")
+		}
+		return false, errors.Wrap(err, "managed cluster operation failed")
 	}
+	return done, nil
+}
 
-	if managedClusterSpec.ServiceCIDR != "" {
-		properties.NetworkProfile.ServiceCidr = &managedClusterSpec.ServiceCIDR
-		ip, _, err := net.ParseCIDR(managedClusterSpec.ServiceCIDR)
-		if err != nil {
-			return fmt.Errorf("failed to parse service cidr: %w", err)
-		}
-		// HACK: set the last octet of the IP to .10
-		// This ensures the dns IP is valid in the service cidr without forcing the user
-		// to specify it in both the Capi cluster and the Azure control plane.
-		// https://golang.org/src/net/ip.go#L48
-		ip[15] = byte(10)
-		dnsIP := ip.String()
-		properties.NetworkProfile.DNSServiceIP = &dnsIP
+// reconcile creates or updates a managed cluster, if possible, and reports which change was applied.
+// send is called with the managed cluster to create or update, unless no change is needed.
+func (s *Service) reconcile(ctx context.Context, log logr.Logger, managedClusterSpec *Spec, existing *containerservice.ManagedCluster, send func(containerservice.ManagedCluster) error) (ReconcileResult, error) {
+	if err := managedClusterSpec.Validate(); err != nil {
+		return NoChange, err
+	}
 
+	isCreate := false
+	if existing == nil {
+		managedCluster, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+		if err != nil && !azure.ResourceNotFound(err) {
+			return NoChange, errors.Wrap(err, "failed to get existing managed cluster")
+		}
+		isCreate = azure.ResourceNotFound(err)
+		existing = &managedCluster
 	}
 
-	if managedClusterSpec.NetworkPolicy != nil {
-		if strings.EqualFold(*managedClusterSpec.NetworkPolicy, "Azure") {
-			properties.NetworkProfile.NetworkPolicy = containerservice.NetworkPolicyAzure
-		} else if strings.EqualFold(*managedClusterSpec.NetworkPolicy, "Calico") {
-			properties.NetworkProfile.NetworkPolicy = containerservice.NetworkPolicyCalico
-		} else {
-			return fmt.Errorf("invalid network policy: '%s'. Allowed options are 'calico' and 'azure'", *managedClusterSpec.NetworkPolicy)
+	// Listing the VM sizes of a location is slow, so only the sizes of new or resized pools are checked.
+	if pools := poolsWithNewSKUs(managedClusterSpec.AgentPools, *existing, isCreate); s.ResourceSkusClient != nil && len(pools) > 0 {
+		if err := s.ValidatePoolSKUs(ctx, managedClusterSpec.Location, pools); err != nil {
+			return NoChange, err
 		}
 	}
 
-	if managedClusterSpec.LoadBalancerSKU != nil {
-		properties.NetworkProfile.LoadBalancerSku = containerservice.LoadBalancerSku(*managedClusterSpec.LoadBalancerSKU)
+	if s.GroupsClient != nil {
+		if err := s.ensureResourceGroup(ctx, log, managedClusterSpec); err != nil {
+			return NoChange, err
+		}
 	}
 
-	for _, pool := range managedClusterSpec.AgentPools {
-		profile := containerservice.ManagedClusterAgentPoolProfile{
-			Name:         &pool.Name,
-			VMSize:       containerservice.VMSizeTypes(pool.SKU),
-			OsDiskSizeGB: &pool.OSDiskSizeGB,
-			Count:        &pool.Replicas,
-			Type:         containerservice.VirtualMachineScaleSets,
+	properties, err := buildManagedCluster(managedClusterSpec)
+	if err != nil {
+		return NoChange, err
+	}
+
+	// AKS only accepts agent pools through the managed cluster at create time, and requires at least one.
+	if isCreate && len(managedClusterSpec.AgentPools) == 0 {
+		return NoChange, errors.New("at least one agent pool is required")
+	}
+
+	if !isCreate && managedClusterSpec.DNSPrefix == "" && existing.ManagedClusterProperties != nil && existing.DNSPrefix != nil {
+		// The DNS prefix is only defaulted on create. It can't be changed, and older clusters used their
+		// name as the prefix without removing invalid characters.
+		properties.DNSPrefix = existing.DNSPrefix
+	}
+
+	if !isCreate && managedClusterSpec.ManageAgentPools != nil && !*managedClusterSpec.ManageAgentPools {
+		// Omitting the profiles leaves the cluster's existing agent pools untouched.
+		properties.AgentPoolProfiles = nil
+	}
+
+	if !isCreate && properties.AgentPoolProfiles != nil {
+		keepAutoscaledCounts(*properties.AgentPoolProfiles, *existing)
+	}
+
+	if !isCreate && len(managedClusterSpec.PreviousAddons) > 0 {
+		disableRemovedAddons(&properties, *existing, managedClusterSpec.PreviousAddons)
+	}
+
+	if !isCreate && properties.NodeResourceGroup != nil && existing.ManagedClusterProperties != nil &&
+		existing.NodeResourceGroup != nil && !strings.EqualFold(*existing.NodeResourceGroup, *properties.NodeResourceGroup) {
+		// The node resource group can't be changed, so keep the existing one rather than fail the update.
+		log.Info("node resource group is immutable, keeping the existing one",
+			"nodeResourceGroup", *existing.NodeResourceGroup, "requestedNodeResourceGroup", *properties.NodeResourceGroup)
+		properties.NodeResourceGroup = existing.NodeResourceGroup
+	}
+
+	var normalized containerservice.ManagedCluster
+	if !isCreate {
+		// For updates, compare against the existing cluster normalized to the properties
+		// we send, since AKS populates defaults and read-only values.
+		normalized = normalizeManagedCluster(*existing, properties)
+		diff := cmp.Diff(properties, normalized)
+		if diff == "" {
+			log.V(2).Info("normalized and desired managed cluster matched, no update needed")
+			return NoChange, nil
+		}
+		log.V(2).Info("update required (+new -old)", "diff", diff)
+	}
+
+	if s.LocationsClient != nil {
+		if err := s.validateLocation(ctx, managedClusterSpec.Location); err != nil {
+			return NoChange, err
+		}
+	}
+
+	if s.SubnetsClient != nil {
+		if err := s.validateSubnets(ctx, managedClusterSpec); err != nil {
+			return NoChange, err
+		}
+	}
+
+	if !isCreate {
+		// Scaling or upgrading pools only needs the pools themselves to change, not a managed cluster update.
+		if pools, ok := poolOnlyChanges(properties, normalized); ok && s.AgentPoolsClient != nil {
+			if err := s.updatePools(ctx, log, managedClusterSpec, *existing, pools); err != nil {
+				return NoChange, err
+			}
+			return Updated, nil
+		}
+
+		// AKS replaces the whole cluster on update, so send what's already there along with our changes.
+		properties = mergeManagedCluster(*existing, properties)
+	}
+
+	err = send(properties)
+	if err != nil {
+		if exhausted, ok := subnetExhausted(err); ok {
+			return NoChange, errors.Wrap(exhausted, "failed to create or update managed cluster")
+		}
+		return NoChange, errors.Wrap(err, "failed to create or update managed cluster")
+	}
+
+	if isCreate {
+		return Created, nil
+	}
+	return Updated, nil
+}
+
+// GetAgentPool fetches a single agent pool of a managed cluster from Azure.
+func (s *Service) GetAgentPool(ctx context.Context, group, clusterName, poolName string) (containerservice.AgentPool, error) {
+	pool, err := s.AgentPoolsClient.Get(ctx, group, clusterName, poolName)
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			return containerservice.AgentPool{}, &agentPoolNotFoundError{cluster: clusterName, name: poolName, err: err}
+		}
+		return containerservice.AgentPool{}, errors.Wrapf(err, "failed to get agent pool %s", poolName)
+	}
+	return pool, nil
+}
+
+// GetPoolStatuses lists the agent pools of a managed cluster with their node count and provisioning state.
+// A cluster without agent pools yields an empty slice.
+func (s *Service) GetPoolStatuses(ctx context.Context, group, clusterName string) ([]PoolStatus, error) {
+	pools, err := s.AgentPoolsClient.List(ctx, group, clusterName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list agent pools of managed cluster %s", clusterName)
+	}
+
+	statuses := make([]PoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		status := PoolStatus{Name: to.String(pool.Name)}
+		if pool.ManagedClusterAgentPoolProfileProperties != nil {
+			status.Count = to.Int32(pool.Count)
+			status.ProvisioningState = to.String(pool.ProvisioningState)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// GetPoolSpecs fetches a managed cluster and converts its agent pools back into pool specifications,
+// so callers can build an updated spec from the observed state.
+func (s *Service) GetPoolSpecs(ctx context.Context, group, name string) ([]PoolSpec, error) {
+	managedCluster, err := s.Client.Get(ctx, group, name)
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			return nil, &managedClusterNotFoundError{name: name, err: err}
 		}
-		*properties.AgentPoolProfiles = append(*properties.AgentPoolProfiles, profile)
+		return nil, errors.Wrapf(err, "failed to get managed cluster %s", name)
+	}
+
+	pools := []PoolSpec{}
+	if managedCluster.ManagedClusterProperties == nil || managedCluster.AgentPoolProfiles == nil {
+		return pools, nil
+	}
+	for _, profile := range *managedCluster.AgentPoolProfiles {
+		pools = append(pools, poolSpecFromProfile(profile))
 	}
+	return pools, nil
+}
 
-	err := s.Client.CreateOrUpdate(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, properties)
+// ScalePool sets the node count of a single agent pool through the agent pools API, leaving the rest
+// of the managed cluster untouched. Other changes to a pool still go through Reconcile.
+func (s *Service) ScalePool(ctx context.Context, group, clusterName string, pool PoolSpec) error {
+	log := s.clusterLogger(group, clusterName).WithValues("agentPool", pool.Name)
+	existing, err := s.AgentPoolsClient.Get(ctx, group, clusterName, pool.Name)
 	if err != nil {
-		return fmt.Errorf("failed to create or update managed cluster, %#+v", err)
+		return errors.Wrapf(err, "failed to get agent pool %s", pool.Name)
+	}
+	if existing.ManagedClusterAgentPoolProfileProperties == nil {
+		return errors.Errorf("agent pool %s has no properties", pool.Name)
+	}
+
+	if to.Bool(existing.EnableAutoScaling) {
+		return errors.Errorf("cannot scale agent pool %s: its node count is managed by the cluster autoscaler", pool.Name)
 	}
 
+	if existing.Count != nil && *existing.Count == pool.Replicas {
+		log.V(2).Info("agent pool already has the desired node count, no scaling needed", "replicas", pool.Replicas)
+		return nil
+	}
+
+	log.V(2).Info("scaling agent pool", "replicas", pool.Replicas)
+	existing.Count = to.Int32Ptr(pool.Replicas)
+	if err := s.AgentPoolsClient.CreateOrUpdate(ctx, group, clusterName, pool.Name, existing); err != nil {
+		return errors.Wrapf(err, "failed to scale agent pool %s", pool.Name)
+	}
 	return nil
 }
 
-// Delete deletes the virtual network with the provided name.
-func (s *Service) Delete(ctx context.Context, spec interface{}) error {
+// DeleteAgentPool deletes a single agent pool of a managed cluster, leaving the rest of the cluster untouched.
+// The cluster's last agent pool can't be deleted, and a pool that is already gone is not an error.
+func (s *Service) DeleteAgentPool(ctx context.Context, group, clusterName, poolName string) error {
+	pools, err := s.AgentPoolsClient.List(ctx, group, clusterName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list agent pools of managed cluster %s", clusterName)
+	}
+
+	found := false
+	for _, pool := range pools {
+		if to.String(pool.Name) == poolName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	// Every managed cluster needs at least one agent pool to run its system pods.
+	if len(pools) == 1 {
+		return errors.Errorf("cannot delete agent pool %s: it is the last agent pool in managed cluster %s", poolName, clusterName)
+	}
+
+	log := s.clusterLogger(group, clusterName).WithValues("agentPool", poolName)
+	log.V(2).Info("deleting agent pool")
+	if err := s.AgentPoolsClient.Delete(ctx, group, clusterName, poolName); err != nil && !azure.ResourceNotFound(errors.Cause(err)) {
+		return errors.Wrapf(err, "failed to delete agent pool %s", poolName)
+	}
+	log.V(2).Info("successfully deleted agent pool")
+	return nil
+}
+
+// ReconcilePools brings the agent pools of an existing managed cluster in line with the specification,
+// creating pools that are missing and deleting pools that are no longer specified. AKS does not remove
+// pools omitted from a managed cluster update, so they are deleted through the agent pools API.
+// The cluster's first pool runs its system pods, so it is only deleted once the first pool of the
+// specification already existed, and otherwise on a later call.
+func (s *Service) ReconcilePools(ctx context.Context, spec interface{}) error {
 	managedClusterSpec, ok := spec.(*Spec)
 	if !ok {
 		return errors.New("expected managed cluster specification")
 	}
 
-	klog.V(2).Infof("Deleting managed cluster  %s ", managedClusterSpec.Name)
-	err := s.Client.Delete(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	if err := managedClusterSpec.Validate(); err != nil {
+		return err
+	}
+
+	log := s.clusterLogger(managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	existing, err := s.Client.Get(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
 	if err != nil {
-		if azure.ResourceNotFound(err) {
-			// already deleted
-			return nil
-		}
-		return errors.Wrapf(err, "failed to delete managed cluster %s in resource group %s", managedClusterSpec.Name, managedClusterSpec.ResourceGroup)
+		return errors.Wrapf(err, "failed to get managed cluster %s", managedClusterSpec.Name)
 	}
 
-	klog.V(2).Infof("successfully deleted managed cluster %s ", managedClusterSpec.Name)
+	var liveNames []string
+	live := map[string]bool{}
+	if existing.ManagedClusterProperties != nil && existing.AgentPoolProfiles != nil {
+		for _, profile := range *existing.AgentPoolProfiles {
+			liveNames = append(liveNames, to.String(profile.Name))
+			live[to.String(profile.Name)] = true
+		}
+	}
+
+	// The first pool of the specification replaces the existing system pool once it existed before this call.
+	replacementReady := len(managedClusterSpec.AgentPools) > 0 && live[managedClusterSpec.AgentPools[0].Name]
+
+	desired := map[string]bool{}
+	for _, pool := range managedClusterSpec.AgentPools {
+		desired[pool.Name] = true
+		if live[pool.Name] {
+			continue
+		}
+		log.V(2).Info("creating agent pool", "agentPool", pool.Name)
+		agentPool := agentPoolFromProfile(buildAgentPoolProfile(pool))
+		if err := s.AgentPoolsClient.CreateOrUpdate(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, pool.Name, agentPool); err != nil {
+			return errors.Wrapf(err, "failed to create agent pool %s", pool.Name)
+		}
+	}
+
+	for _, name := range liveNames {
+		if desired[name] {
+			continue
+		}
+		// Every managed cluster needs at least one agent pool to run its system pods.
+		if len(desired) == 0 {
+			return errors.Errorf("cannot delete agent pool %s: it is the last agent pool in managed cluster %s", name, managedClusterSpec.Name)
+		}
+		if name == liveNames[0] && !replacementReady {
+			log.V(2).Info("keeping system agent pool until its replacement exists", "agentPool", name, "replacement", managedClusterSpec.AgentPools[0].Name)
+			continue
+		}
+		log.V(2).Info("deleting agent pool", "agentPool", name)
+		if err := s.AgentPoolsClient.Delete(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, name); err != nil && !azure.ResourceNotFound(errors.Cause(err)) {
+			return errors.Wrapf(err, "failed to delete agent pool %s", name)
+		}
+	}
+
+	return nil
+}
+
+// poolOnlyChanges returns the desired agent pool profiles whose node count or Kubernetes version differs from
+// the normalized existing cluster, when nothing else in the managed cluster differs.
+func poolOnlyChanges(desired, normalized containerservice.ManagedCluster) ([]containerservice.ManagedClusterAgentPoolProfile, bool) {
+	if desired.ManagedClusterProperties == nil || normalized.ManagedClusterProperties == nil ||
+		desired.AgentPoolProfiles == nil || normalized.AgentPoolProfiles == nil ||
+		len(*desired.AgentPoolProfiles) != len(*normalized.AgentPoolProfiles) {
+		return nil, false
+	}
+
+	var changed []containerservice.ManagedClusterAgentPoolProfile
+	unchanged := make([]containerservice.ManagedClusterAgentPoolProfile, 0, len(*desired.AgentPoolProfiles))
+	for _, pool := range *desired.AgentPoolProfiles {
+		current, ok := findAgentPoolProfile(*normalized.AgentPoolProfiles, to.String(pool.Name))
+		if !ok {
+			return nil, false
+		}
+		if to.Int32(pool.Count) != to.Int32(current.Count) || to.String(pool.OrchestratorVersion) != to.String(current.OrchestratorVersion) {
+			changed = append(changed, pool)
+		}
+		pool.Count, pool.OrchestratorVersion = current.Count, current.OrchestratorVersion
+		unchanged = append(unchanged, pool)
+	}
+
+	// Compare on copies, so the caller's properties keep the changes.
+	properties := *desired.ManagedClusterProperties
+	properties.AgentPoolProfiles = &unchanged
+	desired.ManagedClusterProperties = &properties
+	if len(changed) == 0 || cmp.Diff(desired, normalized) != "" {
+		return nil, false
+	}
+	return changed, true
+}
+
+// updatePools sets the node count and Kubernetes version of agent pools through the agent pools API, keeping the
+// rest of each pool's current settings. AKS rejects an operation while another one is in progress on the
+// cluster, so the pools are updated one at a time.
+func (s *Service) updatePools(ctx context.Context, log logr.Logger, managedClusterSpec *Spec, existing containerservice.ManagedCluster, pools []containerservice.ManagedClusterAgentPoolProfile) error {
+	for _, pool := range pools {
+		name := to.String(pool.Name)
+		current, _ := findAgentPoolProfile(*existing.AgentPoolProfiles, name)
+		agentPool := agentPoolFromProfile(current)
+		agentPool.Count = pool.Count
+		if pool.OrchestratorVersion != nil {
+			agentPool.OrchestratorVersion = pool.OrchestratorVersion
+		}
+
+		log.V(2).Info("updating agent pool", "agentPool", name, "count", to.Int32(agentPool.Count), "version", to.String(agentPool.OrchestratorVersion))
+		err := s.retryThrottled(ctx, log, func() error {
+			return s.AgentPoolsClient.CreateOrUpdate(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, name, agentPool)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update agent pool %s", name)
+		}
+	}
+	return nil
+}
+
+// findAgentPoolProfile returns the agent pool profile with the given name.
+func findAgentPoolProfile(profiles []containerservice.ManagedClusterAgentPoolProfile, name string) (containerservice.ManagedClusterAgentPoolProfile, bool) {
+	for _, profile := range profiles {
+		if to.String(profile.Name) == name {
+			return profile, true
+		}
+	}
+	return containerservice.ManagedClusterAgentPoolProfile{}, false
+}
+
+// clusterLogger returns the service's logger with the managed cluster and its resource group as key/value pairs.
+func (s *Service) clusterLogger(group, name string) logr.Logger {
+	log := s.Logger
+	if log == nil {
+		log = klogr.New()
+	}
+	return log.WithValues("cluster", name, "resourceGroup", group)
+}
+
+// retryThrottled calls op, retrying up to MaxRetries times while ARM throttles the request.
+// It waits as long as the Retry-After header asks, and gives up with the throttling error
+// when that wait would run past the deadline of ctx.
+func (s *Service) retryThrottled(ctx context.Context, log logr.Logger, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		retryAfter, ok := throttled(err)
+		if !ok || attempt >= s.MaxRetries {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(retryAfter).After(deadline) {
+			return err
+		}
+		log.V(2).Info("request throttled by Azure, retrying", "retryAfter", retryAfter)
+		if waitErr := waitForRetry(ctx, retryAfter); waitErr != nil {
+			return err
+		}
+	}
+}
+
+// createOrUpdate sends the managed cluster to Azure, retrying with backoff while a dependent resource
+// has not propagated yet. The last error is returned once the retries are exhausted or ctx is done.
+func (s *Service) createOrUpdate(ctx context.Context, log logr.Logger, managedClusterSpec *Spec, properties containerservice.ManagedCluster) error {
+	backoff := dependencyRetryBackoff
+	for {
+		err := s.retryThrottled(ctx, log, func() error {
+			return s.Client.CreateOrUpdate(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name, properties)
+		})
+		if err == nil || !dependencyNotFound(err) || backoff.Steps <= 1 {
+			return err
+		}
+		log.V(2).Info("dependency of managed cluster not found yet, retrying", "error", err.Error())
+		if waitErr := waitForRetry(ctx, backoff.Step()); waitErr != nil {
+			return err
+		}
+	}
+}
+
+// ReconcileDryRun returns the managed cluster Reconcile would send to Azure, without sending it.
+func (s *Service) ReconcileDryRun(ctx context.Context, spec interface{}) (containerservice.ManagedCluster, error) {
+	managedClusterSpec, ok := spec.(*Spec)
+	if !ok {
+		return containerservice.ManagedCluster{}, errors.New("expected managed cluster specification")
+	}
+
+	if err := managedClusterSpec.Validate(); err != nil {
+		return containerservice.ManagedCluster{}, err
+	}
+	return buildManagedCluster(managedClusterSpec)
+}
+
+// buildManagedCluster converts a validated managed cluster specification into the properties sent to Azure.
+func buildManagedCluster(managedClusterSpec *Spec) (containerservice.ManagedCluster, error) {
+	properties := containerservice.ManagedCluster{
+		Identity: &containerservice.ManagedClusterIdentity{
+			Type: containerservice.SystemAssigned,
+		},
+		Location: to.StringPtr(normalizeLocation(managedClusterSpec.Location)),
+		ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+			DNSPrefix:         to.StringPtr(dnsPrefix(managedClusterSpec)),
+			KubernetesVersion: &managedClusterSpec.Version,
+			LinuxProfile: &containerservice.LinuxProfile{
+				AdminUsername: to.StringPtr(defaultUser),
+				SSH: &containerservice.SSHConfiguration{
+					PublicKeys: &[]containerservice.SSHPublicKey{
+						{
+							KeyData: &managedClusterSpec.SSHPublicKey,
+						},
+					},
+				},
+			},
+			ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+				ClientID: to.StringPtr(managedIdentity),
+			},
+			AgentPoolProfiles: &[]containerservice.ManagedClusterAgentPoolProfile{},
+			NetworkProfile: &containerservice.NetworkProfileType{
+				NetworkPlugin:   containerservice.Azure,
+				LoadBalancerSku: containerservice.Standard,
+			},
+		},
+	}
+
+	if managedClusterSpec.WindowsProfile != nil {
+		properties.WindowsProfile = &containerservice.ManagedClusterWindowsProfile{
+			AdminUsername: to.StringPtr(managedClusterSpec.WindowsProfile.AdminUsername),
+			AdminPassword: to.StringPtr(managedClusterSpec.WindowsProfile.AdminPassword),
+		}
+	}
+
+	if managedClusterSpec.NetworkPlugin != nil {
+		properties.NetworkProfile.NetworkPlugin = containerservice.NetworkPlugin(*managedClusterSpec.NetworkPlugin)
+	}
+
+	if managedClusterSpec.PodCIDR != "" {
+		properties.NetworkProfile.PodCidr = &managedClusterSpec.PodCIDR
+	}
+
+	if managedClusterSpec.ServiceCIDR != "" {
+		properties.NetworkProfile.ServiceCidr = &managedClusterSpec.ServiceCIDR
+	}
+
+	if managedClusterSpec.DNSServiceIP != "" {
+		properties.NetworkProfile.DNSServiceIP = &managedClusterSpec.DNSServiceIP
+	} else if managedClusterSpec.ServiceCIDR != "" {
+		dnsIP, err := dnsServiceIP(managedClusterSpec.ServiceCIDR)
+		if err != nil {
+			return containerservice.ManagedCluster{}, err
+		}
+		properties.NetworkProfile.DNSServiceIP = &dnsIP
+	}
+
+	if managedClusterSpec.DockerBridgeCIDR != "" {
+		properties.NetworkProfile.DockerBridgeCidr = &managedClusterSpec.DockerBridgeCIDR
+	}
+
+	if managedClusterSpec.NetworkPolicy != nil {
+		policy, err := parseNetworkPolicy(*managedClusterSpec.NetworkPolicy)
+		if err != nil {
+			return containerservice.ManagedCluster{}, err
+		}
+		properties.NetworkProfile.NetworkPolicy = policy
+	}
+
+	if managedClusterSpec.OutboundType != nil {
+		properties.NetworkProfile.OutboundType = containerservice.OutboundType(*managedClusterSpec.OutboundType)
+	}
+
+	if managedClusterSpec.LoadBalancerSKU != nil {
+		properties.NetworkProfile.LoadBalancerSku = containerservice.LoadBalancerSku(*managedClusterSpec.LoadBalancerSKU)
+	}
+
+	if managedClusterSpec.LoadBalancerProfile != nil {
+		properties.NetworkProfile.LoadBalancerProfile = buildLoadBalancerProfile(managedClusterSpec.LoadBalancerProfile)
+	}
+
+	if managedClusterSpec.NodeResourceGroup != "" {
+		properties.NodeResourceGroup = &managedClusterSpec.NodeResourceGroup
+	}
+
+	if managedClusterSpec.EnablePrivateCluster != nil || managedClusterSpec.APIServerAccessProfile != nil {
+		properties.APIServerAccessProfile = &containerservice.ManagedClusterAPIServerAccessProfile{
+			EnablePrivateCluster: managedClusterSpec.EnablePrivateCluster,
+		}
+		if managedClusterSpec.APIServerAccessProfile != nil {
+			// An empty list, rather than nil, clears the ranges on an existing cluster.
+			ranges := append([]string{}, managedClusterSpec.APIServerAccessProfile.AuthorizedIPRanges...)
+			properties.APIServerAccessProfile.AuthorizedIPRanges = &ranges
+		}
+	}
+
+	for name, addon := range managedClusterSpec.AddonProfiles {
+		setAddonProfile(&properties, name, addon.Enabled)
+		if len(addon.Config) > 0 {
+			config := map[string]*string{}
+			for key, value := range addon.Config {
+				config[key] = to.StringPtr(value)
+			}
+			properties.AddonProfiles[name].Config = config
+		}
+	}
+
+	if managedClusterSpec.EnableHTTPApplicationRouting != nil && *managedClusterSpec.EnableHTTPApplicationRouting {
+		setAddonProfile(&properties, httpApplicationRoutingAddon, true)
+	}
+
+	if managedClusterSpec.EnableAzurePolicy != nil {
+		setAddonProfile(&properties, azurePolicyAddon, *managedClusterSpec.EnableAzurePolicy)
+	}
+
+	if managedClusterSpec.IngressAppGateway != nil {
+		setAddonProfile(&properties, ingressAppGatewayAddon, true)
+		properties.AddonProfiles[ingressAppGatewayAddon].Config = buildIngressAppGatewayConfig(managedClusterSpec.IngressAppGateway)
+	}
+
+	for _, pool := range managedClusterSpec.AgentPools {
+		*properties.AgentPoolProfiles = append(*properties.AgentPoolProfiles, buildAgentPoolProfile(pool))
+	}
+
+	return properties, nil
+}
+
+// buildLoadBalancerProfile converts a load balancer profile into the profile sent to Azure.
+func buildLoadBalancerProfile(lb *LoadBalancerProfile) *containerservice.ManagedClusterLoadBalancerProfile {
+	profile := &containerservice.ManagedClusterLoadBalancerProfile{}
+	if lb.ManagedOutboundIPCount != nil {
+		profile.ManagedOutboundIPs = &containerservice.ManagedClusterLoadBalancerProfileManagedOutboundIPs{
+			Count: lb.ManagedOutboundIPCount,
+		}
+	}
+	if len(lb.OutboundIPs) > 0 {
+		profile.OutboundIPs = &containerservice.ManagedClusterLoadBalancerProfileOutboundIPs{
+			PublicIPs: resourceReferences(lb.OutboundIPs),
+		}
+	}
+	if len(lb.OutboundIPPrefixes) > 0 {
+		profile.OutboundIPPrefixes = &containerservice.ManagedClusterLoadBalancerProfileOutboundIPPrefixes{
+			PublicIPPrefixes: resourceReferences(lb.OutboundIPPrefixes),
+		}
+	}
+	if lb.AllocatedOutboundPorts != nil {
+		profile.AllocatedOutboundPorts = lb.AllocatedOutboundPorts
+	}
+	if lb.IdleTimeoutInMinutes != nil {
+		profile.IdleTimeoutInMinutes = lb.IdleTimeoutInMinutes
+	}
+	return profile
+}
+
+// resourceReferences converts resource IDs into the references sent to Azure.
+func resourceReferences(ids []string) *[]containerservice.ResourceReference {
+	references := make([]containerservice.ResourceReference, 0, len(ids))
+	for _, id := range ids {
+		references = append(references, containerservice.ResourceReference{ID: to.StringPtr(id)})
+	}
+	return &references
+}
+
+// normalizeResourceReferences returns the existing references, or desired when they refer to the same resources.
+// Azure doesn't preserve the order or the case of resource IDs.
+func normalizeResourceReferences(existing, desired *[]containerservice.ResourceReference) *[]containerservice.ResourceReference {
+	if existing == nil || desired == nil || len(*existing) != len(*desired) {
+		return existing
+	}
+	var existingIDs, desiredIDs []string
+	for _, reference := range *existing {
+		existingIDs = append(existingIDs, strings.ToLower(to.String(reference.ID)))
+	}
+	for _, reference := range *desired {
+		desiredIDs = append(desiredIDs, strings.ToLower(to.String(reference.ID)))
+	}
+	if sameStrings(existingIDs, desiredIDs) {
+		return desired
+	}
+	return existing
+}
+
+// buildAgentPoolProfile converts a validated agent pool specification into the profile sent to Azure.
+func buildAgentPoolProfile(pool PoolSpec) containerservice.ManagedClusterAgentPoolProfile {
+	profile := containerservice.ManagedClusterAgentPoolProfile{
+		Name:         &pool.Name,
+		VMSize:       containerservice.VMSizeTypes(pool.SKU),
+		OsDiskSizeGB: &pool.OSDiskSizeGB,
+		Count:        &pool.Replicas,
+		Type:         containerservice.VirtualMachineScaleSets,
+	}
+	if pool.Version != "" {
+		profile.OrchestratorVersion = to.StringPtr(pool.Version)
+	}
+	if pool.OSType != "" {
+		profile.OsType = containerservice.OSType(pool.OSType)
+	}
+	if pool.VnetSubnetID != "" {
+		profile.VnetSubnetID = &pool.VnetSubnetID
+	}
+	if pool.MaxPods != nil {
+		profile.MaxPods = to.Int32Ptr(*pool.MaxPods)
+	}
+	switch pool.ScaleSetPriority {
+	case scaleSetPriorityRegular:
+		profile.ScaleSetPriority = containerservice.Regular
+	case scaleSetPrioritySpot:
+		profile.ScaleSetPriority = containerservice.Low
+	}
+	if pool.ScaleSetEvictionPolicy != "" {
+		profile.ScaleSetEvictionPolicy = containerservice.ScaleSetEvictionPolicy(pool.ScaleSetEvictionPolicy)
+	}
+	if pool.EnableNodePublicIP != nil {
+		profile.EnableNodePublicIP = to.BoolPtr(*pool.EnableNodePublicIP)
+	}
+	if pool.EnableAutoScaling != nil {
+		profile.EnableAutoScaling = to.BoolPtr(*pool.EnableAutoScaling)
+		if *pool.EnableAutoScaling {
+			profile.MinCount = pool.MinCount
+			profile.MaxCount = pool.MaxCount
+		}
+	}
+	if len(pool.NodeTaints) > 0 {
+		nodeTaints := pool.NodeTaints
+		profile.NodeTaints = &nodeTaints
+	}
+	if len(pool.AvailabilityZones) > 0 {
+		zones := pool.AvailabilityZones
+		profile.AvailabilityZones = &zones
+	}
+	return profile
+}
+
+// agentPoolFromProfile converts a managed cluster agent pool profile into an agent pool for the agent pools API.
+func agentPoolFromProfile(profile containerservice.ManagedClusterAgentPoolProfile) containerservice.AgentPool {
+	return containerservice.AgentPool{
+		ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+			VMSize:                 profile.VMSize,
+			OsDiskSizeGB:           profile.OsDiskSizeGB,
+			Count:                  profile.Count,
+			Type:                   profile.Type,
+			OrchestratorVersion:    profile.OrchestratorVersion,
+			OsType:                 profile.OsType,
+			VnetSubnetID:           profile.VnetSubnetID,
+			MaxPods:                profile.MaxPods,
+			ScaleSetPriority:       profile.ScaleSetPriority,
+			ScaleSetEvictionPolicy: profile.ScaleSetEvictionPolicy,
+			NodeTaints:             profile.NodeTaints,
+			EnableNodePublicIP:     profile.EnableNodePublicIP,
+			EnableAutoScaling:      profile.EnableAutoScaling,
+			MinCount:               profile.MinCount,
+			MaxCount:               profile.MaxCount,
+			AvailabilityZones:      profile.AvailabilityZones,
+		},
+	}
+}
+
+// poolSpecFromProfile converts an agent pool profile returned by Azure into a pool specification.
+func poolSpecFromProfile(profile containerservice.ManagedClusterAgentPoolProfile) PoolSpec {
+	pool := PoolSpec{
+		Name:                   to.String(profile.Name),
+		SKU:                    string(profile.VMSize),
+		Replicas:               to.Int32(profile.Count),
+		Version:                to.String(profile.OrchestratorVersion),
+		OSDiskSizeGB:           to.Int32(profile.OsDiskSizeGB),
+		OSType:                 string(profile.OsType),
+		VnetSubnetID:           to.String(profile.VnetSubnetID),
+		MaxPods:                profile.MaxPods,
+		ScaleSetPriority:       string(profile.ScaleSetPriority),
+		ScaleSetEvictionPolicy: string(profile.ScaleSetEvictionPolicy),
+		EnableNodePublicIP:     profile.EnableNodePublicIP,
+		EnableAutoScaling:      profile.EnableAutoScaling,
+		MinCount:               profile.MinCount,
+		MaxCount:               profile.MaxCount,
+	}
+	if profile.ScaleSetPriority == containerservice.Low {
+		pool.ScaleSetPriority = scaleSetPrioritySpot
+	}
+	if profile.NodeTaints != nil && len(*profile.NodeTaints) > 0 {
+		pool.NodeTaints = append([]string{}, *profile.NodeTaints...)
+	}
+	if profile.AvailabilityZones != nil && len(*profile.AvailabilityZones) > 0 {
+		pool.AvailabilityZones = append([]string{}, *profile.AvailabilityZones...)
+	}
+	return pool
+}
+
+// normalizeManagedCluster copies the properties of an existing managed cluster that are set in desired,
+// so the two can be diffed without defaults and read-only values populated by AKS.
+func normalizeManagedCluster(existing, desired containerservice.ManagedCluster) containerservice.ManagedCluster {
+	normalized := containerservice.ManagedCluster{
+		Location: to.StringPtr(normalizeLocation(to.String(existing.Location))),
+	}
+	if existing.Identity != nil {
+		normalized.Identity = &containerservice.ManagedClusterIdentity{
+			Type: existing.Identity.Type,
+		}
+	}
+	if existing.ManagedClusterProperties == nil || desired.ManagedClusterProperties == nil {
+		return normalized
+	}
+
+	normalized.ManagedClusterProperties = &containerservice.ManagedClusterProperties{
+		DNSPrefix:         existing.DNSPrefix,
+		KubernetesVersion: existing.KubernetesVersion,
+		LinuxProfile:      existing.LinuxProfile,
+	}
+	if desired.NodeResourceGroup != nil {
+		normalized.NodeResourceGroup = existing.NodeResourceGroup
+	}
+	if existing.ServicePrincipalProfile != nil {
+		normalized.ServicePrincipalProfile = &containerservice.ManagedClusterServicePrincipalProfile{
+			ClientID: existing.ServicePrincipalProfile.ClientID,
+		}
+	}
+	if desired.WindowsProfile != nil {
+		// AKS never returns the admin password, so only the username is compared.
+		normalized.WindowsProfile = &containerservice.ManagedClusterWindowsProfile{
+			AdminPassword: desired.WindowsProfile.AdminPassword,
+		}
+		if existing.WindowsProfile != nil {
+			normalized.WindowsProfile.AdminUsername = existing.WindowsProfile.AdminUsername
+		}
+	}
+
+	if desired.AgentPoolProfiles != nil {
+		pools := []containerservice.ManagedClusterAgentPoolProfile{}
+		for _, want := range *desired.AgentPoolProfiles {
+			if existing.AgentPoolProfiles == nil {
+				break
+			}
+			for _, pool := range *existing.AgentPoolProfiles {
+				if to.String(pool.Name) == to.String(want.Name) {
+					pools = append(pools, normalizeAgentPoolProfile(pool, want))
+				}
+			}
+		}
+		normalized.AgentPoolProfiles = &pools
+	}
+
+	if desired.NetworkProfile != nil && existing.NetworkProfile != nil {
+		want, network := desired.NetworkProfile, existing.NetworkProfile
+		normalized.NetworkProfile = &containerservice.NetworkProfileType{
+			NetworkPlugin:   containerservice.NetworkPlugin(matchCase(string(network.NetworkPlugin), string(want.NetworkPlugin))),
+			LoadBalancerSku: containerservice.LoadBalancerSku(matchCase(string(network.LoadBalancerSku), string(want.LoadBalancerSku))),
+		}
+		if want.NetworkPolicy != "" {
+			normalized.NetworkProfile.NetworkPolicy = containerservice.NetworkPolicy(matchCase(string(network.NetworkPolicy), string(want.NetworkPolicy)))
+		}
+		if want.OutboundType != "" {
+			normalized.NetworkProfile.OutboundType = containerservice.OutboundType(matchCase(string(network.OutboundType), string(want.OutboundType)))
+		}
+		if want.PodCidr != nil {
+			normalized.NetworkProfile.PodCidr = network.PodCidr
+		}
+		if want.LoadBalancerProfile != nil && network.LoadBalancerProfile != nil {
+			normalized.NetworkProfile.LoadBalancerProfile = &containerservice.ManagedClusterLoadBalancerProfile{}
+			if want.LoadBalancerProfile.ManagedOutboundIPs != nil {
+				normalized.NetworkProfile.LoadBalancerProfile.ManagedOutboundIPs = network.LoadBalancerProfile.ManagedOutboundIPs
+			}
+			if want.LoadBalancerProfile.OutboundIPs != nil && network.LoadBalancerProfile.OutboundIPs != nil {
+				normalized.NetworkProfile.LoadBalancerProfile.OutboundIPs = &containerservice.ManagedClusterLoadBalancerProfileOutboundIPs{
+					PublicIPs: normalizeResourceReferences(network.LoadBalancerProfile.OutboundIPs.PublicIPs, want.LoadBalancerProfile.OutboundIPs.PublicIPs),
+				}
+			}
+			if want.LoadBalancerProfile.OutboundIPPrefixes != nil && network.LoadBalancerProfile.OutboundIPPrefixes != nil {
+				normalized.NetworkProfile.LoadBalancerProfile.OutboundIPPrefixes = &containerservice.ManagedClusterLoadBalancerProfileOutboundIPPrefixes{
+					PublicIPPrefixes: normalizeResourceReferences(network.LoadBalancerProfile.OutboundIPPrefixes.PublicIPPrefixes, want.LoadBalancerProfile.OutboundIPPrefixes.PublicIPPrefixes),
+				}
+			}
+			if want.LoadBalancerProfile.AllocatedOutboundPorts != nil {
+				normalized.NetworkProfile.LoadBalancerProfile.AllocatedOutboundPorts = network.LoadBalancerProfile.AllocatedOutboundPorts
+			}
+			if want.LoadBalancerProfile.IdleTimeoutInMinutes != nil {
+				normalized.NetworkProfile.LoadBalancerProfile.IdleTimeoutInMinutes = network.LoadBalancerProfile.IdleTimeoutInMinutes
+			}
+		}
+		if want.ServiceCidr != nil {
+			normalized.NetworkProfile.ServiceCidr = network.ServiceCidr
+		}
+		if want.DNSServiceIP != nil {
+			normalized.NetworkProfile.DNSServiceIP = network.DNSServiceIP
+		}
+		if want.DockerBridgeCidr != nil {
+			normalized.NetworkProfile.DockerBridgeCidr = network.DockerBridgeCidr
+		}
+	}
+
+	if want := desired.APIServerAccessProfile; want != nil {
+		access := existing.APIServerAccessProfile
+		if access == nil {
+			access = &containerservice.ManagedClusterAPIServerAccessProfile{}
+		}
+		normalized.APIServerAccessProfile = &containerservice.ManagedClusterAPIServerAccessProfile{}
+		if want.EnablePrivateCluster != nil {
+			normalized.APIServerAccessProfile.EnablePrivateCluster = access.EnablePrivateCluster
+		}
+		if want.AuthorizedIPRanges != nil {
+			// AKS omits an empty list and doesn't keep the order of the ranges.
+			ranges := []string{}
+			if access.AuthorizedIPRanges != nil {
+				ranges = append(ranges, *access.AuthorizedIPRanges...)
+			}
+			if sameStrings(ranges, *want.AuthorizedIPRanges) {
+				ranges = *want.AuthorizedIPRanges
+			}
+			normalized.APIServerAccessProfile.AuthorizedIPRanges = &ranges
+		}
+	}
+
+	for name := range desired.AddonProfiles {
+		addon, ok := existing.AddonProfiles[name]
+		if !ok || addon == nil {
+			continue
+		}
+		if normalized.AddonProfiles == nil {
+			normalized.AddonProfiles = map[string]*containerservice.ManagedClusterAddonProfile{}
+		}
+		normalizedAddon := &containerservice.ManagedClusterAddonProfile{
+			Enabled: addon.Enabled,
+		}
+		if desiredConfig := desired.AddonProfiles[name].Config; desiredConfig != nil {
+			// AKS adds its own keys to an addon's config, so only compare the ones we set.
+			normalizedAddon.Config = map[string]*string{}
+			for key := range desiredConfig {
+				if value, ok := addon.Config[key]; ok {
+					normalizedAddon.Config[key] = value
+				}
+			}
+		}
+		normalized.AddonProfiles[name] = normalizedAddon
+	}
+
+	return normalized
+}
+
+// mergeManagedCluster returns the managed cluster sent to update existing: the properties set in desired, and
+// the existing ones for everything desired leaves unset, such as tags, addons enabled outside of the spec or the
+// load balancer profile AKS defaulted. Read-only properties are left out.
+func mergeManagedCluster(existing, desired containerservice.ManagedCluster) containerservice.ManagedCluster {
+	merged := containerservice.ManagedCluster{
+		Identity: desired.Identity,
+		Location: desired.Location,
+		Tags:     existing.Tags,
+	}
+	if desired.ManagedClusterProperties == nil {
+		return merged
+	}
+	properties := *desired.ManagedClusterProperties
+	merged.ManagedClusterProperties = &properties
+	if existing.ManagedClusterProperties == nil {
+		return merged
+	}
+
+	if properties.WindowsProfile == nil {
+		properties.WindowsProfile = existing.WindowsProfile
+	}
+	if properties.NodeResourceGroup == nil {
+		properties.NodeResourceGroup = existing.NodeResourceGroup
+	}
+	if properties.EnableRBAC == nil {
+		properties.EnableRBAC = existing.EnableRBAC
+	}
+	if properties.EnablePodSecurityPolicy == nil {
+		properties.EnablePodSecurityPolicy = existing.EnablePodSecurityPolicy
+	}
+	if properties.AadProfile == nil {
+		properties.AadProfile = existing.AadProfile
+	}
+	if properties.APIServerAccessProfile == nil {
+		properties.APIServerAccessProfile = existing.APIServerAccessProfile
+	}
+
+	if len(existing.AddonProfiles) > 0 {
+		addons := map[string]*containerservice.ManagedClusterAddonProfile{}
+		for name, addon := range existing.AddonProfiles {
+			addons[name] = addon
+		}
+		for name, addon := range desired.AddonProfiles {
+			addons[name] = addon
+		}
+		properties.AddonProfiles = addons
+	}
+
+	if properties.NetworkProfile != nil && existing.NetworkProfile != nil {
+		network := *properties.NetworkProfile
+		if network.PodCidr == nil {
+			network.PodCidr = existing.NetworkProfile.PodCidr
+		}
+		if network.ServiceCidr == nil {
+			network.ServiceCidr = existing.NetworkProfile.ServiceCidr
+		}
+		if network.DNSServiceIP == nil {
+			network.DNSServiceIP = existing.NetworkProfile.DNSServiceIP
+		}
+		if network.DockerBridgeCidr == nil {
+			network.DockerBridgeCidr = existing.NetworkProfile.DockerBridgeCidr
+		}
+		if network.NetworkPolicy == "" {
+			network.NetworkPolicy = existing.NetworkProfile.NetworkPolicy
+		}
+		if network.OutboundType == "" {
+			network.OutboundType = existing.NetworkProfile.OutboundType
+		}
+		if network.LoadBalancerProfile == nil {
+			network.LoadBalancerProfile = existing.NetworkProfile.LoadBalancerProfile
+		}
+		properties.NetworkProfile = &network
+	}
+
+	return merged
+}
+
+// normalizeAgentPoolProfile copies the properties of an existing agent pool profile that are set in desired.
+func normalizeAgentPoolProfile(existing, desired containerservice.ManagedClusterAgentPoolProfile) containerservice.ManagedClusterAgentPoolProfile {
+	normalized := containerservice.ManagedClusterAgentPoolProfile{
+		Name:         existing.Name,
+		VMSize:       existing.VMSize,
+		OsDiskSizeGB: existing.OsDiskSizeGB,
+		Count:        existing.Count,
+		Type:         existing.Type,
+	}
+	// A zero OS disk size lets AKS choose the size.
+	if to.Int32(desired.OsDiskSizeGB) == 0 {
+		normalized.OsDiskSizeGB = desired.OsDiskSizeGB
+	}
+	if desired.OrchestratorVersion != nil {
+		normalized.OrchestratorVersion = existing.OrchestratorVersion
+	}
+	if desired.OsType != "" {
+		normalized.OsType = existing.OsType
+	}
+	if desired.VnetSubnetID != nil {
+		normalized.VnetSubnetID = existing.VnetSubnetID
+	}
+	if desired.MaxPods != nil {
+		normalized.MaxPods = existing.MaxPods
+	}
+	if desired.ScaleSetPriority != "" {
+		normalized.ScaleSetPriority = existing.ScaleSetPriority
+	}
+	if desired.ScaleSetEvictionPolicy != "" {
+		normalized.ScaleSetEvictionPolicy = existing.ScaleSetEvictionPolicy
+	}
+	if desired.NodeTaints != nil {
+		normalized.NodeTaints = existing.NodeTaints
+	}
+	if desired.EnableNodePublicIP != nil {
+		normalized.EnableNodePublicIP = existing.EnableNodePublicIP
+	}
+	if desired.EnableAutoScaling != nil {
+		// AKS omits the setting on pools that were never autoscaled.
+		normalized.EnableAutoScaling = to.BoolPtr(to.Bool(existing.EnableAutoScaling))
+	}
+	if desired.MinCount != nil {
+		normalized.MinCount = existing.MinCount
+	}
+	if desired.MaxCount != nil {
+		normalized.MaxCount = existing.MaxCount
+	}
+	if desired.AvailabilityZones != nil {
+		normalized.AvailabilityZones = existing.AvailabilityZones
+	}
+	return normalized
+}
+
+// keepAutoscaledCounts sets the count of each autoscaled pool in profiles to its current count in the existing
+// cluster, so updates don't fight the cluster autoscaler.
+func keepAutoscaledCounts(profiles []containerservice.ManagedClusterAgentPoolProfile, existing containerservice.ManagedCluster) {
+	if existing.ManagedClusterProperties == nil || existing.AgentPoolProfiles == nil {
+		return
+	}
+	for i := range profiles {
+		if !to.Bool(profiles[i].EnableAutoScaling) {
+			continue
+		}
+		for _, pool := range *existing.AgentPoolProfiles {
+			if to.String(pool.Name) == to.String(profiles[i].Name) && pool.Count != nil {
+				profiles[i].Count = pool.Count
+			}
+		}
+	}
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCase returns desired if it equals actual ignoring case, since AKS does not preserve the case of some enums.
+func matchCase(actual, desired string) string {
+	if strings.EqualFold(actual, desired) {
+		return desired
+	}
+	return actual
+}
+
+// setAddonProfile enables or disables the named addon on a managed cluster.
+func setAddonProfile(properties *containerservice.ManagedCluster, name string, enabled bool) {
+	if properties.AddonProfiles == nil {
+		properties.AddonProfiles = map[string]*containerservice.ManagedClusterAddonProfile{}
+	}
+	properties.AddonProfiles[name] = &containerservice.ManagedClusterAddonProfile{
+		Enabled: to.BoolPtr(enabled),
+	}
+}
+
+// disableRemovedAddons disables the previously set addons that are still enabled on an existing managed cluster
+// but that properties no longer sets.
+func disableRemovedAddons(properties *containerservice.ManagedCluster, existing containerservice.ManagedCluster, previous []string) {
+	if existing.ManagedClusterProperties == nil {
+		return
+	}
+	for _, name := range previous {
+		addon := existing.AddonProfiles[name]
+		if _, ok := properties.AddonProfiles[name]; ok || addon == nil || !to.Bool(addon.Enabled) {
+			continue
+		}
+		setAddonProfile(properties, name, false)
+	}
+}
+
+// buildIngressAppGatewayConfig returns the addon config selecting either an existing application gateway
+// or the subnet for a new one.
+func buildIngressAppGatewayConfig(appGateway *IngressAppGateway) map[string]*string {
+	if appGateway.ApplicationGatewayID != "" {
+		return map[string]*string{"applicationGatewayId": to.StringPtr(appGateway.ApplicationGatewayID)}
+	}
+	return map[string]*string{"subnetCIDR": to.StringPtr(appGateway.SubnetCIDR)}
+}
+
+// Delete deletes the virtual network with the provided name.
+func (s *Service) Delete(ctx context.Context, spec interface{}) error {
+	managedClusterSpec, ok := spec.(*Spec)
+	if !ok {
+		return errors.New("expected managed cluster specification")
+	}
+
+	log := s.clusterLogger(managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	log.V(2).Info("deleting managed cluster")
+	err := s.retryThrottled(ctx, log, func() error {
+		return s.Client.Delete(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	})
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			// already deleted
+			return nil
+		}
+		return errors.Wrapf(err, "failed to delete managed cluster %s in resource group %s", managedClusterSpec.Name, managedClusterSpec.ResourceGroup)
+	}
+
+	log.V(2).Info("successfully deleted managed cluster")
+	return nil
+}
+
+// RotateClusterCertificates rotates the certificates of a managed cluster and waits for the rotation to complete.
+// The rotation restarts the cluster's nodes. A missing cluster is an error that matches ErrManagedClusterNotFound.
+func (s *Service) RotateClusterCertificates(ctx context.Context, group, name string) error {
+	log := s.clusterLogger(group, name)
+	log.V(2).Info("rotating managed cluster certificates")
+	err := s.retryThrottled(ctx, log, func() error {
+		return s.Client.RotateClusterCertificates(ctx, group, name)
+	})
+	if err != nil {
+		if azure.ResourceNotFound(errors.Cause(err)) {
+			return &managedClusterNotFoundError{name: name, err: err}
+		}
+		return errors.Wrapf(err, "failed to rotate certificates of managed cluster %s", name)
+	}
+
+	log.V(2).Info("successfully rotated managed cluster certificates")
+	return nil
+}
+
+// RotateClusterCertificatesAsync is RotateClusterCertificates that only starts the rotation, so callers aren't blocked
+// while AKS restarts the cluster's nodes. Poll the returned future with IsDone.
+func (s *Service) RotateClusterCertificatesAsync(ctx context.Context, group, name string) (*azureautorest.Future, error) {
+	log := s.clusterLogger(group, name)
+	log.V(2).Info("rotating managed cluster certificates asynchronously")
+	var future azureautorest.Future
+	err := s.retryThrottled(ctx, log, func() error {
+		started, err := s.Client.RotateClusterCertificatesAsync(ctx, group, name)
+		if err != nil {
+			return err
+		}
+		future = started
+		return nil
+	})
+	if err != nil {
+		if azure.ResourceNotFound(errors.Cause(err)) {
+			return nil, &managedClusterNotFoundError{name: name, err: err}
+		}
+		return nil, errors.Wrapf(err, "failed to rotate certificates of managed cluster %s", name)
+	}
+
+	log.V(2).Info("successfully started rotating managed cluster certificates")
+	return &future, nil
+}
+
+// ResetServicePrincipalProfile replaces the service principal credential of a managed cluster and waits for the
+// update to complete. Clusters using a managed identity have no service principal, so resetting one is an error.
+func (s *Service) ResetServicePrincipalProfile(ctx context.Context, group, name, clientID, secret string) error {
+	if clientID == "" || secret == "" {
+		return errors.New("a client ID and secret are required to reset a service principal")
+	}
+
+	managedCluster, err := s.Client.Get(ctx, group, name)
+	if err != nil {
+		if azure.ResourceNotFound(err) {
+			return &managedClusterNotFoundError{name: name, err: err}
+		}
+		return errors.Wrapf(err, "failed to get managed cluster %s", name)
+	}
+	if usesManagedIdentity(managedCluster) {
+		return errors.Errorf("managed cluster %s uses a managed identity and has no service principal to reset", name)
+	}
+
+	log := s.clusterLogger(group, name)
+	log.V(2).Info("resetting managed cluster service principal", "clientID", clientID)
+	err = s.retryThrottled(ctx, log, func() error {
+		return s.Client.ResetServicePrincipalProfile(ctx, group, name, containerservice.ManagedClusterServicePrincipalProfile{
+			ClientID: to.StringPtr(clientID),
+			Secret:   to.StringPtr(secret),
+		})
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to reset service principal of managed cluster %s", name)
+	}
+
+	log.V(2).Info("successfully reset managed cluster service principal")
+	return nil
+}
+
+// usesManagedIdentity reports whether a managed cluster authenticates with a managed identity rather than a service principal.
+func usesManagedIdentity(managedCluster containerservice.ManagedCluster) bool {
+	if managedCluster.Identity != nil && managedCluster.Identity.Type != "" && managedCluster.Identity.Type != containerservice.None {
+		return true
+	}
+	return managedCluster.ManagedClusterProperties != nil && managedCluster.ServicePrincipalProfile != nil &&
+		strings.EqualFold(to.String(managedCluster.ServicePrincipalProfile.ClientID), managedIdentity)
+}
+
+// osTypeOrDefault returns the OS type of a pool, defaulting to Linux.
+func osTypeOrDefault(osType string) string {
+	if osType == "" {
+		return string(containerservice.Linux)
+	}
+	return osType
+}
+
+// dnsPrefix returns the DNS prefix of a managed cluster, sanitizing the cluster name when no prefix is specified.
+func dnsPrefix(managedClusterSpec *Spec) string {
+	if managedClusterSpec.DNSPrefix != "" {
+		return managedClusterSpec.DNSPrefix
+	}
+	return infrav1exp.DefaultDNSPrefix(managedClusterSpec.Name)
+}
+
+// dnsServiceIP returns the .10 address of an IPv4 service CIDR, which is the cluster DNS service IP
+// when none is specified.
+func dnsServiceIP(serviceCIDR string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(serviceCIDR)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse service cidr")
+	}
+	network := ipNet.IP.To4()
+	if network == nil {
+		return "", errors.Errorf("service cidr '%s' is not supported: only IPv4 service cidrs can be used", serviceCIDR)
+	}
+	// The .10 host must fit below the network's broadcast address.
+	ones, bits := ipNet.Mask.Size()
+	if uint64(1)<<uint(bits-ones) <= dnsServiceIPOffset+1 {
+		return "", errors.Errorf("service cidr '%s' is too small to contain the DNS service IP", serviceCIDR)
+	}
+	dnsIP := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(dnsIP, binary.BigEndian.Uint32(network)+dnsServiceIPOffset)
+	return dnsIP.String(), nil
+}
+
+// parseNetworkPolicy converts a network policy name into the policy sent to Azure, ignoring case.
+func parseNetworkPolicy(policy string) (containerservice.NetworkPolicy, error) {
+	switch {
+	case strings.EqualFold(policy, string(containerservice.NetworkPolicyAzure)):
+		return containerservice.NetworkPolicyAzure, nil
+	case strings.EqualFold(policy, string(containerservice.NetworkPolicyCalico)):
+		return containerservice.NetworkPolicyCalico, nil
+	default:
+		return "", fmt.Errorf("invalid network policy: '%s'. Allowed options are 'calico' and 'azure'", policy)
+	}
+}
+
+// parseSubnetID splits a subnet resource ID into its resource group, virtual network and subnet names.
+func parseSubnetID(id string) (group, vnet, subnet string, err error) {
+	match := subnetIDRegex.FindStringSubmatch(id)
+	if match == nil || match[0] != id {
+		return "", "", "", errors.Errorf("invalid subnet ID '%s'", id)
+	}
+	return match[1], match[2], match[3], nil
+}
+
+// normalizeLocation converts a region display name such as "West US 2" into its canonical form, "westus2".
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Join(strings.Fields(location), ""))
+}
+
+// ensureResourceGroup checks the cluster's resource group exists, creating it when the spec allows.
+func (s *Service) ensureResourceGroup(ctx context.Context, log logr.Logger, managedClusterSpec *Spec) error {
+	_, err := s.GroupsClient.Get(ctx, managedClusterSpec.ResourceGroup)
+	if err == nil {
+		return nil
+	}
+	if !azure.ResourceNotFound(err) {
+		return errors.Wrapf(err, "failed to get resource group %s", managedClusterSpec.ResourceGroup)
+	}
+	if !managedClusterSpec.CreateResourceGroup {
+		return errors.Errorf("resource group %s does not exist, create it or set CreateResourceGroup", managedClusterSpec.ResourceGroup)
+	}
+
+	log.V(2).Info("creating resource group")
+	group := resources.Group{
+		Location: to.StringPtr(normalizeLocation(managedClusterSpec.Location)),
+	}
+	if len(managedClusterSpec.Tags) > 0 {
+		group.Tags = *to.StringMapPtr(managedClusterSpec.Tags)
+	}
+	if _, err := s.GroupsClient.CreateOrUpdate(ctx, managedClusterSpec.ResourceGroup, group); err != nil {
+		return errors.Wrapf(err, "failed to create resource group %s", managedClusterSpec.ResourceGroup)
+	}
+	log.V(2).Info("successfully created resource group")
 	return nil
 }
@@ -0,0 +1,4587 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package managedclusters
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-06-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-06-01/subscriptions"
+	"github.com/Azure/go-autorest/autorest"
+	azureautorest "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/agentpools/mock_agentpools"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/availabilityzones/mock_availabilityzones"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/groups/mock_groups"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/locations/mock_locations"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/managedclusters/mock_managedclusters"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/subnets/mock_subnets"
+)
+
+func TestValidateTaint(t *testing.T) {
+	testcases := []struct {
+		name          string
+		taint         string
+		expectedError string
+	}{
+		{
+			name:  "NoSchedule effect",
+			taint: "key=value:NoSchedule",
+		},
+		{
+			name:  "PreferNoSchedule effect",
+			taint: "key=value:PreferNoSchedule",
+		},
+		{
+			name:  "NoExecute effect",
+			taint: "key=value:NoExecute",
+		},
+		{
+			name:  "taint without a value",
+			taint: "key:NoSchedule",
+		},
+		{
+			name:          "unknown effect",
+			taint:         "key=value:NoRun",
+			expectedError: "invalid taint 'key=value:NoRun': effect must be one of NoSchedule, PreferNoSchedule or NoExecute",
+		},
+		{
+			name:          "effect with wrong casing",
+			taint:         "key=value:noschedule",
+			expectedError: "invalid taint 'key=value:noschedule': effect must be one of NoSchedule, PreferNoSchedule or NoExecute",
+		},
+		{
+			name:          "empty effect",
+			taint:         "key=value:",
+			expectedError: "invalid taint 'key=value:': effect must be one of NoSchedule, PreferNoSchedule or NoExecute",
+		},
+		{
+			name:          "missing effect",
+			taint:         "key=value",
+			expectedError: "invalid taint 'key=value': expected format key=value:Effect",
+		},
+		{
+			name:          "missing key",
+			taint:         "=value:NoSchedule",
+			expectedError: "invalid taint '=value:NoSchedule': expected format key=value:Effect",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateTaint(tc.taint)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileSpotPool(t *testing.T) {
+	g := NewWithT(t)
+
+	mockCtrl := gomock.NewController(t)
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	spec := &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools: []PoolSpec{
+			{
+				Name:     "system",
+				SKU:      "Standard_D2s_v3",
+				Replicas: 1,
+			},
+			{
+				Name:                   "spot",
+				SKU:                    "Standard_D2s_v3",
+				Replicas:               3,
+				ScaleSetPriority:       "Spot",
+				ScaleSetEvictionPolicy: "Deallocate",
+			},
+		},
+	}
+
+	var sent containerservice.ManagedCluster
+	managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+		Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+	managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+		Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+			sent = cluster
+		})
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	g.Expect(s.Reconcile(context.TODO(), spec)).To(Succeed())
+	g.Expect(*sent.AgentPoolProfiles).To(HaveLen(2))
+	profile := (*sent.AgentPoolProfiles)[1]
+	g.Expect(profile.ScaleSetPriority).To(Equal(containerservice.Low))
+	g.Expect(profile.ScaleSetEvictionPolicy).To(Equal(containerservice.Deallocate))
+}
+
+func TestReconcileOSDiskSize(t *testing.T) {
+	testcases := []struct {
+		name          string
+		osDiskSizeGB  int32
+		expectedError string
+	}{
+		{
+			name:         "default size",
+			osDiskSizeGB: 0,
+		},
+		{
+			name:         "smallest size",
+			osDiskSizeGB: 30,
+		},
+		{
+			name:         "valid size",
+			osDiskSizeGB: 128,
+		},
+		{
+			name:         "largest size",
+			osDiskSizeGB: 2048,
+		},
+		{
+			name:          "too small",
+			osDiskSizeGB:  29,
+			expectedError: "invalid agent pool pool0: OS disk size 29 GB must be between 30 and 2048 GB, or 0 for the default size",
+		},
+		{
+			name:          "too large",
+			osDiskSizeGB:  2049,
+			expectedError: "invalid agent pool pool0: OS disk size 2049 GB must be between 30 and 2048 GB, or 0 for the default size",
+		},
+		{
+			name:          "negative",
+			osDiskSizeGB:  -1,
+			expectedError: "invalid agent pool pool0: OS disk size -1 GB must be between 30 and 2048 GB, or 0 for the default size",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			if tc.expectedError == "" {
+				managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+				managedClustersMock.EXPECT().CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect((*cluster.AgentPoolProfiles)[0].OsDiskSizeGB).To(Equal(to.Int32Ptr(tc.osDiskSizeGB)))
+					})
+			}
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				Location:      "westus2",
+				Version:       "1.17.7",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1, OSDiskSizeGB: tc.osDiskSizeGB}},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestBuildAgentPoolProfileNodePublicIP(t *testing.T) {
+	testcases := []struct {
+		name     string
+		enabled  *bool
+		expected *bool
+	}{
+		{
+			name:     "enabled",
+			enabled:  to.BoolPtr(true),
+			expected: to.BoolPtr(true),
+		},
+		{
+			name:     "disabled",
+			enabled:  to.BoolPtr(false),
+			expected: to.BoolPtr(false),
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			profile := buildAgentPoolProfile(PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1, EnableNodePublicIP: tc.enabled})
+			g.Expect(profile.EnableNodePublicIP).To(Equal(tc.expected))
+			g.Expect(agentPoolFromProfile(profile).EnableNodePublicIP).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestValidateScaleSetPriority(t *testing.T) {
+	testcases := []struct {
+		name          string
+		pool          PoolSpec
+		expectedError string
+	}{
+		{
+			name: "default priority",
+			pool: PoolSpec{Name: "pool0"},
+		},
+		{
+			name: "regular priority",
+			pool: PoolSpec{Name: "pool0", ScaleSetPriority: "Regular"},
+		},
+		{
+			name: "spot priority with default eviction policy",
+			pool: PoolSpec{Name: "pool0", ScaleSetPriority: "Spot"},
+		},
+		{
+			name: "spot priority with delete eviction policy",
+			pool: PoolSpec{Name: "pool0", ScaleSetPriority: "Spot", ScaleSetEvictionPolicy: "Delete"},
+		},
+		{
+			name:          "unknown priority",
+			pool:          PoolSpec{Name: "pool0", ScaleSetPriority: "Cheap"},
+			expectedError: "invalid scale set priority 'Cheap'. Allowed options are 'Regular' and 'Spot'",
+		},
+		{
+			name:          "unknown eviction policy",
+			pool:          PoolSpec{Name: "pool0", ScaleSetPriority: "Spot", ScaleSetEvictionPolicy: "Hibernate"},
+			expectedError: "invalid scale set eviction policy 'Hibernate'. Allowed options are 'Delete' and 'Deallocate'",
+		},
+		{
+			name:          "eviction policy on a regular pool",
+			pool:          PoolSpec{Name: "pool0", ScaleSetEvictionPolicy: "Delete"},
+			expectedError: "scale set eviction policy 'Delete' is only supported for Spot priority",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateScaleSetPriority(tc.pool)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	g := NewWithT(t)
+
+	mockCtrl := gomock.NewController(t)
+	// No calls are expected on the client.
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	spec := &Spec{
+		Name:            "my-cluster",
+		ResourceGroup:   "my-rg",
+		Location:        "westus2",
+		Version:         "1.17.7",
+		SSHPublicKey:    "ssh-rsa AAAA",
+		LoadBalancerSKU: to.StringPtr("Standard"),
+		NetworkPlugin:   to.StringPtr("kubenet"),
+		NetworkPolicy:   to.StringPtr("calico"),
+		PodCIDR:         "192.168.0.0/16",
+		ServiceCIDR:     "10.96.0.0/12",
+		AgentPools: []PoolSpec{
+			{
+				Name:         "pool0",
+				SKU:          "Standard_D2s_v3",
+				Replicas:     3,
+				OSDiskSizeGB: 128,
+				NodeTaints:   []string{"dedicated=infra:NoSchedule"},
+			},
+			{
+				Name:             "pool1",
+				SKU:              "Standard_D4s_v3",
+				Replicas:         2,
+				ScaleSetPriority: "Spot",
+			},
+		},
+	}
+
+	expected := containerservice.ManagedCluster{
+		Identity: &containerservice.ManagedClusterIdentity{
+			Type: containerservice.SystemAssigned,
+		},
+		Location: to.StringPtr("westus2"),
+		ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+			DNSPrefix:         to.StringPtr("my-cluster"),
+			KubernetesVersion: to.StringPtr("1.17.7"),
+			LinuxProfile: &containerservice.LinuxProfile{
+				AdminUsername: to.StringPtr("azureuser"),
+				SSH: &containerservice.SSHConfiguration{
+					PublicKeys: &[]containerservice.SSHPublicKey{
+						{
+							KeyData: to.StringPtr("ssh-rsa AAAA"),
+						},
+					},
+				},
+			},
+			ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+				ClientID: to.StringPtr("msi"),
+			},
+			AgentPoolProfiles: &[]containerservice.ManagedClusterAgentPoolProfile{
+				{
+					Name:         to.StringPtr("pool0"),
+					VMSize:       containerservice.VMSizeTypes("Standard_D2s_v3"),
+					OsDiskSizeGB: to.Int32Ptr(128),
+					Count:        to.Int32Ptr(3),
+					Type:         containerservice.VirtualMachineScaleSets,
+					NodeTaints:   &[]string{"dedicated=infra:NoSchedule"},
+				},
+				{
+					Name:             to.StringPtr("pool1"),
+					VMSize:           containerservice.VMSizeTypes("Standard_D4s_v3"),
+					OsDiskSizeGB:     to.Int32Ptr(0),
+					Count:            to.Int32Ptr(2),
+					Type:             containerservice.VirtualMachineScaleSets,
+					ScaleSetPriority: containerservice.Low,
+				},
+			},
+			NetworkProfile: &containerservice.NetworkProfileType{
+				NetworkPlugin:   containerservice.NetworkPlugin("kubenet"),
+				NetworkPolicy:   containerservice.NetworkPolicyCalico,
+				PodCidr:         to.StringPtr("192.168.0.0/16"),
+				ServiceCidr:     to.StringPtr("10.96.0.0/12"),
+				DNSServiceIP:    to.StringPtr("10.96.0.10"),
+				LoadBalancerSku: containerservice.LoadBalancerSku("Standard"),
+			},
+		},
+	}
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	result, err := s.ReconcileDryRun(context.TODO(), spec)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(expected))
+}
+
+func TestReconcilePrivateCluster(t *testing.T) {
+	const subnetID = "/subscriptions/123/resourceGroups/my-vnet-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+
+	testcases := []struct {
+		name          string
+		policies      *string
+		expectedError string
+		expect        func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder)
+	}{
+		{
+			name:     "private endpoint network policies disabled",
+			policies: to.StringPtr("Disabled"),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(cluster.APIServerAccessProfile.EnablePrivateCluster).To(Equal(to.BoolPtr(true)))
+						g.Expect((*cluster.AgentPoolProfiles)[0].VnetSubnetID).To(Equal(to.StringPtr(subnetID)))
+					})
+			},
+		},
+		{
+			name:          "private endpoint network policies enabled",
+			policies:      to.StringPtr("Enabled"),
+			expectedError: "subnet " + subnetID + " cannot host the private cluster API server endpoint: set privateEndpointNetworkPolicies to 'Disabled' on the subnet",
+			expect:        func(_ *GomegaWithT, _ *mock_managedclusters.MockClientMockRecorder) {},
+		},
+		{
+			name:          "private endpoint network policies unset",
+			expectedError: "subnet " + subnetID + " cannot host the private cluster API server endpoint: set privateEndpointNetworkPolicies to 'Disabled' on the subnet",
+			expect:        func(_ *GomegaWithT, _ *mock_managedclusters.MockClientMockRecorder) {},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			mockCtrl := gomock.NewController(t)
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			subnetsMock := mock_subnets.NewMockClient(mockCtrl)
+
+			subnetsMock.EXPECT().Get(context.TODO(), "my-vnet-rg", "my-vnet", "my-subnet").Return(network.Subnet{
+				SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+					PrivateEndpointNetworkPolicies: tc.policies,
+				},
+			}, nil)
+			managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			tc.expect(g, managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client:        managedClustersMock,
+				SubnetsClient: subnetsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:                 "my-cluster",
+				ResourceGroup:        "my-rg",
+				EnablePrivateCluster: to.BoolPtr(true),
+				AgentPools: []PoolSpec{
+					{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1, VnetSubnetID: subnetID},
+					{Name: "pool1", SKU: "Standard_D2s_v3", Replicas: 1, VnetSubnetID: subnetID},
+				},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileSubnets(t *testing.T) {
+	const subnetID = "/subscriptions/123/resourceGroups/my-vnet-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+
+	testcases := []struct {
+		name          string
+		serviceCIDR   string
+		outboundType  *string
+		subnet        network.SubnetPropertiesFormat
+		expectedError string
+	}{
+		{
+			name:        "subnet outside the service cidr",
+			serviceCIDR: "10.0.0.0/16",
+			subnet:      network.SubnetPropertiesFormat{AddressPrefix: to.StringPtr("10.240.0.0/16")},
+		},
+		{
+			name:          "subnet overlaps the service cidr",
+			serviceCIDR:   "10.240.0.0/24",
+			subnet:        network.SubnetPropertiesFormat{AddressPrefix: to.StringPtr("10.240.0.0/16")},
+			expectedError: "service cidr '10.240.0.0/24' must not overlap address prefix '10.240.0.0/16' of subnet " + subnetID,
+		},
+		{
+			name:          "subnet overlaps the default service cidr",
+			subnet:        network.SubnetPropertiesFormat{AddressPrefixes: &[]string{"10.240.0.0/16", "10.0.1.0/24"}},
+			expectedError: "service cidr '10.0.0.0/16' must not overlap address prefix '10.0.1.0/24' of subnet " + subnetID,
+		},
+		{
+			name:         "user defined routing with a route table",
+			outboundType: to.StringPtr("userDefinedRouting"),
+			subnet: network.SubnetPropertiesFormat{
+				AddressPrefix: to.StringPtr("10.240.0.0/16"),
+				RouteTable:    &network.RouteTable{ID: to.StringPtr("/subscriptions/123/resourceGroups/my-vnet-rg/providers/Microsoft.Network/routeTables/my-routes")},
+			},
+		},
+		{
+			name:          "user defined routing without a route table",
+			outboundType:  to.StringPtr("userDefinedRouting"),
+			subnet:        network.SubnetPropertiesFormat{AddressPrefix: to.StringPtr("10.240.0.0/16")},
+			expectedError: "subnet " + subnetID + " has no route table, which outbound type 'userDefinedRouting' requires",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			subnetsMock := mock_subnets.NewMockClient(mockCtrl)
+
+			subnetsMock.EXPECT().Get(context.TODO(), "my-vnet-rg", "my-vnet", "my-subnet").Return(network.Subnet{
+				SubnetPropertiesFormat: &tc.subnet,
+			}, nil)
+			managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			if tc.expectedError == "" {
+				managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			}
+
+			s := &Service{
+				Client:        managedClustersMock,
+				SubnetsClient: subnetsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				ServiceCIDR:   tc.serviceCIDR,
+				OutboundType:  tc.outboundType,
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1, VnetSubnetID: subnetID}},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestNormalizeLocation(t *testing.T) {
+	testcases := []struct {
+		location string
+		expected string
+	}{
+		{location: "westus2", expected: "westus2"},
+		{location: "West US 2", expected: "westus2"},
+		{location: "  East US  ", expected: "eastus"},
+		{location: "NorthEurope", expected: "northeurope"},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.location, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(normalizeLocation(tc.location)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestReconcileLocation(t *testing.T) {
+	available := []subscriptions.Location{
+		{Name: to.StringPtr("westus"), DisplayName: to.StringPtr("West US")},
+		{Name: to.StringPtr("westus2"), DisplayName: to.StringPtr("West US 2")},
+		{Name: to.StringPtr("eastus"), DisplayName: to.StringPtr("East US")},
+	}
+
+	testcases := []struct {
+		name          string
+		location      string
+		expectedError string
+	}{
+		{
+			name:     "canonical location",
+			location: "westus2",
+		},
+		{
+			name:     "display name",
+			location: "West US 2",
+		},
+		{
+			name:          "misspelled location",
+			location:      "westus22",
+			expectedError: `location "westus22" is not available to this subscription, did you mean westus2?`,
+		},
+		{
+			name:          "unknown location",
+			location:      "moon",
+			expectedError: `location "moon" is not available to this subscription`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			locationsMock := mock_locations.NewMockClient(mockCtrl)
+
+			spec := &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				Location:      tc.location,
+				Version:       "1.17.7",
+				SSHPublicKey:  "",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			}
+
+			managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			locationsMock.EXPECT().List(gomock.Any()).Return(available, nil)
+			if tc.expectedError == "" {
+				managedClustersMock.EXPECT().CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(cluster.Location).To(Equal(to.StringPtr("westus2")))
+					})
+			}
+
+			s := &Service{
+				Client:          managedClustersMock,
+				LocationsClient: locationsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), spec)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileUnmanagedAgentPools(t *testing.T) {
+	testcases := []struct {
+		name          string
+		pools         []PoolSpec
+		expect        func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name:  "existing cluster leaves agent pools untouched",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{}, nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(cluster.AgentPoolProfiles).To(BeNil())
+					})
+			},
+		},
+		{
+			name:  "new cluster is created with its agent pools",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(*cluster.AgentPoolProfiles).To(HaveLen(1))
+						g.Expect(*(*cluster.AgentPoolProfiles)[0].Name).To(Equal("pool0"))
+					})
+			},
+		},
+		{
+			name: "new cluster without agent pools",
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError: "at least one agent pool is required",
+		},
+		{
+			name:  "failure getting the existing cluster",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get existing managed cluster: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(g, managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:             "my-cluster",
+				ResourceGroup:    "my-rg",
+				Location:         "westus2",
+				Version:          "1.17.7",
+				AgentPools:       tc.pools,
+				ManageAgentPools: to.BoolPtr(false),
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestBuildManagedClusterHTTPApplicationRouting(t *testing.T) {
+	testcases := []struct {
+		name     string
+		enabled  *bool
+		expected map[string]*containerservice.ManagedClusterAddonProfile
+	}{
+		{
+			name:    "enabled",
+			enabled: to.BoolPtr(true),
+			expected: map[string]*containerservice.ManagedClusterAddonProfile{
+				"httpApplicationRouting": {
+					Enabled: to.BoolPtr(true),
+				},
+			},
+		},
+		{
+			name:    "disabled",
+			enabled: to.BoolPtr(false),
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			cluster, err := buildManagedCluster(&Spec{
+				Name:                         "my-cluster",
+				ResourceGroup:                "my-rg",
+				Location:                     "westus2",
+				Version:                      "1.17.7",
+				AgentPools:                   []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+				EnableHTTPApplicationRouting: tc.enabled,
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(cluster.AddonProfiles).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestReconcileWindowsProfile(t *testing.T) {
+	g := NewWithT(t)
+	spec := &Spec{
+		Name:           "my-cluster",
+		ResourceGroup:  "my-rg",
+		Location:       "westus2",
+		Version:        "1.17.7",
+		WindowsProfile: &WindowsProfile{AdminUsername: "azureuser", AdminPassword: "P@ssw0rd1234"},
+		AgentPools: []PoolSpec{
+			{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+			{Name: "win1", SKU: "Standard_D2s_v3", Replicas: 1, OSType: "Windows"},
+		},
+	}
+
+	cluster, err := (&Service{}).ReconcileDryRun(context.TODO(), spec)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(cluster.WindowsProfile).To(Equal(&containerservice.ManagedClusterWindowsProfile{
+		AdminUsername: to.StringPtr("azureuser"),
+		AdminPassword: to.StringPtr("P@ssw0rd1234"),
+	}))
+	g.Expect((*cluster.AgentPoolProfiles)[1].OsType).To(Equal(containerservice.Windows))
+
+	// AKS doesn't return the password, so an existing cluster with the same username is unchanged.
+	properties := *cluster.ManagedClusterProperties
+	existing := cluster
+	existing.ManagedClusterProperties = &properties
+	existing.WindowsProfile = &containerservice.ManagedClusterWindowsProfile{AdminUsername: to.StringPtr("azureuser")}
+	g.Expect(normalizeManagedCluster(existing, cluster).WindowsProfile).To(Equal(cluster.WindowsProfile))
+
+	existing.WindowsProfile = &containerservice.ManagedClusterWindowsProfile{AdminUsername: to.StringPtr("otheruser")}
+	g.Expect(normalizeManagedCluster(existing, cluster).WindowsProfile).NotTo(Equal(cluster.WindowsProfile))
+}
+
+func TestBuildManagedClusterAzurePolicy(t *testing.T) {
+	testcases := []struct {
+		name     string
+		enabled  *bool
+		expected map[string]*containerservice.ManagedClusterAddonProfile
+	}{
+		{
+			name:    "enabled",
+			enabled: to.BoolPtr(true),
+			expected: map[string]*containerservice.ManagedClusterAddonProfile{
+				"azurepolicy": {
+					Enabled: to.BoolPtr(true),
+				},
+			},
+		},
+		{
+			name:    "disabled",
+			enabled: to.BoolPtr(false),
+			expected: map[string]*containerservice.ManagedClusterAddonProfile{
+				"azurepolicy": {
+					Enabled: to.BoolPtr(false),
+				},
+			},
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			cluster, err := buildManagedCluster(&Spec{
+				Name:              "my-cluster",
+				ResourceGroup:     "my-rg",
+				Location:          "westus2",
+				Version:           "1.17.7",
+				AgentPools:        []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+				EnableAzurePolicy: tc.enabled,
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(cluster.AddonProfiles).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestBuildManagedClusterIngressAppGateway(t *testing.T) {
+	testcases := []struct {
+		name          string
+		appGateway    *IngressAppGateway
+		expected      map[string]*containerservice.ManagedClusterAddonProfile
+		expectedError string
+	}{
+		{
+			name:       "existing application gateway",
+			appGateway: &IngressAppGateway{ApplicationGatewayID: "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/applicationGateways/my-appgw"},
+			expected: map[string]*containerservice.ManagedClusterAddonProfile{
+				"ingressApplicationGateway": {
+					Enabled: to.BoolPtr(true),
+					Config: map[string]*string{
+						"applicationGatewayId": to.StringPtr("/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/applicationGateways/my-appgw"),
+					},
+				},
+			},
+		},
+		{
+			name:       "new application gateway",
+			appGateway: &IngressAppGateway{SubnetCIDR: "10.2.0.0/16"},
+			expected: map[string]*containerservice.ManagedClusterAddonProfile{
+				"ingressApplicationGateway": {
+					Enabled: to.BoolPtr(true),
+					Config: map[string]*string{
+						"subnetCIDR": to.StringPtr("10.2.0.0/16"),
+					},
+				},
+			},
+		},
+		{
+			name: "unset",
+		},
+		{
+			name: "both set",
+			appGateway: &IngressAppGateway{
+				ApplicationGatewayID: "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/applicationGateways/my-appgw",
+				SubnetCIDR:           "10.2.0.0/16",
+			},
+			expectedError: "invalid ingress application gateway: only one of application gateway ID and subnet CIDR can be set",
+		},
+		{
+			name:          "neither set",
+			appGateway:    &IngressAppGateway{},
+			expectedError: "invalid ingress application gateway: one of application gateway ID and subnet CIDR must be set",
+		},
+		{
+			name:          "invalid subnet cidr",
+			appGateway:    &IngressAppGateway{SubnetCIDR: "10.2.0.0"},
+			expectedError: "failed to parse ingress application gateway subnet cidr: invalid CIDR address: 10.2.0.0",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			cluster, err := (&Service{}).ReconcileDryRun(context.TODO(), &Spec{
+				Name:              "my-cluster",
+				ResourceGroup:     "my-rg",
+				Location:          "westus2",
+				Version:           "1.17.7",
+				AgentPools:        []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+				IngressAppGateway: tc.appGateway,
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(cluster.AddonProfiles).To(Equal(tc.expected))
+			}
+		})
+	}
+}
+
+func TestNormalizeManagedClusterAddonConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	desired, err := buildManagedCluster(&Spec{
+		Name:              "my-cluster",
+		ResourceGroup:     "my-rg",
+		Location:          "westus2",
+		Version:           "1.17.7",
+		AgentPools:        []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+		IngressAppGateway: &IngressAppGateway{SubnetCIDR: "10.2.0.0/16"},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	existing := containerservice.ManagedCluster{
+		ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+			AddonProfiles: map[string]*containerservice.ManagedClusterAddonProfile{
+				"ingressApplicationGateway": {
+					Enabled: to.BoolPtr(true),
+					Config: map[string]*string{
+						"subnetCIDR":                    to.StringPtr("10.2.0.0/16"),
+						"effectiveApplicationGatewayId": to.StringPtr("/subscriptions/123/resourceGroups/mc_my-rg/providers/Microsoft.Network/applicationGateways/my-appgw"),
+					},
+				},
+			},
+		},
+	}
+
+	// Config keys added by AKS are ignored, so only the keys we set are compared.
+	g.Expect(normalizeManagedCluster(existing, desired).AddonProfiles).To(Equal(desired.AddonProfiles))
+}
+
+func TestNormalizeManagedClusterAuthorizedIPRanges(t *testing.T) {
+	testcases := []struct {
+		name          string
+		desired       []string
+		existing      *containerservice.ManagedClusterAPIServerAccessProfile
+		expectChanged bool
+	}{
+		{
+			name:     "same ranges in a different order",
+			desired:  []string{"73.140.245.0/24", "20.1.2.3/32"},
+			existing: &containerservice.ManagedClusterAPIServerAccessProfile{AuthorizedIPRanges: &[]string{"20.1.2.3/32", "73.140.245.0/24"}},
+		},
+		{
+			name:          "range added",
+			desired:       []string{"73.140.245.0/24", "20.1.2.3/32"},
+			existing:      &containerservice.ManagedClusterAPIServerAccessProfile{AuthorizedIPRanges: &[]string{"73.140.245.0/24"}},
+			expectChanged: true,
+		},
+		{
+			name:          "ranges removed",
+			desired:       []string{},
+			existing:      &containerservice.ManagedClusterAPIServerAccessProfile{AuthorizedIPRanges: &[]string{"73.140.245.0/24"}},
+			expectChanged: true,
+		},
+		{
+			name:    "no ranges on an unrestricted cluster",
+			desired: []string{},
+		},
+		{
+			name:          "ranges added to an unrestricted cluster",
+			desired:       []string{"73.140.245.0/24"},
+			expectChanged: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			desired, err := buildManagedCluster(&Spec{
+				Name:                   "my-cluster",
+				ResourceGroup:          "my-rg",
+				Location:               "westus2",
+				Version:                "1.17.7",
+				AgentPools:             []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+				APIServerAccessProfile: &APIServerAccessProfile{AuthorizedIPRanges: tc.desired},
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(*desired.APIServerAccessProfile.AuthorizedIPRanges).To(Equal(tc.desired))
+
+			existing := containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					APIServerAccessProfile: tc.existing,
+				},
+			}
+			normalized := normalizeManagedCluster(existing, desired).APIServerAccessProfile
+			if tc.expectChanged {
+				g.Expect(normalized).NotTo(Equal(desired.APIServerAccessProfile))
+			} else {
+				g.Expect(normalized).To(Equal(desired.APIServerAccessProfile))
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllInvalidPools(t *testing.T) {
+	g := NewWithT(t)
+
+	err := (&Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools: []PoolSpec{
+			{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+			{Name: "Pool1", SKU: "Standard_D2s_v3", Replicas: 1},
+			{Name: "pool2", SKU: "Standard_D2s_v3", Replicas: 1, NodeTaints: []string{"dedicated=gpu"}},
+		},
+	}).Validate()
+	g.Expect(err).To(HaveOccurred())
+
+	agg, ok := err.(kerrors.Aggregate)
+	g.Expect(ok).To(BeTrue())
+	var messages []string
+	for _, e := range agg.Errors() {
+		messages = append(messages, e.Error())
+	}
+	g.Expect(messages).To(Equal([]string{
+		"invalid agent pool name 'Pool1': must start with a lowercase letter and contain only lowercase letters and numbers",
+		"invalid agent pool pool2: invalid taint 'dedicated=gpu': expected format key=value:Effect",
+	}))
+}
+
+func TestValidate(t *testing.T) {
+	pool := PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}
+	validSpec := func() *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       "1.17.7",
+			AgentPools:    []PoolSpec{pool},
+		}
+	}
+
+	testcases := []struct {
+		name           string
+		modify         func(spec *Spec)
+		expectedErrors []string
+	}{
+		{
+			name:   "valid spec",
+			modify: func(spec *Spec) {},
+		},
+		{
+			name:           "invalid name",
+			modify:         func(spec *Spec) { spec.Name = "-my-cluster" },
+			expectedErrors: []string{"invalid managed cluster name '-my-cluster': must start and end with a letter or number"},
+		},
+		{
+			name:   "empty version defaults",
+			modify: func(spec *Spec) { spec.Version = "" },
+		},
+		{
+			name:           "dns prefix ending with a hyphen",
+			modify:         func(spec *Spec) { spec.DNSPrefix = "my-prefix-" },
+			expectedErrors: []string{"invalid DNS prefix 'my-prefix-': must be at most 54 letters, digits and hyphens, and start and end with a letter or digit"},
+		},
+		{
+			name:           "dns prefix too long",
+			modify:         func(spec *Spec) { spec.DNSPrefix = strings.Repeat("a", 55) },
+			expectedErrors: []string{"invalid DNS prefix '" + strings.Repeat("a", 55) + "': must be at most 54 letters, digits and hyphens, and start and end with a letter or digit"},
+		},
+		{
+			name:           "version with a v prefix",
+			modify:         func(spec *Spec) { spec.Version = "v1.17.7" },
+			expectedErrors: []string{"invalid Kubernetes version 'v1.17.7': expected format major.minor.patch, for example 1.17.7"},
+		},
+		{
+			name:           "node resource group matches the cluster resource group",
+			modify:         func(spec *Spec) { spec.NodeResourceGroup = "My-RG" },
+			expectedErrors: []string{"node resource group 'My-RG' must be different from the cluster resource group"},
+		},
+		{
+			name:           "invalid network plugin",
+			modify:         func(spec *Spec) { spec.NetworkPlugin = to.StringPtr("flannel") },
+			expectedErrors: []string{"invalid network plugin: 'flannel'. Allowed options are 'azure' and 'kubenet'"},
+		},
+		{
+			name: "pod cidr with kubenet",
+			modify: func(spec *Spec) {
+				spec.NetworkPlugin = to.StringPtr("kubenet")
+				spec.PodCIDR = "192.168.0.0/16"
+				spec.ServiceCIDR = "10.0.0.0/16"
+			},
+		},
+		{
+			name:           "pod cidr with azure",
+			modify:         func(spec *Spec) { spec.PodCIDR = "192.168.0.0/16" },
+			expectedErrors: []string{"pod cidr '192.168.0.0/16' is only supported with the 'kubenet' network plugin, not 'azure'"},
+		},
+		{
+			name:           "service cidr too small for the DNS service IP",
+			modify:         func(spec *Spec) { spec.ServiceCIDR = "10.0.0.0/29" },
+			expectedErrors: []string{"service cidr '10.0.0.0/29' is too small to contain the DNS service IP"},
+		},
+		{
+			name: "DNS service IP outside the service cidr",
+			modify: func(spec *Spec) {
+				spec.ServiceCIDR = "10.96.0.0/12"
+				spec.DNSServiceIP = "10.0.0.10"
+			},
+			expectedErrors: []string{"DNS service IP '10.0.0.10' is not within the service cidr '10.96.0.0/12'"},
+		},
+		{
+			name:           "docker bridge cidr overlapping the service cidr",
+			modify:         func(spec *Spec) { spec.DockerBridgeCIDR = "10.0.0.1/24" },
+			expectedErrors: []string{"docker bridge cidr '10.0.0.1/24' must not overlap '10.0.0.0/16'"},
+		},
+		{
+			name:           "invalid network policy",
+			modify:         func(spec *Spec) { spec.NetworkPolicy = to.StringPtr("cilium") },
+			expectedErrors: []string{"invalid network policy: 'cilium'. Allowed options are 'calico' and 'azure'"},
+		},
+		{
+			name: "azure network policy with kubenet",
+			modify: func(spec *Spec) {
+				spec.NetworkPlugin = to.StringPtr("kubenet")
+				spec.NetworkPolicy = to.StringPtr("azure")
+			},
+			expectedErrors: []string{"network policy 'azure' is only supported with the 'azure' network plugin, not 'kubenet'. Use the 'calico' network policy with 'kubenet'"},
+		},
+		{
+			name: "load balancer profile with the Basic SKU",
+			modify: func(spec *Spec) {
+				spec.LoadBalancerSKU = to.StringPtr("basic")
+				spec.LoadBalancerProfile = &LoadBalancerProfile{ManagedOutboundIPCount: to.Int32Ptr(2)}
+			},
+			expectedErrors: []string{"load balancer profile is only supported with the 'standard' load balancer SKU, not 'basic'"},
+		},
+		{
+			name: "authorized IP ranges",
+			modify: func(spec *Spec) {
+				spec.APIServerAccessProfile = &APIServerAccessProfile{AuthorizedIPRanges: []string{"73.140.245.0/24", "20.1.2.3"}}
+			},
+		},
+		{
+			name: "invalid authorized IP ranges",
+			modify: func(spec *Spec) {
+				spec.APIServerAccessProfile = &APIServerAccessProfile{AuthorizedIPRanges: []string{"73.140.245.0/33", "office"}}
+			},
+			expectedErrors: []string{
+				"invalid API server authorized IP range '73.140.245.0/33': must be an IP address or CIDR",
+				"invalid API server authorized IP range 'office': must be an IP address or CIDR",
+			},
+		},
+		{
+			name: "authorized IP ranges on a private cluster",
+			modify: func(spec *Spec) {
+				spec.EnablePrivateCluster = to.BoolPtr(true)
+				spec.APIServerAccessProfile = &APIServerAccessProfile{AuthorizedIPRanges: []string{"73.140.245.0/24"}}
+			},
+			expectedErrors: []string{"API server authorized IP ranges are not supported with private clusters"},
+		},
+		{
+			name: "autoscaled pool",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].EnableAutoScaling = to.BoolPtr(true)
+				spec.AgentPools[0].MinCount = to.Int32Ptr(1)
+				spec.AgentPools[0].MaxCount = to.Int32Ptr(5)
+			},
+		},
+		{
+			name: "autoscaled pool without a node count range",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].EnableAutoScaling = to.BoolPtr(true)
+				spec.AgentPools[0].MaxCount = to.Int32Ptr(5)
+			},
+			expectedErrors: []string{"invalid agent pool pool0: min and max count are required with autoscaling enabled"},
+		},
+		{
+			name: "autoscaled pool with min count above max count",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].EnableAutoScaling = to.BoolPtr(true)
+				spec.AgentPools[0].MinCount = to.Int32Ptr(6)
+				spec.AgentPools[0].MaxCount = to.Int32Ptr(5)
+			},
+			expectedErrors: []string{"invalid agent pool pool0: invalid autoscaling range 6 to 5: min count must be at least 1 and no more than max count"},
+		},
+		{
+			name: "node count range without autoscaling",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].MinCount = to.Int32Ptr(1)
+				spec.AgentPools[0].MaxCount = to.Int32Ptr(5)
+			},
+			expectedErrors: []string{"invalid agent pool pool0: min and max count are only supported with autoscaling enabled"},
+		},
+		{
+			name:           "ingress application gateway without a gateway or subnet",
+			modify:         func(spec *Spec) { spec.IngressAppGateway = &IngressAppGateway{} },
+			expectedErrors: []string{"invalid ingress application gateway: one of application gateway ID and subnet CIDR must be set"},
+		},
+		{
+			name: "spot system pool",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].ScaleSetPriority = "Spot"
+			},
+			expectedErrors: []string{"invalid agent pool pool0: the first agent pool is the system pool and can't use Spot priority"},
+		},
+		{
+			name: "spot user pool",
+			modify: func(spec *Spec) {
+				spec.AgentPools = append(spec.AgentPools, PoolSpec{Name: "spot", SKU: "Standard_D2s_v3", Replicas: 1, ScaleSetPriority: "Spot"})
+			},
+		},
+		{
+			name: "zoned pool",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].AvailabilityZones = []string{"1", "2", "3"}
+			},
+		},
+		{
+			name: "zoned pool with the Basic load balancer SKU",
+			modify: func(spec *Spec) {
+				spec.LoadBalancerSKU = to.StringPtr("Basic")
+				spec.AgentPools[0].AvailabilityZones = []string{"1", "2", "3"}
+			},
+			expectedErrors: []string{"invalid agent pool pool0: availability zones are only supported with the 'standard' load balancer SKU, not 'Basic'"},
+		},
+		{
+			name:           "duplicate pool names",
+			modify:         func(spec *Spec) { spec.AgentPools = []PoolSpec{pool, pool} },
+			expectedErrors: []string{"duplicate agent pool name 'pool0'"},
+		},
+		{
+			name: "invalid pool settings",
+			modify: func(spec *Spec) {
+				spec.AgentPools = []PoolSpec{{
+					Name:             "pool0",
+					SKU:              "Standard_D2s_v3",
+					Replicas:         1,
+					OSDiskSizeGB:     10,
+					ScaleSetPriority: "Low",
+					NodeTaints:       []string{"dedicated"},
+				}}
+			},
+			expectedErrors: []string{
+				"invalid agent pool pool0: OS disk size 10 GB must be between 30 and 2048 GB, or 0 for the default size",
+				"invalid agent pool pool0: invalid scale set priority 'Low'. Allowed options are 'Regular' and 'Spot'",
+				"invalid agent pool pool0: invalid taint 'dedicated': expected format key=value:Effect",
+			},
+		},
+		{
+			name: "windows pool with a windows profile",
+			modify: func(spec *Spec) {
+				spec.WindowsProfile = &WindowsProfile{AdminUsername: "azureuser", AdminPassword: "P@ssw0rd1234"}
+				spec.AgentPools = append(spec.AgentPools, PoolSpec{Name: "win1", SKU: "Standard_D2s_v3", Replicas: 1, OSType: "Windows"})
+			},
+		},
+		{
+			name: "windows pool without a windows profile",
+			modify: func(spec *Spec) {
+				spec.AgentPools = append(spec.AgentPools, PoolSpec{Name: "win1", SKU: "Standard_D2s_v3", Replicas: 1, OSType: "Windows"})
+			},
+			expectedErrors: []string{"invalid agent pool win1: Windows pools require a windows profile"},
+		},
+		{
+			name: "windows pool with kubenet",
+			modify: func(spec *Spec) {
+				spec.NetworkPlugin = to.StringPtr("kubenet")
+				spec.WindowsProfile = &WindowsProfile{AdminUsername: "azureuser", AdminPassword: "P@ssw0rd1234"}
+				spec.AgentPools = append(spec.AgentPools, PoolSpec{Name: "win1", SKU: "Standard_D2s_v3", Replicas: 1, OSType: "Windows"})
+			},
+			expectedErrors: []string{"invalid agent pool win1: Windows pools require the 'azure' network plugin"},
+		},
+		{
+			name: "windows system pool",
+			modify: func(spec *Spec) {
+				spec.WindowsProfile = &WindowsProfile{AdminUsername: "azureuser", AdminPassword: "P@ssw0rd1234"}
+				spec.AgentPools = []PoolSpec{{Name: "win1", SKU: "Standard_D2s_v3", Replicas: 1, OSType: "Windows"}}
+			},
+			expectedErrors: []string{"invalid agent pool win1: the first agent pool is the system pool and must run Linux"},
+		},
+		{
+			name:           "windows profile without a password",
+			modify:         func(spec *Spec) { spec.WindowsProfile = &WindowsProfile{AdminUsername: "azureuser"} },
+			expectedErrors: []string{"windows profile requires an admin username and password"},
+		},
+		{
+			name: "addon profiles",
+			modify: func(spec *Spec) {
+				spec.EnableAzurePolicy = to.BoolPtr(true)
+				spec.AddonProfiles = map[string]AddonProfile{
+					"omsagent": {Enabled: true, Config: map[string]string{"logAnalyticsWorkspaceResourceID": "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.OperationalInsights/workspaces/my-workspace"}},
+				}
+			},
+		},
+		{
+			name: "addon profile set by its own field",
+			modify: func(spec *Spec) {
+				spec.EnableAzurePolicy = to.BoolPtr(true)
+				spec.AddonProfiles = map[string]AddonProfile{"azurepolicy": {Enabled: false}, "": {Enabled: true}}
+			},
+			expectedErrors: []string{
+				"invalid addon profile: name is required",
+				"invalid addon profile azurepolicy: the addon is already configured by its own field",
+			},
+		},
+		{
+			name: "every pool in an existing subnet",
+			modify: func(spec *Spec) {
+				spec.AgentPools = []PoolSpec{pool, pool}
+				spec.AgentPools[1].Name = "pool1"
+				for i := range spec.AgentPools {
+					spec.AgentPools[i].VnetSubnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+				}
+			},
+		},
+		{
+			name: "only some pools in an existing subnet",
+			modify: func(spec *Spec) {
+				spec.AgentPools = []PoolSpec{pool, pool}
+				spec.AgentPools[1].Name = "pool1"
+				spec.AgentPools[1].VnetSubnetID = "my-subnet"
+			},
+			expectedErrors: []string{
+				"invalid agent pool pool1: invalid subnet ID 'my-subnet'",
+				"either all agent pools or none must set a subnet ID",
+			},
+		},
+		{
+			name: "user defined routing",
+			modify: func(spec *Spec) {
+				spec.OutboundType = to.StringPtr("userDefinedRouting")
+				spec.AgentPools[0].VnetSubnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+			},
+		},
+		{
+			name: "user defined routing without an existing subnet",
+			modify: func(spec *Spec) {
+				spec.OutboundType = to.StringPtr("userDefinedRouting")
+				spec.LoadBalancerSKU = to.StringPtr("Basic")
+			},
+			expectedErrors: []string{
+				"outbound type 'userDefinedRouting' is only supported with the 'standard' load balancer SKU, not 'Basic'",
+				"invalid agent pool pool0: outbound type 'userDefinedRouting' requires an existing subnet with a route table",
+			},
+		},
+		{
+			name:           "invalid outbound type",
+			modify:         func(spec *Spec) { spec.OutboundType = to.StringPtr("natGateway") },
+			expectedErrors: []string{"invalid outbound type: 'natGateway'. Allowed options are 'loadBalancer' and 'userDefinedRouting'"},
+		},
+		{
+			name: "max pods within limits",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].MaxPods = to.Int32Ptr(250)
+			},
+		},
+		{
+			name: "max pods too low",
+			modify: func(spec *Spec) {
+				spec.AgentPools[0].MaxPods = to.Int32Ptr(5)
+			},
+			expectedErrors: []string{"invalid agent pool pool0: max pods 5 must be between 10 and 250"},
+		},
+		{
+			name: "every violation is reported",
+			modify: func(spec *Spec) {
+				spec.Name = ""
+				spec.Version = "latest"
+				spec.NetworkPolicy = to.StringPtr("cilium")
+				spec.AgentPools = []PoolSpec{{Name: "Pool0"}}
+			},
+			expectedErrors: []string{
+				"invalid managed cluster name '': must be between 1 and 63 characters",
+				"invalid Kubernetes version 'latest': expected format major.minor.patch, for example 1.17.7",
+				"invalid network policy: 'cilium'. Allowed options are 'calico' and 'azure'",
+				"invalid agent pool name 'Pool0': must start with a lowercase letter and contain only lowercase letters and numbers",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			spec := validSpec()
+			tc.modify(spec)
+			err := spec.Validate()
+			if len(tc.expectedErrors) == 0 {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			agg, ok := err.(kerrors.Aggregate)
+			g.Expect(ok).To(BeTrue())
+			var messages []string
+			for _, e := range agg.Errors() {
+				messages = append(messages, e.Error())
+			}
+			g.Expect(messages).To(Equal(tc.expectedErrors))
+		})
+	}
+}
+
+func TestReconcileValidatesBeforeCallingAzure(t *testing.T) {
+	g := NewWithT(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// No calls are expected on any client.
+	s := &Service{
+		Client:             mock_managedclusters.NewMockClient(mockCtrl),
+		ResourceSkusClient: mock_availabilityzones.NewMockClient(mockCtrl),
+		GroupsClient:       mock_groups.NewMockClient(mockCtrl),
+	}
+
+	err := s.Reconcile(context.TODO(), &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "v1.17.7",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})
+	g.Expect(err).To(MatchError("invalid Kubernetes version 'v1.17.7': expected format major.minor.patch, for example 1.17.7"))
+}
+
+func TestValidateName(t *testing.T) {
+	testcases := []struct {
+		name          string
+		clusterName   string
+		expectedError string
+	}{
+		{
+			name:        "valid name",
+			clusterName: "My-Cluster-01",
+		},
+		{
+			name:        "single character",
+			clusterName: "a",
+		},
+		{
+			name:        "longest name",
+			clusterName: strings.Repeat("a", 63),
+		},
+		{
+			name:          "too long",
+			clusterName:   strings.Repeat("a", 64),
+			expectedError: "invalid managed cluster name '" + strings.Repeat("a", 64) + "': must be between 1 and 63 characters",
+		},
+		{
+			name:          "empty name",
+			clusterName:   "",
+			expectedError: "invalid managed cluster name '': must be between 1 and 63 characters",
+		},
+		{
+			name:        "underscores",
+			clusterName: "my_cluster_01",
+		},
+		{
+			name:          "invalid characters",
+			clusterName:   "my_cluster.01",
+			expectedError: "invalid managed cluster name 'my_cluster.01': must contain only letters, numbers, underscores and hyphens",
+		},
+		{
+			name:          "starts with an underscore",
+			clusterName:   "_my-cluster",
+			expectedError: "invalid managed cluster name '_my-cluster': must start and end with a letter or number",
+		},
+		{
+			name:          "starts with a hyphen",
+			clusterName:   "-my-cluster",
+			expectedError: "invalid managed cluster name '-my-cluster': must start and end with a letter or number",
+		},
+		{
+			name:          "ends with a hyphen",
+			clusterName:   "my-cluster-",
+			expectedError: "invalid managed cluster name 'my-cluster-': must start and end with a letter or number",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateName(tc.clusterName)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestValidatePoolNames(t *testing.T) {
+	testcases := []struct {
+		name          string
+		pools         []PoolSpec
+		expectedError string
+	}{
+		{
+			name:  "valid linux and windows pools",
+			pools: []PoolSpec{{Name: "linuxpool001"}, {Name: "win1", OSType: "Windows"}},
+		},
+		{
+			name:          "linux pool name too long",
+			pools:         []PoolSpec{{Name: "linuxpool0001"}},
+			expectedError: "invalid agent pool name 'linuxpool0001': must be at most 12 characters for Linux pools",
+		},
+		{
+			name:          "windows pool name too long",
+			pools:         []PoolSpec{{Name: "winpool", OSType: "Windows"}},
+			expectedError: "invalid agent pool name 'winpool': must be at most 6 characters for Windows pools",
+		},
+		{
+			name:          "uppercase characters",
+			pools:         []PoolSpec{{Name: "Pool0"}},
+			expectedError: "invalid agent pool name 'Pool0': must start with a lowercase letter and contain only lowercase letters and numbers",
+		},
+		{
+			name:          "starts with a number",
+			pools:         []PoolSpec{{Name: "0pool"}},
+			expectedError: "invalid agent pool name '0pool': must start with a lowercase letter and contain only lowercase letters and numbers",
+		},
+		{
+			name:          "empty name",
+			pools:         []PoolSpec{{Name: ""}},
+			expectedError: "invalid agent pool name '': must start with a lowercase letter and contain only lowercase letters and numbers",
+		},
+		{
+			name:          "duplicate names",
+			pools:         []PoolSpec{{Name: "pool0"}, {Name: "pool1"}, {Name: "pool0"}},
+			expectedError: "duplicate agent pool name 'pool0'",
+		},
+		{
+			name:          "unknown OS type",
+			pools:         []PoolSpec{{Name: "pool0", OSType: "Plan9"}},
+			expectedError: "invalid OS type 'Plan9' for agent pool pool0. Allowed options are 'Linux' and 'Windows'",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validatePoolNames(tc.pools)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestScalePool(t *testing.T) {
+	existingPool := func(count int32) containerservice.AgentPool {
+		return containerservice.AgentPool{
+			Name: to.StringPtr("pool1"),
+			ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+				VMSize:     containerservice.VMSizeTypes("Standard_D2s_v3"),
+				Count:      to.Int32Ptr(count),
+				Type:       containerservice.VirtualMachineScaleSets,
+				NodeTaints: &[]string{"key=value:NoSchedule"},
+			},
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		expect        func(m *mock_agentpools.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "scales only the targeted pool",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existingPool(1), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", existingPool(3))
+			},
+		},
+		{
+			name: "pool already at the desired count",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existingPool(3), nil)
+			},
+		},
+		{
+			name: "pool does not exist",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(containerservice.AgentPool{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError: "failed to get agent pool pool1: #: Not found: StatusCode=404",
+		},
+		{
+			name: "autoscaled pool",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				pool := existingPool(1)
+				pool.EnableAutoScaling = to.BoolPtr(true)
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(pool, nil)
+			},
+			expectedError: "cannot scale agent pool pool1: its node count is managed by the cluster autoscaler",
+		},
+		{
+			name: "scaling fails",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool1").Return(existingPool(1), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", existingPool(3)).
+					Return(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to scale agent pool pool1: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			// No calls are expected on the managed clusters client.
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(agentPoolsMock.EXPECT())
+
+			s := &Service{
+				Client:           managedClustersMock,
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			err := s.ScalePool(context.TODO(), "my-rg", "my-cluster", PoolSpec{Name: "pool1", SKU: "Standard_D2s_v3", Replicas: 3})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcilePools(t *testing.T) {
+	liveCluster := func(names ...string) containerservice.ManagedCluster {
+		profiles := []containerservice.ManagedClusterAgentPoolProfile{}
+		for _, name := range names {
+			profiles = append(profiles, containerservice.ManagedClusterAgentPoolProfile{
+				Name:   to.StringPtr(name),
+				VMSize: containerservice.VMSizeTypes("Standard_D2s_v3"),
+				Count:  to.Int32Ptr(1),
+			})
+		}
+		return containerservice.ManagedCluster{
+			ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+				AgentPoolProfiles: &profiles,
+			},
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		pools         []PoolSpec
+		expect        func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name:  "no changes",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0"), nil)
+			},
+		},
+		{
+			name:  "adds a pool",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}, {Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 2}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0"), nil)
+				a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", containerservice.AgentPool{
+					ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+						VMSize:       containerservice.VMSizeTypes("Standard_D4s_v3"),
+						OsDiskSizeGB: to.Int32Ptr(0),
+						Count:        to.Int32Ptr(2),
+						Type:         containerservice.VirtualMachineScaleSets,
+					},
+				})
+			},
+		},
+		{
+			name:  "removes a pool",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0", "pool1"), nil)
+				a.Delete(context.TODO(), "my-rg", "my-cluster", "pool1")
+			},
+		},
+		{
+			name:  "replaces a pool",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}, {Name: "pool2", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0", "pool1"), nil)
+				gomock.InOrder(
+					a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool2", gomock.Any()),
+					a.Delete(context.TODO(), "my-rg", "my-cluster", "pool1"),
+				)
+			},
+		},
+		{
+			name:  "renames the system pool",
+			pools: []PoolSpec{{Name: "system", SKU: "Standard_D2s_v3", Replicas: 1}, {Name: "pool1", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0", "pool1"), nil)
+				// pool0 is kept until a later call, once its replacement exists.
+				a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "system", gomock.Any())
+			},
+		},
+		{
+			name:  "deletes the renamed system pool once its replacement exists",
+			pools: []PoolSpec{{Name: "system", SKU: "Standard_D2s_v3", Replicas: 1}, {Name: "pool1", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0", "pool1", "system"), nil)
+				a.Delete(context.TODO(), "my-rg", "my-cluster", "pool0")
+			},
+		},
+		{
+			name:  "pool already deleted",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0", "pool1"), nil)
+				a.Delete(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not Found"), "failed to begin operation"))
+			},
+		},
+		{
+			name: "refuses to delete the last pool",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(liveCluster("pool0"), nil)
+			},
+			expectedError: "cannot delete agent pool pool0: it is the last agent pool in managed cluster my-cluster",
+		},
+		{
+			name:  "failure getting the managed cluster",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get managed cluster my-cluster: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT(), agentPoolsMock.EXPECT())
+
+			s := &Service{
+				Client:           managedClustersMock,
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			err := s.ReconcilePools(context.TODO(), &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				AgentPools:    tc.pools,
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestGetFQDN(t *testing.T) {
+	testcases := []struct {
+		name          string
+		cluster       containerservice.ManagedCluster
+		expectedFQDN  string
+		expectedError string
+	}{
+		{
+			name: "public cluster",
+			cluster: containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Succeeded"),
+					Fqdn:              to.StringPtr("my-cluster-1234.hcp.westus2.azmk8s.io"),
+				},
+			},
+			expectedFQDN: "my-cluster-1234.hcp.westus2.azmk8s.io",
+		},
+		{
+			name: "private cluster",
+			cluster: containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Succeeded"),
+					PrivateFQDN:       to.StringPtr("my-cluster-1234.5678.privatelink.westus2.azmk8s.io"),
+					APIServerAccessProfile: &containerservice.ManagedClusterAPIServerAccessProfile{
+						EnablePrivateCluster: to.BoolPtr(true),
+					},
+				},
+			},
+			expectedFQDN: "my-cluster-1234.5678.privatelink.westus2.azmk8s.io",
+		},
+		{
+			name: "still provisioning",
+			cluster: containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Creating"),
+				},
+			},
+			expectedError: "managed cluster my-cluster has no FQDN yet, provisioning state is Creating",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").Return(tc.cluster, nil)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			fqdn, err := s.GetFQDN(context.TODO(), &Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(fqdn).To(Equal(tc.expectedFQDN))
+			}
+		})
+	}
+}
+
+func TestValidateNetworkCIDRs(t *testing.T) {
+	testcases := []struct {
+		name          string
+		podCIDR       string
+		serviceCIDR   string
+		plugin        containerservice.NetworkPlugin
+		expectedError string
+	}{
+		{
+			name:        "azure without pod cidr",
+			serviceCIDR: "10.0.0.0/16",
+			plugin:      containerservice.Azure,
+		},
+		{
+			name:        "kubenet with separate cidrs",
+			podCIDR:     "192.168.0.0/16",
+			serviceCIDR: "10.0.0.0/16",
+			plugin:      containerservice.Kubenet,
+		},
+		{
+			name:          "azure with pod cidr",
+			podCIDR:       "192.168.0.0/16",
+			serviceCIDR:   "10.0.0.0/16",
+			plugin:        containerservice.Azure,
+			expectedError: "pod cidr '192.168.0.0/16' is only supported with the 'kubenet' network plugin, not 'azure'",
+		},
+		{
+			name:          "service cidr inside pod cidr",
+			podCIDR:       "10.0.0.0/8",
+			serviceCIDR:   "10.1.0.0/16",
+			plugin:        containerservice.Kubenet,
+			expectedError: "pod cidr '10.0.0.0/8' and service cidr '10.1.0.0/16' must not overlap",
+		},
+		{
+			name:          "pod cidr inside service cidr",
+			podCIDR:       "10.1.0.0/24",
+			serviceCIDR:   "10.1.0.0/16",
+			plugin:        containerservice.Kubenet,
+			expectedError: "pod cidr '10.1.0.0/24' and service cidr '10.1.0.0/16' must not overlap",
+		},
+		{
+			name:          "invalid pod cidr",
+			podCIDR:       "10.1.0.0",
+			plugin:        containerservice.Kubenet,
+			expectedError: "failed to parse pod cidr: invalid CIDR address: 10.1.0.0",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateNetworkCIDRs(tc.podCIDR, tc.serviceCIDR, tc.plugin)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestValidateNetworkPolicy(t *testing.T) {
+	testcases := []struct {
+		name          string
+		policy        containerservice.NetworkPolicy
+		plugin        containerservice.NetworkPlugin
+		expectedError string
+	}{
+		{
+			name:   "azure policy with azure plugin",
+			policy: containerservice.NetworkPolicyAzure,
+			plugin: containerservice.Azure,
+		},
+		{
+			name:          "azure policy with kubenet plugin",
+			policy:        containerservice.NetworkPolicyAzure,
+			plugin:        containerservice.Kubenet,
+			expectedError: "network policy 'azure' is only supported with the 'azure' network plugin, not 'kubenet'. Use the 'calico' network policy with 'kubenet'",
+		},
+		{
+			name:   "calico policy with azure plugin",
+			policy: containerservice.NetworkPolicyCalico,
+			plugin: containerservice.Azure,
+		},
+		{
+			name:   "calico policy with kubenet plugin",
+			policy: containerservice.NetworkPolicyCalico,
+			plugin: containerservice.Kubenet,
+		},
+		{
+			name:   "azure policy with mixed case azure plugin",
+			policy: containerservice.NetworkPolicyAzure,
+			plugin: containerservice.NetworkPlugin("Azure"),
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateNetworkPolicy(tc.policy, tc.plugin)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestDNSServiceIP(t *testing.T) {
+	testcases := []struct {
+		name          string
+		serviceCIDR   string
+		expectedIP    string
+		expectedError string
+	}{
+		{
+			name:        "/12",
+			serviceCIDR: "10.96.0.0/12",
+			expectedIP:  "10.96.0.10",
+		},
+		{
+			name:        "/24",
+			serviceCIDR: "10.0.5.0/24",
+			expectedIP:  "10.0.5.10",
+		},
+		{
+			name:        "/28 not aligned to an octet",
+			serviceCIDR: "10.0.5.16/28",
+			expectedIP:  "10.0.5.26",
+		},
+		{
+			name:        "host bits are ignored",
+			serviceCIDR: "10.0.5.7/24",
+			expectedIP:  "10.0.5.10",
+		},
+		{
+			name:          "/29 is too small",
+			serviceCIDR:   "10.0.5.0/29",
+			expectedError: "service cidr '10.0.5.0/29' is too small to contain the DNS service IP",
+		},
+		{
+			name:          "IPv6",
+			serviceCIDR:   "fd00:10:96::/108",
+			expectedError: "service cidr 'fd00:10:96::/108' is not supported: only IPv4 service cidrs can be used",
+		},
+		{
+			name:          "invalid cidr",
+			serviceCIDR:   "10.96.0.0",
+			expectedError: "failed to parse service cidr: invalid CIDR address: 10.96.0.0",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ip, err := dnsServiceIP(tc.serviceCIDR)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(ip).To(Equal(tc.expectedIP))
+			}
+		})
+	}
+}
+
+func TestValidateDNSServiceIP(t *testing.T) {
+	testcases := []struct {
+		name          string
+		dnsIP         string
+		serviceCIDR   string
+		expectedError string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:        "derived from the service cidr",
+			serviceCIDR: "10.96.0.0/12",
+		},
+		{
+			name:          "service cidr too small for the derived IP",
+			serviceCIDR:   "10.0.5.0/29",
+			expectedError: "service cidr '10.0.5.0/29' is too small to contain the DNS service IP",
+		},
+		{
+			name:        "within the service cidr",
+			dnsIP:       "10.96.0.53",
+			serviceCIDR: "10.96.0.0/12",
+		},
+		{
+			name:        "small service cidr",
+			dnsIP:       "10.0.5.2",
+			serviceCIDR: "10.0.5.0/29",
+		},
+		{
+			name:  "within the default service cidr",
+			dnsIP: "10.0.0.10",
+		},
+		{
+			name:          "outside the default service cidr",
+			dnsIP:         "10.96.0.10",
+			expectedError: "DNS service IP '10.96.0.10' is not within the service cidr '10.0.0.0/16'",
+		},
+		{
+			name:          "outside the service cidr",
+			dnsIP:         "10.0.0.10",
+			serviceCIDR:   "10.96.0.0/12",
+			expectedError: "DNS service IP '10.0.0.10' is not within the service cidr '10.96.0.0/12'",
+		},
+		{
+			name:          "network address",
+			dnsIP:         "10.96.0.0",
+			serviceCIDR:   "10.96.0.0/12",
+			expectedError: "DNS service IP '10.96.0.0' can't be the network or broadcast address of the service cidr '10.96.0.0/12'",
+		},
+		{
+			name:          "broadcast address",
+			dnsIP:         "10.111.255.255",
+			serviceCIDR:   "10.96.0.0/12",
+			expectedError: "DNS service IP '10.111.255.255' can't be the network or broadcast address of the service cidr '10.96.0.0/12'",
+		},
+		{
+			name:          "IPv6",
+			dnsIP:         "fd00:10:96::a",
+			expectedError: "invalid DNS service IP 'fd00:10:96::a': must be an IPv4 address",
+		},
+		{
+			name:          "invalid IP",
+			dnsIP:         "10.96.0",
+			expectedError: "invalid DNS service IP '10.96.0': must be an IPv4 address",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateDNSServiceIP(tc.dnsIP, tc.serviceCIDR)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestValidateDockerBridgeCIDR(t *testing.T) {
+	testcases := []struct {
+		name          string
+		bridgeCIDR    string
+		podCIDR       string
+		serviceCIDR   string
+		expectedError string
+	}{
+		{
+			name:       "default service cidr",
+			bridgeCIDR: "172.17.0.1/16",
+		},
+		{
+			name:        "separate from the pod and service cidrs",
+			bridgeCIDR:  "172.17.0.1/16",
+			podCIDR:     "192.168.0.0/16",
+			serviceCIDR: "10.96.0.0/12",
+		},
+		{
+			name:          "overlaps the default service cidr",
+			bridgeCIDR:    "10.0.0.1/24",
+			expectedError: "docker bridge cidr '10.0.0.1/24' must not overlap '10.0.0.0/16'",
+		},
+		{
+			name:          "overlaps the service cidr",
+			bridgeCIDR:    "10.96.0.1/16",
+			serviceCIDR:   "10.96.0.0/12",
+			expectedError: "docker bridge cidr '10.96.0.1/16' must not overlap '10.96.0.0/12'",
+		},
+		{
+			name:          "overlaps the pod cidr",
+			bridgeCIDR:    "172.17.0.1/16",
+			podCIDR:       "172.16.0.0/12",
+			expectedError: "docker bridge cidr '172.17.0.1/16' must not overlap '172.16.0.0/12'",
+		},
+		{
+			name:          "invalid cidr",
+			bridgeCIDR:    "172.17.0.1",
+			expectedError: "failed to parse docker bridge cidr: invalid CIDR address: 172.17.0.1",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validateDockerBridgeCIDR(tc.bridgeCIDR, tc.podCIDR, tc.serviceCIDR)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestBuildManagedClusterNetworkProfile(t *testing.T) {
+	testcases := []struct {
+		name     string
+		modify   func(spec *Spec)
+		expected *containerservice.NetworkProfileType
+	}{
+		{
+			name:   "defaults",
+			modify: func(spec *Spec) {},
+			expected: &containerservice.NetworkProfileType{
+				NetworkPlugin:   containerservice.Azure,
+				LoadBalancerSku: containerservice.Standard,
+			},
+		},
+		{
+			name:   "DNS service IP derived from the service cidr",
+			modify: func(spec *Spec) { spec.ServiceCIDR = "10.96.0.0/12" },
+			expected: &containerservice.NetworkProfileType{
+				NetworkPlugin:   containerservice.Azure,
+				ServiceCidr:     to.StringPtr("10.96.0.0/12"),
+				DNSServiceIP:    to.StringPtr("10.96.0.10"),
+				LoadBalancerSku: containerservice.Standard,
+			},
+		},
+		{
+			name: "explicit DNS service IP and docker bridge cidr",
+			modify: func(spec *Spec) {
+				spec.ServiceCIDR = "10.96.0.0/12"
+				spec.DNSServiceIP = "10.96.0.53"
+				spec.DockerBridgeCIDR = "172.17.0.1/16"
+			},
+			expected: &containerservice.NetworkProfileType{
+				NetworkPlugin:    containerservice.Azure,
+				ServiceCidr:      to.StringPtr("10.96.0.0/12"),
+				DNSServiceIP:     to.StringPtr("10.96.0.53"),
+				DockerBridgeCidr: to.StringPtr("172.17.0.1/16"),
+				LoadBalancerSku:  containerservice.Standard,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			spec := &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				Location:      "westus2",
+				Version:       "1.17.7",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			}
+			tc.modify(spec)
+			cluster, err := buildManagedCluster(spec)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(cluster.NetworkProfile).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestDNSPrefix(t *testing.T) {
+	testcases := []struct {
+		name     string
+		spec     *Spec
+		expected string
+	}{
+		{
+			name:     "explicit prefix",
+			spec:     &Spec{Name: "my-cluster", DNSPrefix: "team-a-prod"},
+			expected: "team-a-prod",
+		},
+		{
+			name:     "falls back to the cluster name",
+			spec:     &Spec{Name: "my-cluster"},
+			expected: "my-cluster",
+		},
+		{
+			name:     "strips invalid characters",
+			spec:     &Spec{Name: "my_cluster.prod"},
+			expected: "myclusterprod",
+		},
+		{
+			name:     "strips leading and trailing hyphens",
+			spec:     &Spec{Name: "-my-cluster_-"},
+			expected: "my-cluster",
+		},
+		{
+			name:     "truncates long names",
+			spec:     &Spec{Name: "a-very-long-cluster-name-that-does-not-fit-in-a-dns-prefix"},
+			expected: "a-very-long-cluster-name-that-does-not-fit-in-a-dns-pr",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(dnsPrefix(tc.spec)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestReconcileNameWithUnderscores(t *testing.T) {
+	g := NewWithT(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my_cluster").
+		Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+	managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my_cluster", gomock.Any()).
+		Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+			g.Expect(cluster.DNSPrefix).To(Equal(to.StringPtr("mycluster")))
+		})
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	g.Expect(s.Reconcile(context.TODO(), &Spec{
+		Name:          "my_cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})).To(Succeed())
+}
+
+func TestReconcileWithResult(t *testing.T) {
+	spec := &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		SSHPublicKey:  "ssh-rsa AAAA",
+		NetworkPolicy: to.StringPtr("calico"),
+		ServiceCIDR:   "10.96.0.0/12",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 3}},
+	}
+
+	// existingCluster is the cluster AKS returns for spec, including defaults and read-only values.
+	existingCluster := func(version string) containerservice.ManagedCluster {
+		return containerservice.ManagedCluster{
+			ID:       to.StringPtr("/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.ContainerService/managedClusters/my-cluster"),
+			Name:     to.StringPtr("my-cluster"),
+			Location: to.StringPtr("westus2"),
+			Identity: &containerservice.ManagedClusterIdentity{
+				PrincipalID: to.StringPtr("principal"),
+				TenantID:    to.StringPtr("tenant"),
+				Type:        containerservice.SystemAssigned,
+			},
+			ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+				ProvisioningState: to.StringPtr("Succeeded"),
+				KubernetesVersion: to.StringPtr(version),
+				DNSPrefix:         to.StringPtr("my-cluster"),
+				Fqdn:              to.StringPtr("my-cluster-1234.hcp.westus2.azmk8s.io"),
+				NodeResourceGroup: to.StringPtr("MC_my-rg_my-cluster_westus2"),
+				LinuxProfile: &containerservice.LinuxProfile{
+					AdminUsername: to.StringPtr("azureuser"),
+					SSH: &containerservice.SSHConfiguration{
+						PublicKeys: &[]containerservice.SSHPublicKey{{KeyData: to.StringPtr("ssh-rsa AAAA")}},
+					},
+				},
+				ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+					ClientID: to.StringPtr("msi"),
+				},
+				AgentPoolProfiles: &[]containerservice.ManagedClusterAgentPoolProfile{
+					{
+						Name:                to.StringPtr("pool0"),
+						Count:               to.Int32Ptr(3),
+						VMSize:              containerservice.VMSizeTypes("Standard_D2s_v3"),
+						OsDiskSizeGB:        to.Int32Ptr(128),
+						MaxPods:             to.Int32Ptr(30),
+						OsType:              containerservice.Linux,
+						Type:                containerservice.VirtualMachineScaleSets,
+						OrchestratorVersion: to.StringPtr(version),
+						ProvisioningState:   to.StringPtr("Succeeded"),
+					},
+				},
+				NetworkProfile: &containerservice.NetworkProfileType{
+					NetworkPlugin:    containerservice.Azure,
+					NetworkPolicy:    containerservice.NetworkPolicyCalico,
+					ServiceCidr:      to.StringPtr("10.96.0.0/12"),
+					DNSServiceIP:     to.StringPtr("10.96.0.10"),
+					DockerBridgeCidr: to.StringPtr("172.17.0.1/16"),
+					LoadBalancerSku:  containerservice.LoadBalancerSku("Standard"),
+				},
+			},
+		}
+	}
+
+	outdated := existingCluster("1.16.10")
+	current := existingCluster("1.17.7")
+
+	testcases := []struct {
+		name           string
+		existing       *containerservice.ManagedCluster
+		expect         func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedResult ReconcileResult
+	}{
+		{
+			name: "create",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+			expectedResult: Created,
+		},
+		{
+			name: "update",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(existingCluster("1.16.10"), nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+			expectedResult: Updated,
+		},
+		{
+			name: "no change",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(existingCluster("1.17.7"), nil)
+			},
+			expectedResult: NoChange,
+		},
+		{
+			// The supplied cluster is used as is, without another Get.
+			name:     "update with existing cluster",
+			existing: &outdated,
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+			expectedResult: Updated,
+		},
+		{
+			name:           "no change with existing cluster",
+			existing:       &current,
+			expect:         func(m *mock_managedclusters.MockClientMockRecorder) {},
+			expectedResult: NoChange,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			var result ReconcileResult
+			var err error
+			if tc.existing != nil {
+				result, err = s.ReconcileWithExisting(context.TODO(), spec, tc.existing)
+			} else {
+				result, err = s.ReconcileWithResult(context.TODO(), spec)
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result).To(Equal(tc.expectedResult))
+		})
+	}
+}
+
+func TestReconcileAutoscaledPool(t *testing.T) {
+	spec := func(version string) *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       version,
+			AgentPools: []PoolSpec{{
+				Name:              "pool0",
+				SKU:               "Standard_D2s_v3",
+				Replicas:          1,
+				EnableAutoScaling: to.BoolPtr(true),
+				MinCount:          to.Int32Ptr(1),
+				MaxCount:          to.Int32Ptr(5),
+			}},
+		}
+	}
+	// existingCluster is the cluster for spec after the autoscaler has scaled pool0 to count nodes.
+	existingCluster := func(version string, count int32) containerservice.ManagedCluster {
+		cluster, err := buildManagedCluster(spec(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		(*cluster.AgentPoolProfiles)[0].Count = to.Int32Ptr(count)
+		return cluster
+	}
+
+	testcases := []struct {
+		name           string
+		existing       containerservice.ManagedCluster
+		expect         func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder)
+		expectedResult ReconcileResult
+	}{
+		{
+			name:           "count changed by the autoscaler",
+			existing:       existingCluster("1.17.7", 4),
+			expect:         func(_ *GomegaWithT, _ *mock_managedclusters.MockClientMockRecorder) {},
+			expectedResult: NoChange,
+		},
+		{
+			name:     "update keeps the current count",
+			existing: existingCluster("1.16.10", 4),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect((*cluster.AgentPoolProfiles)[0].Count).To(Equal(to.Int32Ptr(4)))
+						g.Expect((*cluster.AgentPoolProfiles)[0].EnableAutoScaling).To(Equal(to.BoolPtr(true)))
+					})
+			},
+			expectedResult: Updated,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(g, managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			result, err := s.ReconcileWithExisting(context.TODO(), spec("1.17.7"), &tc.existing)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result).To(Equal(tc.expectedResult))
+		})
+	}
+}
+
+func TestReconcileAddonProfiles(t *testing.T) {
+	workspaceID := "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.OperationalInsights/workspaces/my-workspace"
+	spec := func(addons map[string]AddonProfile, previous ...string) *Spec {
+		return &Spec{
+			Name:           "my-cluster",
+			ResourceGroup:  "my-rg",
+			Location:       "westus2",
+			Version:        "1.17.7",
+			AgentPools:     []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			AddonProfiles:  addons,
+			PreviousAddons: previous,
+		}
+	}
+	// existingCluster is the cluster for spec with the given addons enabled, with the extra config AKS adds.
+	existingCluster := func(names ...string) containerservice.ManagedCluster {
+		cluster, err := buildManagedCluster(spec(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster.AddonProfiles = map[string]*containerservice.ManagedClusterAddonProfile{}
+		for _, name := range names {
+			cluster.AddonProfiles[name] = &containerservice.ManagedClusterAddonProfile{Enabled: to.BoolPtr(true)}
+		}
+		if addon, ok := cluster.AddonProfiles["omsagent"]; ok {
+			addon.Config = map[string]*string{
+				"logAnalyticsWorkspaceResourceID": to.StringPtr(workspaceID),
+				"useAADAuth":                      to.StringPtr("false"),
+			}
+		}
+		return cluster
+	}
+	omsagent := map[string]AddonProfile{
+		"omsagent": {Enabled: true, Config: map[string]string{"logAnalyticsWorkspaceResourceID": workspaceID}},
+	}
+
+	testcases := []struct {
+		name           string
+		spec           *Spec
+		existing       containerservice.ManagedCluster
+		expectedAddons map[string]*containerservice.ManagedClusterAddonProfile
+		expectedResult ReconcileResult
+	}{
+		{
+			name:           "addons match",
+			spec:           spec(omsagent),
+			existing:       existingCluster("omsagent"),
+			expectedResult: NoChange,
+		},
+		{
+			name:     "addon added",
+			spec:     spec(omsagent),
+			existing: existingCluster(),
+			expectedAddons: map[string]*containerservice.ManagedClusterAddonProfile{
+				"omsagent": {Enabled: to.BoolPtr(true), Config: map[string]*string{"logAnalyticsWorkspaceResourceID": to.StringPtr(workspaceID)}},
+			},
+			expectedResult: Updated,
+		},
+		{
+			name:     "addon removed from the spec is disabled",
+			spec:     spec(omsagent, "omsagent", "azurepolicy"),
+			existing: existingCluster("omsagent", "azurepolicy"),
+			expectedAddons: map[string]*containerservice.ManagedClusterAddonProfile{
+				"omsagent":    {Enabled: to.BoolPtr(true), Config: map[string]*string{"logAnalyticsWorkspaceResourceID": to.StringPtr(workspaceID)}},
+				"azurepolicy": {Enabled: to.BoolPtr(false)},
+			},
+			expectedResult: Updated,
+		},
+		{
+			name:     "every addon removed from the spec is disabled",
+			spec:     spec(nil, "omsagent"),
+			existing: existingCluster("omsagent", "azurepolicy"),
+			expectedAddons: map[string]*containerservice.ManagedClusterAddonProfile{
+				"omsagent":    {Enabled: to.BoolPtr(false)},
+				"azurepolicy": {Enabled: to.BoolPtr(true)},
+			},
+			expectedResult: Updated,
+		},
+		{
+			name:           "addon the spec never set stays enabled",
+			spec:           spec(omsagent, "omsagent"),
+			existing:       existingCluster("omsagent", "azurepolicy"),
+			expectedResult: NoChange,
+		},
+		{
+			name:           "addons left unchanged without addon profiles",
+			spec:           spec(nil),
+			existing:       existingCluster("omsagent", "azurepolicy"),
+			expectedResult: NoChange,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			if tc.expectedAddons != nil {
+				managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(cluster.AddonProfiles).To(Equal(tc.expectedAddons))
+					})
+			}
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			result, err := s.ReconcileWithExisting(context.TODO(), tc.spec, &tc.existing)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result).To(Equal(tc.expectedResult))
+		})
+	}
+}
+
+func TestReconcileNodeResourceGroup(t *testing.T) {
+	testcases := []struct {
+		name              string
+		nodeResourceGroup string
+		existing          *containerservice.ManagedCluster
+		expected          *string
+		expectedError     string
+	}{
+		{
+			name:              "new cluster",
+			nodeResourceGroup: "my-nodes-rg",
+			expected:          to.StringPtr("my-nodes-rg"),
+		},
+		{
+			name: "unset",
+		},
+		{
+			name:              "same as the cluster resource group",
+			nodeResourceGroup: "MY-RG",
+			expectedError:     "node resource group 'MY-RG' must be different from the cluster resource group",
+		},
+		{
+			name:              "existing cluster keeps its node resource group",
+			nodeResourceGroup: "my-nodes-rg",
+			existing: &containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					KubernetesVersion: to.StringPtr("1.16.10"),
+					NodeResourceGroup: to.StringPtr("MC_my-rg_my-cluster_westus2"),
+				},
+			},
+			expected: to.StringPtr("MC_my-rg_my-cluster_westus2"),
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			if tc.expectedError == "" {
+				if tc.existing != nil {
+					managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").Return(*tc.existing, nil)
+				} else {
+					managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+						Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+				}
+				managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+						g.Expect(cluster.NodeResourceGroup).To(Equal(tc.expected))
+					})
+			}
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:              "my-cluster",
+				ResourceGroup:     "my-rg",
+				Location:          "westus2",
+				Version:           "1.17.7",
+				NodeResourceGroup: tc.nodeResourceGroup,
+				AgentPools:        []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileKeepsUnmanagedSettings(t *testing.T) {
+	g := NewWithT(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	spec := &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	}
+	existing, err := buildManagedCluster(spec)
+	g.Expect(err).NotTo(HaveOccurred())
+	existing.Tags = map[string]*string{"team": to.StringPtr("platform")}
+	existing.KubernetesVersion = to.StringPtr("1.16.10")
+	existing.ProvisioningState = to.StringPtr("Succeeded")
+	existing.Fqdn = to.StringPtr("my-cluster-dns.hcp.westus2.azmk8s.io")
+	existing.EnableRBAC = to.BoolPtr(true)
+	existing.AddonProfiles = map[string]*containerservice.ManagedClusterAddonProfile{
+		"omsagent": {Enabled: to.BoolPtr(true)},
+	}
+	existing.NetworkProfile.DockerBridgeCidr = to.StringPtr("172.17.0.1/16")
+	existing.NetworkProfile.LoadBalancerProfile = &containerservice.ManagedClusterLoadBalancerProfile{
+		ManagedOutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileManagedOutboundIPs{Count: to.Int32Ptr(2)},
+	}
+
+	managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+		Do(func(_ context.Context, _, _ string, cluster containerservice.ManagedCluster) {
+			g.Expect(cluster.KubernetesVersion).To(Equal(to.StringPtr("1.17.7")))
+			g.Expect(cluster.Tags).To(Equal(existing.Tags))
+			g.Expect(cluster.EnableRBAC).To(Equal(to.BoolPtr(true)))
+			g.Expect(cluster.AddonProfiles).To(HaveKey("omsagent"))
+			g.Expect(cluster.NetworkProfile.DockerBridgeCidr).To(Equal(to.StringPtr("172.17.0.1/16")))
+			g.Expect(cluster.NetworkProfile.LoadBalancerProfile).To(Equal(existing.NetworkProfile.LoadBalancerProfile))
+			g.Expect(cluster.ProvisioningState).To(BeNil())
+			g.Expect(cluster.Fqdn).To(BeNil())
+		})
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	result, err := s.ReconcileWithExisting(context.TODO(), spec, &existing)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(Updated))
+}
+
+func TestReconcileKeepsExistingDNSPrefix(t *testing.T) {
+	g := NewWithT(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	spec := &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	}
+	// The cluster was created with a prefix other than the default, which can't be changed.
+	existing, err := buildManagedCluster(&Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		DNSPrefix:     "my-cluster-dns",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	result, err := s.ReconcileWithExisting(context.TODO(), spec, &existing)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(NoChange))
+}
+
+func TestReconcileUpdatesPoolsThroughAgentPoolsAPI(t *testing.T) {
+	spec := func(version string, pools ...PoolSpec) *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       version,
+			AgentPools:    pools,
+		}
+	}
+
+	testcases := []struct {
+		name   string
+		spec   *Spec
+		expect func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder)
+	}{
+		{
+			name: "scaled pool",
+			spec: spec("1.17.7",
+				PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+				PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 5}),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+					Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+						g.Expect(pool.Count).To(Equal(to.Int32Ptr(5)))
+						g.Expect(pool.VMSize).To(Equal(containerservice.VMSizeTypes("Standard_D4s_v3")))
+						g.Expect(pool.OrchestratorVersion).To(Equal(to.StringPtr("1.16.10")))
+					})
+			},
+		},
+		{
+			name: "several pools changed",
+			spec: spec("1.17.7",
+				PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 3},
+				PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 2, Version: "1.17.7"}),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				gomock.InOrder(
+					a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool0", gomock.Any()),
+					a.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", "pool1", gomock.Any()).
+						Do(func(_ context.Context, _, _, _ string, pool containerservice.AgentPool) {
+							g.Expect(pool.OrchestratorVersion).To(Equal(to.StringPtr("1.17.7")))
+						}),
+				)
+			},
+		},
+		{
+			name: "cluster upgraded with a scaled pool",
+			spec: spec("1.18.4",
+				PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+				PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 5}),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+		},
+		{
+			name: "pool added",
+			spec: spec("1.17.7",
+				PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+				PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 2},
+				PoolSpec{Name: "pool2", SKU: "Standard_D4s_v3", Replicas: 2}),
+			expect: func(g *GomegaWithT, m *mock_managedclusters.MockClientMockRecorder, a *mock_agentpools.MockClientMockRecorder) {
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			existing, err := buildManagedCluster(spec("1.17.7",
+				PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1},
+				PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 2, Version: "1.16.10"}))
+			g.Expect(err).NotTo(HaveOccurred())
+			tc.expect(g, managedClustersMock.EXPECT(), agentPoolsMock.EXPECT())
+
+			s := &Service{
+				Client:           managedClustersMock,
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			result, err := s.ReconcileWithExisting(context.TODO(), tc.spec, &existing)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result).To(Equal(Updated))
+		})
+	}
+}
+
+func TestReconcilePoolUpdateValidatesSubnets(t *testing.T) {
+	g := NewWithT(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	subnetsMock := mock_subnets.NewMockClient(mockCtrl)
+
+	spec := func(replicas int32) *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       "1.17.7",
+			AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: replicas, VnetSubnetID: exhaustedSubnetID}},
+		}
+	}
+	existing, err := buildManagedCluster(spec(1))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The pool is only scaled, but its subnet is checked before the agent pools API is called.
+	subnetsMock.EXPECT().Get(context.TODO(), "my-rg", "my-vnet", "my-subnet").
+		Return(network.Subnet{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+
+	s := &Service{
+		Client:           mock_managedclusters.NewMockClient(mockCtrl),
+		AgentPoolsClient: mock_agentpools.NewMockClient(mockCtrl),
+		SubnetsClient:    subnetsMock,
+	}
+
+	result, err := s.ReconcileWithExisting(context.TODO(), spec(3), &existing)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(HavePrefix("failed to get subnet " + exhaustedSubnetID))
+	g.Expect(result).To(Equal(NoChange))
+}
+
+func TestGetAgentPool(t *testing.T) {
+	testcases := []struct {
+		name             string
+		expect           func(m *mock_agentpools.MockClientMockRecorder)
+		expectedPool     containerservice.AgentPool
+		expectedError    string
+		expectedNotFound bool
+	}{
+		{
+			name: "found",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool0").Return(containerservice.AgentPool{
+					Name: to.StringPtr("pool0"),
+					ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+						ProvisioningState: to.StringPtr("Succeeded"),
+					},
+				}, nil)
+			},
+			expectedPool: containerservice.AgentPool{
+				Name: to.StringPtr("pool0"),
+				ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+					ProvisioningState: to.StringPtr("Succeeded"),
+				},
+			},
+		},
+		{
+			name: "not found",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool0").
+					Return(containerservice.AgentPool{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError:    "agent pool pool0 not found in managed cluster my-cluster: #: Not found: StatusCode=404",
+			expectedNotFound: true,
+		},
+		{
+			name: "other error",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster", "pool0").
+					Return(containerservice.AgentPool{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get agent pool pool0: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(agentPoolsMock.EXPECT())
+
+			s := &Service{
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			pool, err := s.GetAgentPool(context.TODO(), "my-rg", "my-cluster", "pool0")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+				var notFound *agentPoolNotFoundError
+				g.Expect(errors.As(err, &notFound)).To(Equal(tc.expectedNotFound))
+				g.Expect(errors.Is(err, ErrAgentPoolNotFound)).To(Equal(tc.expectedNotFound))
+				g.Expect(errors.Is(err, ErrManagedClusterNotFound)).To(BeFalse())
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(pool).To(Equal(tc.expectedPool))
+			}
+		})
+	}
+}
+
+func TestGetPoolStatuses(t *testing.T) {
+	testcases := []struct {
+		name             string
+		expect           func(m *mock_agentpools.MockClientMockRecorder)
+		expectedStatuses []PoolStatus
+		expectedError    string
+	}{
+		{
+			name: "pools",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{
+					{
+						Name: to.StringPtr("pool0"),
+						ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+							Count:             to.Int32Ptr(3),
+							ProvisioningState: to.StringPtr("Succeeded"),
+						},
+					},
+					{
+						Name: to.StringPtr("pool1"),
+						ManagedClusterAgentPoolProfileProperties: &containerservice.ManagedClusterAgentPoolProfileProperties{
+							Count:             to.Int32Ptr(1),
+							ProvisioningState: to.StringPtr("Scaling"),
+						},
+					},
+					{
+						Name: to.StringPtr("pool2"),
+					},
+				}, nil)
+			},
+			expectedStatuses: []PoolStatus{
+				{Name: "pool0", Count: 3, ProvisioningState: "Succeeded"},
+				{Name: "pool1", Count: 1, ProvisioningState: "Scaling"},
+				{Name: "pool2"},
+			},
+		},
+		{
+			name: "no pools",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return(nil, nil)
+			},
+			expectedStatuses: []PoolStatus{},
+		},
+		{
+			name: "error",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").
+					Return(nil, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to list agent pools of managed cluster my-cluster: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(agentPoolsMock.EXPECT())
+
+			s := &Service{
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			statuses, err := s.GetPoolStatuses(context.TODO(), "my-rg", "my-cluster")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(statuses).NotTo(BeNil())
+				g.Expect(statuses).To(Equal(tc.expectedStatuses))
+			}
+		})
+	}
+}
+
+func TestDeleteAgentPool(t *testing.T) {
+	pool := func(name string) containerservice.AgentPool {
+		return containerservice.AgentPool{Name: to.StringPtr(name)}
+	}
+
+	testcases := []struct {
+		name          string
+		expect        func(m *mock_agentpools.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "delete",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{pool("pool0"), pool("pool1")}, nil)
+				m.Delete(context.TODO(), "my-rg", "my-cluster", "pool1")
+			},
+		},
+		{
+			name: "last pool",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{pool("pool1")}, nil)
+			},
+			expectedError: "cannot delete agent pool pool1: it is the last agent pool in managed cluster my-cluster",
+		},
+		{
+			name: "already deleted",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{pool("pool0")}, nil)
+			},
+		},
+		{
+			name: "deleted concurrently",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{pool("pool0"), pool("pool1")}, nil)
+				m.Delete(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"), "failed to begin operation"))
+			},
+		},
+		{
+			name: "delete fails",
+			expect: func(m *mock_agentpools.MockClientMockRecorder) {
+				m.List(context.TODO(), "my-rg", "my-cluster").Return([]containerservice.AgentPool{pool("pool0"), pool("pool1")}, nil)
+				m.Delete(context.TODO(), "my-rg", "my-cluster", "pool1").
+					Return(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to delete agent pool pool1: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			agentPoolsMock := mock_agentpools.NewMockClient(mockCtrl)
+
+			tc.expect(agentPoolsMock.EXPECT())
+
+			s := &Service{
+				AgentPoolsClient: agentPoolsMock,
+			}
+
+			err := s.DeleteAgentPool(context.TODO(), "my-rg", "my-cluster", "pool1")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestGetPoolSpecs(t *testing.T) {
+	testcases := []struct {
+		name          string
+		expect        func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedPools []PoolSpec
+		expectedError string
+	}{
+		{
+			name: "two pools",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{
+					ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+						AgentPoolProfiles: &[]containerservice.ManagedClusterAgentPoolProfile{
+							{
+								Name:              to.StringPtr("pool0"),
+								VMSize:            containerservice.VMSizeTypes("Standard_D2s_v3"),
+								Count:             to.Int32Ptr(3),
+								OsDiskSizeGB:      to.Int32Ptr(128),
+								OsType:            containerservice.Linux,
+								MaxPods:           to.Int32Ptr(30),
+								Type:              containerservice.VirtualMachineScaleSets,
+								ProvisioningState: to.StringPtr("Succeeded"),
+							},
+							{
+								Name:                   to.StringPtr("spot"),
+								VMSize:                 containerservice.VMSizeTypes("Standard_D4s_v3"),
+								Count:                  to.Int32Ptr(1),
+								OsDiskSizeGB:           to.Int32Ptr(64),
+								OsType:                 containerservice.Linux,
+								VnetSubnetID:           to.StringPtr("/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"),
+								NodeTaints:             &[]string{"kubernetes.azure.com/scalesetpriority=spot:NoSchedule"},
+								ScaleSetPriority:       containerservice.Low,
+								ScaleSetEvictionPolicy: containerservice.Delete,
+								AvailabilityZones:      &[]string{"1", "2"},
+							},
+						},
+					},
+				}, nil)
+			},
+			expectedPools: []PoolSpec{
+				{
+					Name:         "pool0",
+					SKU:          "Standard_D2s_v3",
+					Replicas:     3,
+					OSDiskSizeGB: 128,
+					OSType:       "Linux",
+					MaxPods:      to.Int32Ptr(30),
+				},
+				{
+					Name:                   "spot",
+					SKU:                    "Standard_D4s_v3",
+					Replicas:               1,
+					OSDiskSizeGB:           64,
+					OSType:                 "Linux",
+					VnetSubnetID:           "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet",
+					NodeTaints:             []string{"kubernetes.azure.com/scalesetpriority=spot:NoSchedule"},
+					ScaleSetPriority:       "Spot",
+					ScaleSetEvictionPolicy: "Delete",
+					AvailabilityZones:      []string{"1", "2"},
+				},
+			},
+		},
+		{
+			name: "no pools",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{}, nil)
+			},
+			expectedPools: []PoolSpec{},
+		},
+		{
+			name: "cluster not found",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError: "managed cluster my-cluster not found: #: Not found: StatusCode=404",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			pools, err := s.GetPoolSpecs(context.TODO(), "my-rg", "my-cluster")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(pools).To(Equal(tc.expectedPools))
+			}
+		})
+	}
+}
+
+func TestBuildManagedClusterLoadBalancerProfile(t *testing.T) {
+	testcases := []struct {
+		name          string
+		sku           *string
+		profile       *LoadBalancerProfile
+		expected      *containerservice.ManagedClusterLoadBalancerProfile
+		expectedError string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "outbound IPs and ports",
+			profile: &LoadBalancerProfile{
+				ManagedOutboundIPCount: to.Int32Ptr(4),
+				AllocatedOutboundPorts: to.Int32Ptr(8000),
+			},
+			expected: &containerservice.ManagedClusterLoadBalancerProfile{
+				ManagedOutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileManagedOutboundIPs{
+					Count: to.Int32Ptr(4),
+				},
+				AllocatedOutboundPorts: to.Int32Ptr(8000),
+			},
+		},
+		{
+			name: "explicit Standard SKU",
+			sku:  to.StringPtr("Standard"),
+			profile: &LoadBalancerProfile{
+				ManagedOutboundIPCount: to.Int32Ptr(2),
+			},
+			expected: &containerservice.ManagedClusterLoadBalancerProfile{
+				ManagedOutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileManagedOutboundIPs{
+					Count: to.Int32Ptr(2),
+				},
+			},
+		},
+		{
+			name: "Basic SKU",
+			sku:  to.StringPtr("basic"),
+			profile: &LoadBalancerProfile{
+				ManagedOutboundIPCount: to.Int32Ptr(2),
+			},
+			expectedError: "load balancer profile is only supported with the 'standard' load balancer SKU, not 'basic'",
+		},
+		{
+			name: "too many outbound IPs",
+			profile: &LoadBalancerProfile{
+				ManagedOutboundIPCount: to.Int32Ptr(101),
+			},
+			expectedError: "invalid managed outbound IP count 101: must be between 1 and 100",
+		},
+		{
+			name: "outbound IP prefixes and idle timeout",
+			profile: &LoadBalancerProfile{
+				OutboundIPPrefixes:   []string{"/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPPrefixes/my-prefix"},
+				IdleTimeoutInMinutes: to.Int32Ptr(10),
+			},
+			expected: &containerservice.ManagedClusterLoadBalancerProfile{
+				OutboundIPPrefixes: &containerservice.ManagedClusterLoadBalancerProfileOutboundIPPrefixes{
+					PublicIPPrefixes: &[]containerservice.ResourceReference{
+						{ID: to.StringPtr("/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPPrefixes/my-prefix")},
+					},
+				},
+				IdleTimeoutInMinutes: to.Int32Ptr(10),
+			},
+		},
+		{
+			name: "outbound IPs",
+			profile: &LoadBalancerProfile{
+				OutboundIPs: []string{"/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/my-ip"},
+			},
+			expected: &containerservice.ManagedClusterLoadBalancerProfile{
+				OutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileOutboundIPs{
+					PublicIPs: &[]containerservice.ResourceReference{
+						{ID: to.StringPtr("/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/my-ip")},
+					},
+				},
+			},
+		},
+		{
+			name: "managed outbound IPs and outbound IPs",
+			profile: &LoadBalancerProfile{
+				ManagedOutboundIPCount: to.Int32Ptr(2),
+				OutboundIPs:            []string{"/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/my-ip"},
+			},
+			expectedError: "only one of managed outbound IP count, outbound IPs and outbound IP prefixes can be set",
+		},
+		{
+			name: "outbound IP prefix that is a public IP",
+			profile: &LoadBalancerProfile{
+				OutboundIPPrefixes: []string{"/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/my-ip"},
+			},
+			expectedError: "invalid outbound IP prefix '/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/my-ip': expected a public IP prefix resource ID",
+		},
+		{
+			name: "idle timeout too short",
+			profile: &LoadBalancerProfile{
+				IdleTimeoutInMinutes: to.Int32Ptr(2),
+			},
+			expectedError: "invalid idle timeout 2 minutes: must be between 4 and 120",
+		},
+		{
+			name: "ports not a multiple of 8",
+			profile: &LoadBalancerProfile{
+				AllocatedOutboundPorts: to.Int32Ptr(1001),
+			},
+			expectedError: "invalid allocated outbound ports 1001: must be a multiple of 8 between 0 and 64000",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			cluster, err := (&Service{}).ReconcileDryRun(context.TODO(), &Spec{
+				Name:                "my-cluster",
+				ResourceGroup:       "my-rg",
+				Location:            "westus2",
+				Version:             "1.17.7",
+				LoadBalancerSKU:     tc.sku,
+				LoadBalancerProfile: tc.profile,
+				AgentPools:          []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(cluster.NetworkProfile.LoadBalancerProfile).To(Equal(tc.expected))
+			}
+		})
+	}
+}
+
+func TestNormalizeManagedClusterOutboundIPs(t *testing.T) {
+	g := NewWithT(t)
+	ipID := func(name string) string {
+		return "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/publicIPAddresses/" + name
+	}
+	desired, err := buildManagedCluster(&Spec{
+		Name:                "my-cluster",
+		ResourceGroup:       "my-rg",
+		Location:            "westus2",
+		Version:             "1.17.7",
+		LoadBalancerProfile: &LoadBalancerProfile{OutboundIPs: []string{ipID("ip1"), ipID("ip2")}},
+		AgentPools:          []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	existing := func(ids ...string) containerservice.ManagedCluster {
+		properties := *desired.ManagedClusterProperties
+		networkProfile := *properties.NetworkProfile
+		networkProfile.LoadBalancerProfile = &containerservice.ManagedClusterLoadBalancerProfile{
+			ManagedOutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileManagedOutboundIPs{Count: to.Int32Ptr(1)},
+			OutboundIPs: &containerservice.ManagedClusterLoadBalancerProfileOutboundIPs{
+				PublicIPs: resourceReferences(ids),
+			},
+			IdleTimeoutInMinutes: to.Int32Ptr(30),
+		}
+		properties.NetworkProfile = &networkProfile
+		cluster := desired
+		cluster.ManagedClusterProperties = &properties
+		return cluster
+	}
+
+	// Azure may return the IDs reordered and in another case.
+	normalized := normalizeManagedCluster(existing(strings.ToUpper(ipID("ip2")), ipID("ip1")), desired)
+	g.Expect(normalized.NetworkProfile.LoadBalancerProfile).To(Equal(desired.NetworkProfile.LoadBalancerProfile))
+
+	normalized = normalizeManagedCluster(existing(ipID("ip1"), ipID("ip3")), desired)
+	g.Expect(normalized.NetworkProfile.LoadBalancerProfile).NotTo(Equal(desired.NetworkProfile.LoadBalancerProfile))
+}
+
+func TestReconcileAgentPoolsRequired(t *testing.T) {
+	testcases := []struct {
+		name          string
+		pools         []PoolSpec
+		expect        func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "nil pools on create",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError: "at least one agent pool is required",
+		},
+		{
+			name:  "empty pools on create",
+			pools: []PoolSpec{},
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedError: "at least one agent pool is required",
+		},
+		{
+			name: "no pools on update",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{}, nil)
+				m.CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+			},
+		},
+		{
+			name:          "duplicate pool names",
+			pools:         []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}, {Name: "pool0", SKU: "Standard_D4s_v3", Replicas: 1}},
+			expect:        func(m *mock_managedclusters.MockClientMockRecorder) {},
+			expectedError: "duplicate agent pool name 'pool0'",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				Location:      "westus2",
+				Version:       "1.17.7",
+				AgentPools:    tc.pools,
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+// logEntry is a message logged by testLogger, with all of its key/value pairs.
+type logEntry struct {
+	msg           string
+	keysAndValues []interface{}
+}
+
+// testLogger is a logr.Logger that records the messages logged through it.
+type testLogger struct {
+	values  []interface{}
+	entries *[]logEntry
+}
+
+func (l testLogger) Info(msg string, keysAndValues ...interface{}) {
+	kvs := append(append([]interface{}{}, l.values...), keysAndValues...)
+	*l.entries = append(*l.entries, logEntry{msg: msg, keysAndValues: kvs})
+}
+
+func (l testLogger) Enabled() bool { return true }
+
+func (l testLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.Info(msg, append(keysAndValues, "error", err)...)
+}
+
+func (l testLogger) V(level int) logr.InfoLogger { return l }
+
+func (l testLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return testLogger{values: append(append([]interface{}{}, l.values...), keysAndValues...), entries: l.entries}
+}
+
+func (l testLogger) WithName(name string) logr.Logger { return l }
+
+func TestReconcileLogging(t *testing.T) {
+	g := NewWithT(t)
+
+	mockCtrl := gomock.NewController(t)
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+		Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+	managedClustersMock.EXPECT().CreateOrUpdate(context.TODO(), "my-rg", "my-cluster", gomock.Any())
+
+	var entries []logEntry
+	s := &Service{
+		Client: managedClustersMock,
+		Logger: testLogger{entries: &entries},
+	}
+
+	g.Expect(s.Reconcile(context.TODO(), &Spec{
+		Name:          "my-cluster",
+		ResourceGroup: "my-rg",
+		Location:      "westus2",
+		Version:       "1.17.7",
+		AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+	})).To(Succeed())
+
+	g.Expect(entries).To(Equal([]logEntry{
+		{msg: "reconciling managed cluster", keysAndValues: []interface{}{"cluster", "my-cluster", "resourceGroup", "my-rg"}},
+		{msg: "successfully reconciled managed cluster", keysAndValues: []interface{}{"cluster", "my-cluster", "resourceGroup", "my-rg", "result", Created}},
+	}))
+}
+
+const sampleKubeconfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Y2EtZGF0YQ==
+    server: https://my-cluster-1234.hcp.westus2.azmk8s.io:443
+  name: my-cluster
+contexts:
+- context:
+    cluster: my-cluster
+    user: clusterAdmin_my-rg_my-cluster
+  name: my-cluster-admin
+current-context: my-cluster-admin
+kind: Config
+preferences: {}
+users:
+- name: clusterAdmin_my-rg_my-cluster
+  user:
+    token: 0123456789abcdef
+`
+
+func TestGetKubeconfig(t *testing.T) {
+	testcases := []struct {
+		name          string
+		data          []byte
+		expectedError string
+	}{
+		{
+			name: "valid kubeconfig",
+			data: []byte(sampleKubeconfig),
+		},
+		{
+			name:          "ARM error instead of a kubeconfig",
+			data:          []byte(`{"error": {"code": "ResourceNotFound", "message": "The Resource was not found."}}`),
+			expectedError: "failed to parse kubeconfig of managed cluster my-cluster: no clusters found",
+		},
+		{
+			name:          "malformed payload",
+			data:          []byte("not a kubeconfig"),
+			expectedError: "failed to parse kubeconfig of managed cluster my-cluster",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().GetCredentials(context.TODO(), "my-rg", "my-cluster").Return(tc.data, nil)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			config, err := s.GetKubeconfig(context.TODO(), "my-rg", "my-cluster")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(HavePrefix(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(config.CurrentContext).To(Equal("my-cluster-admin"))
+				g.Expect(config.Clusters).To(HaveKey("my-cluster"))
+				g.Expect(config.Clusters["my-cluster"].Server).To(Equal("https://my-cluster-1234.hcp.westus2.azmk8s.io:443"))
+				g.Expect(config.Clusters["my-cluster"].CertificateAuthorityData).To(Equal([]byte("ca-data")))
+			}
+		})
+	}
+}
+
+func TestValidatePoolSKUs(t *testing.T) {
+	skus := []compute.ResourceSku{
+		{ResourceType: to.StringPtr("virtualMachines"), Name: to.StringPtr("Standard_D2s_v3")},
+		{ResourceType: to.StringPtr("disks"), Name: to.StringPtr("Premium_LRS")},
+		{
+			ResourceType: to.StringPtr("virtualMachines"),
+			Name:         to.StringPtr("Standard_NC6"),
+			Restrictions: &[]compute.ResourceSkuRestrictions{{Type: compute.Location}},
+		},
+		{
+			ResourceType: to.StringPtr("virtualMachines"),
+			Name:         to.StringPtr("Standard_D4s_v3"),
+			Restrictions: &[]compute.ResourceSkuRestrictions{{Type: compute.Zone}},
+		},
+	}
+
+	testcases := []struct {
+		name          string
+		pools         []PoolSpec
+		expectedError string
+	}{
+		{
+			name:  "available sizes",
+			pools: []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3"}, {Name: "pool1", SKU: "standard_d4s_v3"}},
+		},
+		{
+			name:  "default size",
+			pools: []PoolSpec{{Name: "pool0"}},
+		},
+		{
+			name:          "unknown size",
+			pools:         []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3"}, {Name: "pool1", SKU: "Standard_Z9"}},
+			expectedError: `agent pool pool1 uses VM size Standard_Z9, which is not available in location "westus2"`,
+		},
+		{
+			name:          "restricted size",
+			pools:         []PoolSpec{{Name: "gpu", SKU: "Standard_NC6"}},
+			expectedError: `agent pool gpu uses VM size Standard_NC6, which is not available in location "westus2"`,
+		},
+		{
+			name:          "not a VM size",
+			pools:         []PoolSpec{{Name: "pool0", SKU: "Premium_LRS"}},
+			expectedError: `agent pool pool0 uses VM size Premium_LRS, which is not available in location "westus2"`,
+		},
+		{
+			name:          "several unavailable sizes",
+			pools:         []PoolSpec{{Name: "pool0", SKU: "Standard_Z9"}, {Name: "gpu", SKU: "Standard_NC6"}},
+			expectedError: `agent pool pool0 uses VM size Standard_Z9; agent pool gpu uses VM size Standard_NC6, which is not available in location "westus2"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := validatePoolSKUs("westus2", tc.pools, skus)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(Equal(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileUnavailablePoolSKU(t *testing.T) {
+	testcases := []struct {
+		name          string
+		expect        func(m *mock_availabilityzones.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "size not offered in location",
+			expect: func(m *mock_availabilityzones.MockClientMockRecorder) {
+				m.ListComplete(gomock.Any(), "location eq 'westus2'").Return(compute.NewResourceSkusResultIterator(compute.ResourceSkusResultPage{}), nil)
+			},
+			expectedError: `agent pool pool0 uses VM size Standard_D2s_v3, which is not available in location "West US 2"`,
+		},
+		{
+			name: "listing sizes fails",
+			expect: func(m *mock_availabilityzones.MockClientMockRecorder) {
+				m.ListComplete(gomock.Any(), "location eq 'westus2'").Return(compute.ResourceSkusResultIterator{}, autorest.NewError("", "", "Internal Server Error"))
+			},
+			expectedError: "failed to list available VM sizes",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			skusMock := mock_availabilityzones.NewMockClient(mockCtrl)
+
+			spec := &Spec{
+				Name:          "my-cluster",
+				ResourceGroup: "my-rg",
+				Location:      "West US 2",
+				Version:       "1.17.7",
+				SSHPublicKey:  "",
+				AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			}
+
+			// The SKUs of a new cluster are validated before it is written.
+			managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").
+				Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			tc.expect(skusMock.EXPECT())
+
+			s := &Service{
+				Client:             managedClustersMock,
+				ResourceSkusClient: skusMock,
+			}
+
+			err := s.Reconcile(context.TODO(), spec)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(HavePrefix(tc.expectedError))
+		})
+	}
+}
+
+func TestReconcileValidatesNewPoolSKUs(t *testing.T) {
+	pool0 := PoolSpec{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}
+	spec := func(pools ...PoolSpec) *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       "1.17.7",
+			AgentPools:    pools,
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		spec          *Spec
+		expect        func(m *mock_availabilityzones.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name: "unchanged pools",
+			spec: spec(pool0),
+		},
+		{
+			name: "new pool",
+			spec: spec(pool0, PoolSpec{Name: "pool1", SKU: "Standard_D4s_v3", Replicas: 1}),
+			expect: func(m *mock_availabilityzones.MockClientMockRecorder) {
+				m.ListComplete(gomock.Any(), "location eq 'westus2'").Return(compute.NewResourceSkusResultIterator(compute.ResourceSkusResultPage{}), nil)
+			},
+			expectedError: `agent pool pool1 uses VM size Standard_D4s_v3, which is not available in location "westus2"`,
+		},
+		{
+			name: "resized pool",
+			spec: spec(PoolSpec{Name: "pool0", SKU: "Standard_D8s_v3", Replicas: 1}),
+			expect: func(m *mock_availabilityzones.MockClientMockRecorder) {
+				m.ListComplete(gomock.Any(), "location eq 'westus2'").Return(compute.NewResourceSkusResultIterator(compute.ResourceSkusResultPage{}), nil)
+			},
+			expectedError: `agent pool pool0 uses VM size Standard_D8s_v3, which is not available in location "westus2"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			skusMock := mock_availabilityzones.NewMockClient(mockCtrl)
+			if tc.expect != nil {
+				tc.expect(skusMock.EXPECT())
+			}
+
+			existing, err := buildManagedCluster(spec(pool0))
+			g.Expect(err).NotTo(HaveOccurred())
+
+			s := &Service{
+				Client:             mock_managedclusters.NewMockClient(mockCtrl),
+				ResourceSkusClient: skusMock,
+			}
+
+			result, err := s.ReconcileWithExisting(context.TODO(), tc.spec, &existing)
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(result).To(Equal(NoChange))
+			}
+		})
+	}
+}
+
+func TestGetUpgradeProfile(t *testing.T) {
+	profile := containerservice.ManagedClusterUpgradeProfile{
+		Name: to.StringPtr("default"),
+		ManagedClusterUpgradeProfileProperties: &containerservice.ManagedClusterUpgradeProfileProperties{
+			ControlPlaneProfile: &containerservice.ManagedClusterPoolUpgradeProfile{
+				KubernetesVersion: to.StringPtr("1.17.7"),
+				Upgrades: &[]containerservice.ManagedClusterPoolUpgradeProfileUpgradesItem{
+					{KubernetesVersion: to.StringPtr("1.18.4")},
+				},
+			},
+			AgentPoolProfiles: &[]containerservice.ManagedClusterPoolUpgradeProfile{
+				{
+					Name:              to.StringPtr("pool0"),
+					KubernetesVersion: to.StringPtr("1.17.7"),
+					Upgrades: &[]containerservice.ManagedClusterPoolUpgradeProfileUpgradesItem{
+						{KubernetesVersion: to.StringPtr("1.18.4")},
+					},
+				},
+			},
+		},
+	}
+
+	testcases := []struct {
+		name             string
+		expect           func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedProfile  containerservice.ManagedClusterUpgradeProfile
+		expectedNotFound bool
+		expectedError    string
+	}{
+		{
+			name: "upgrades available",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.GetUpgradeProfile(context.TODO(), "my-rg", "my-cluster").Return(profile, nil)
+			},
+			expectedProfile: profile,
+		},
+		{
+			name: "cluster not found",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.GetUpgradeProfile(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedClusterUpgradeProfile{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"))
+			},
+			expectedNotFound: true,
+			expectedError:    "managed cluster my-cluster not found: #: Not found: StatusCode=404",
+		},
+		{
+			name: "other error",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.GetUpgradeProfile(context.TODO(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedClusterUpgradeProfile{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get upgrade profile of managed cluster my-cluster: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			result, err := s.GetUpgradeProfile(context.TODO(), "my-rg", "my-cluster")
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+				g.Expect(errors.Is(err, ErrManagedClusterNotFound)).To(Equal(tc.expectedNotFound))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(result).To(Equal(tc.expectedProfile))
+			}
+		})
+	}
+}
+
+func TestReconcileConcurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+	const clusters = 5
+	specs := make([]*Spec, clusters)
+	for i := range specs {
+		specs[i] = &Spec{
+			Name:          fmt.Sprintf("cluster%d", i),
+			ResourceGroup: "my-rg",
+			Location:      []string{"westus2", "eastus"}[i%2],
+			Version:       fmt.Sprintf("1.17.%d", i),
+			SSHPublicKey:  fmt.Sprintf("ssh-rsa key%d", i),
+			AgentPools:    []PoolSpec{{Name: fmt.Sprintf("pool%d", i), SKU: "Standard_D2s_v3", Replicas: int32(i + 1)}},
+		}
+	}
+
+	var mu sync.Mutex
+	created := map[string]containerservice.ManagedCluster{}
+	managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", gomock.Any()).
+		Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found")).
+		Times(clusters)
+	managedClustersMock.EXPECT().CreateOrUpdate(gomock.Any(), "my-rg", gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, _, name string, cluster containerservice.ManagedCluster) {
+			mu.Lock()
+			defer mu.Unlock()
+			created[name] = cluster
+		}).
+		Times(clusters)
+
+	s := &Service{
+		Client: managedClustersMock,
+	}
+
+	// Run with -race to catch state shared between concurrent reconciles.
+	var wg sync.WaitGroup
+	errs := make([]error, clusters)
+	for i := range specs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Reconcile(context.TODO(), specs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, spec := range specs {
+		g.Expect(errs[i]).NotTo(HaveOccurred())
+		cluster, ok := created[spec.Name]
+		g.Expect(ok).To(BeTrue())
+		g.Expect(cluster.Location).To(Equal(to.StringPtr(spec.Location)))
+		g.Expect(cluster.KubernetesVersion).To(Equal(to.StringPtr(spec.Version)))
+		g.Expect((*cluster.LinuxProfile.SSH.PublicKeys)[0].KeyData).To(Equal(to.StringPtr(spec.SSHPublicKey)))
+		g.Expect(*cluster.AgentPoolProfiles).To(HaveLen(1))
+		g.Expect((*cluster.AgentPoolProfiles)[0].Name).To(Equal(to.StringPtr(spec.AgentPools[0].Name)))
+		g.Expect((*cluster.AgentPoolProfiles)[0].Count).To(Equal(to.Int32Ptr(spec.AgentPools[0].Replicas)))
+	}
+
+	// Changing one cluster's properties must not leak into another's.
+	*created["cluster0"].LinuxProfile.AdminUsername = "changed"
+	*created["cluster0"].ServicePrincipalProfile.ClientID = "changed"
+	g.Expect(created["cluster1"].LinuxProfile.AdminUsername).To(Equal(to.StringPtr(defaultUser)))
+	g.Expect(created["cluster1"].ServicePrincipalProfile.ClientID).To(Equal(to.StringPtr(managedIdentity)))
+}
+
+func TestRotateClusterCertificates(t *testing.T) {
+	testcases := []struct {
+		name             string
+		err              error
+		expectedNotFound bool
+		expectedError    string
+	}{
+		{
+			name: "rotated",
+		},
+		{
+			name:             "cluster not found",
+			err:              errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"), "failed to begin operation"),
+			expectedNotFound: true,
+			expectedError:    "managed cluster my-cluster not found: failed to begin operation: #: Not found: StatusCode=404",
+		},
+		{
+			name:          "operation failed",
+			err:           errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"), "failed to end operation"),
+			expectedError: "failed to rotate certificates of managed cluster my-cluster: failed to end operation: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			// The client returns once the long-running operation completes.
+			completed := false
+			managedClustersMock.EXPECT().RotateClusterCertificates(gomock.Any(), "my-rg", "my-cluster").
+				DoAndReturn(func(_ context.Context, _, _ string) error {
+					completed = true
+					return tc.err
+				})
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.RotateClusterCertificates(context.TODO(), "my-rg", "my-cluster")
+			g.Expect(completed).To(BeTrue())
+			g.Expect(errors.Is(err, ErrManagedClusterNotFound)).To(Equal(tc.expectedNotFound))
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestRotateClusterCertificatesAsync(t *testing.T) {
+	testcases := []struct {
+		name             string
+		err              error
+		expectedNotFound bool
+		expectedError    string
+	}{
+		{
+			name: "started",
+		},
+		{
+			name:             "cluster not found",
+			err:              errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found"), "failed to begin operation"),
+			expectedNotFound: true,
+			expectedError:    "managed cluster my-cluster not found: failed to begin operation: #: Not found: StatusCode=404",
+		},
+		{
+			name:          "start failed",
+			err:           errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"), "failed to begin operation"),
+			expectedError: "failed to rotate certificates of managed cluster my-cluster: failed to begin operation: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().RotateClusterCertificatesAsync(gomock.Any(), "my-rg", "my-cluster").
+				Return(azureautorest.Future{}, tc.err)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			future, err := s.RotateClusterCertificatesAsync(context.TODO(), "my-rg", "my-cluster")
+			g.Expect(errors.Is(err, ErrManagedClusterNotFound)).To(Equal(tc.expectedNotFound))
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+				g.Expect(future).To(BeNil())
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(future).NotTo(BeNil())
+			}
+		})
+	}
+}
+
+func TestResetServicePrincipalProfile(t *testing.T) {
+	servicePrincipalCluster := containerservice.ManagedCluster{
+		ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+			ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+				ClientID: to.StringPtr("old-client-id"),
+			},
+		},
+	}
+
+	testcases := []struct {
+		name          string
+		clientID      string
+		secret        string
+		expect        func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedError string
+	}{
+		{
+			name:     "service principal",
+			clientID: "new-client-id",
+			secret:   "new-secret",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(servicePrincipalCluster, nil)
+				m.ResetServicePrincipalProfile(context.TODO(), "my-rg", "my-cluster", containerservice.ManagedClusterServicePrincipalProfile{
+					ClientID: to.StringPtr("new-client-id"),
+					Secret:   to.StringPtr("new-secret"),
+				})
+			},
+		},
+		{
+			name:     "system assigned identity",
+			clientID: "new-client-id",
+			secret:   "new-secret",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{
+					Identity: &containerservice.ManagedClusterIdentity{
+						Type: containerservice.SystemAssigned,
+					},
+					ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+						ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+							ClientID: to.StringPtr("msi"),
+						},
+					},
+				}, nil)
+			},
+			expectedError: "managed cluster my-cluster uses a managed identity and has no service principal to reset",
+		},
+		{
+			name:          "missing secret",
+			clientID:      "new-client-id",
+			expect:        func(m *mock_managedclusters.MockClientMockRecorder) {},
+			expectedError: "a client ID and secret are required to reset a service principal",
+		},
+		{
+			name:     "reset fails",
+			clientID: "new-client-id",
+			secret:   "new-secret",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(context.TODO(), "my-rg", "my-cluster").Return(servicePrincipalCluster, nil)
+				m.ResetServicePrincipalProfile(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Return(errors.Wrap(autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 400}, "Bad Request"), "failed to end operation"))
+			},
+			expectedError: "failed to reset service principal of managed cluster my-cluster: failed to end operation: #: Bad Request: StatusCode=400",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.ResetServicePrincipalProfile(context.TODO(), "my-rg", "my-cluster", tc.clientID, tc.secret)
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileResourceGroup(t *testing.T) {
+	notFound := autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 404}, "Not found")
+
+	testcases := []struct {
+		name                string
+		createResourceGroup bool
+		expect              func(m *mock_groups.MockClientMockRecorder)
+		expectReconcile     bool
+		expectedError       string
+	}{
+		{
+			name: "existing group",
+			expect: func(m *mock_groups.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg").Return(resources.Group{Name: to.StringPtr("my-rg")}, nil)
+			},
+			expectReconcile: true,
+		},
+		{
+			name: "missing group",
+			expect: func(m *mock_groups.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg").Return(resources.Group{}, notFound)
+			},
+			expectedError: "resource group my-rg does not exist, create it or set CreateResourceGroup",
+		},
+		{
+			name:                "missing group created",
+			createResourceGroup: true,
+			expect: func(m *mock_groups.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg").Return(resources.Group{}, notFound)
+				m.CreateOrUpdate(gomock.Any(), "my-rg", resources.Group{
+					Location: to.StringPtr("westus2"),
+					Tags:     map[string]*string{"team": to.StringPtr("platform")},
+				})
+			},
+			expectReconcile: true,
+		},
+		{
+			name: "get group fails",
+			expect: func(m *mock_groups.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg").
+					Return(resources.Group{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 403}, "Forbidden"))
+			},
+			expectedError: "failed to get resource group my-rg: #: Forbidden: StatusCode=403",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+			groupsMock := mock_groups.NewMockClient(mockCtrl)
+
+			tc.expect(groupsMock.EXPECT())
+			managedClustersMock.EXPECT().Get(gomock.Any(), "my-rg", "my-cluster").Return(containerservice.ManagedCluster{}, notFound)
+			if tc.expectReconcile {
+				managedClustersMock.EXPECT().CreateOrUpdate(gomock.Any(), "my-rg", "my-cluster", gomock.Any())
+			}
+
+			s := &Service{
+				Client:       managedClustersMock,
+				GroupsClient: groupsMock,
+			}
+
+			err := s.Reconcile(context.TODO(), &Spec{
+				Name:                "my-cluster",
+				ResourceGroup:       "my-rg",
+				Location:            "West US 2",
+				Version:             "1.17.7",
+				Tags:                map[string]string{"team": "platform"},
+				CreateResourceGroup: tc.createResourceGroup,
+				AgentPools:          []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+			})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestGetIdentityPrincipalID(t *testing.T) {
+	testcases := []struct {
+		name                string
+		cluster             containerservice.ManagedCluster
+		expectedPrincipalID string
+		expectedError       string
+	}{
+		{
+			name: "populated",
+			cluster: containerservice.ManagedCluster{
+				Identity: &containerservice.ManagedClusterIdentity{
+					Type:        containerservice.SystemAssigned,
+					PrincipalID: to.StringPtr("principal"),
+					TenantID:    to.StringPtr("tenant"),
+				},
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Succeeded"),
+				},
+			},
+			expectedPrincipalID: "principal",
+		},
+		{
+			name: "not ready",
+			cluster: containerservice.ManagedCluster{
+				Identity: &containerservice.ManagedClusterIdentity{
+					Type: containerservice.SystemAssigned,
+				},
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Creating"),
+				},
+			},
+			expectedError: "managed cluster my-cluster has no identity principal ID yet, provisioning state is Creating",
+		},
+		{
+			name: "service principal",
+			cluster: containerservice.ManagedCluster{
+				ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+					ProvisioningState: to.StringPtr("Succeeded"),
+					ServicePrincipalProfile: &containerservice.ManagedClusterServicePrincipalProfile{
+						ClientID: to.StringPtr("client-id"),
+					},
+				},
+			},
+			expectedError: "managed cluster my-cluster uses a service principal, not a managed identity",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().Get(context.TODO(), "my-rg", "my-cluster").Return(tc.cluster, nil)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			principalID, err := s.GetIdentityPrincipalID(context.TODO(), &Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(principalID).To(Equal(tc.expectedPrincipalID))
+			}
+		})
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	waitFn := waitForRetry
+	defer func() { waitForRetry = waitFn }()
+
+	cluster := func(state string) containerservice.ManagedCluster {
+		return containerservice.ManagedCluster{
+			ManagedClusterProperties: &containerservice.ManagedClusterProperties{
+				ProvisioningState: to.StringPtr(state),
+			},
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		expect        func(m *mock_managedclusters.MockClientMockRecorder)
+		cancelled     bool
+		expectedWaits int
+		expectedError string
+	}{
+		{
+			name: "creating then succeeded",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				gomock.InOrder(
+					m.Get(gomock.Any(), "my-rg", "my-cluster").Return(cluster("Creating"), nil).Times(2),
+					m.Get(gomock.Any(), "my-rg", "my-cluster").Return(cluster("Succeeded"), nil),
+				)
+			},
+			expectedWaits: 2,
+		},
+		{
+			name: "creating then failed",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				gomock.InOrder(
+					m.Get(gomock.Any(), "my-rg", "my-cluster").Return(cluster("Creating"), nil),
+					m.Get(gomock.Any(), "my-rg", "my-cluster").Return(cluster("Failed"), nil),
+				)
+			},
+			expectedWaits: 1,
+			expectedError: "managed cluster my-cluster failed to provision, provisioning state is Failed",
+		},
+		{
+			name: "context done",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg", "my-cluster").Return(cluster("Updating"), nil)
+			},
+			cancelled:     true,
+			expectedWaits: 1,
+			expectedError: "managed cluster my-cluster is not ready, provisioning state is Updating: context canceled",
+		},
+		{
+			name: "get fails",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.Get(gomock.Any(), "my-rg", "my-cluster").
+					Return(containerservice.ManagedCluster{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 500}, "Internal Server Error"))
+			},
+			expectedError: "failed to get managed cluster my-cluster: #: Internal Server Error: StatusCode=500",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			waits := 0
+			waitForRetry = func(ctx context.Context, d time.Duration) error {
+				g.Expect(d).To(Equal(time.Second))
+				waits++
+				if tc.cancelled {
+					return context.Canceled
+				}
+				return nil
+			}
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			err := s.WaitForReady(context.TODO(), &Spec{Name: "my-cluster", ResourceGroup: "my-rg"}, time.Second)
+			g.Expect(waits).To(Equal(tc.expectedWaits))
+			if tc.expectedError != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestReconcileAsync(t *testing.T) {
+	spec := func(version string) *Spec {
+		return &Spec{
+			Name:          "my-cluster",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			Version:       version,
+			AgentPools:    []PoolSpec{{Name: "pool0", SKU: "Standard_D2s_v3", Replicas: 1}},
+		}
+	}
+	existing, err := buildManagedCluster(spec("1.16.10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name           string
+		version        string
+		expect         func(m *mock_managedclusters.MockClientMockRecorder)
+		expectedResult ReconcileResult
+		expectedFuture bool
+		expectedError  string
+	}{
+		{
+			name:           "no change",
+			version:        "1.16.10",
+			expect:         func(_ *mock_managedclusters.MockClientMockRecorder) {},
+			expectedResult: NoChange,
+		},
+		{
+			name:    "update started",
+			version: "1.17.7",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdateAsync(context.TODO(), "my-rg", "my-cluster", gomock.Any()).Return(azureautorest.Future{}, nil)
+			},
+			expectedResult: Updated,
+			expectedFuture: true,
+		},
+		{
+			name:    "update fails to start",
+			version: "1.17.7",
+			expect: func(m *mock_managedclusters.MockClientMockRecorder) {
+				m.CreateOrUpdateAsync(context.TODO(), "my-rg", "my-cluster", gomock.Any()).
+					Return(azureautorest.Future{}, autorest.NewErrorWithResponse("", "", &http.Response{StatusCode: 400}, "Bad request"))
+			},
+			expectedResult: NoChange,
+			expectedError:  "failed to create or update managed cluster: #: Bad request: StatusCode=400",
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			tc.expect(managedClustersMock.EXPECT())
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			result, future, err := s.ReconcileAsync(context.TODO(), spec(tc.version), &existing)
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+				g.Expect(errors.Cause(err)).To(BeAssignableToTypeOf(autorest.DetailedError{}))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+			g.Expect(result).To(Equal(tc.expectedResult))
+			g.Expect(future != nil).To(Equal(tc.expectedFuture))
+		})
+	}
+}
+
+func TestIsDone(t *testing.T) {
+	testcases := []struct {
+		name           string
+		done           bool
+		err            error
+		expectedDone   bool
+		expectedError  string
+		expectedSubnet bool
+	}{
+		{
+			name: "in progress",
+		},
+		{
+			name:         "done",
+			done:         true,
+			expectedDone: true,
+		},
+		{
+			name:          "failed",
+			done:          true,
+			err:           errors.New("Code=\"ControlPlaneAddOnsNotReady\""),
+			expectedError: "managed cluster operation failed: Code=\"ControlPlaneAddOnsNotReady\"",
+		},
+		{
+			name:           "subnet exhausted",
+			done:           true,
+			err:            errors.New("Code=\"SubnetIsFull\""),
+			expectedError:  "managed cluster operation failed: the node subnet has no free IP addresses left, expand the subnet address range: Code=\"SubnetIsFull\"",
+			expectedSubnet: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			managedClustersMock := mock_managedclusters.NewMockClient(mockCtrl)
+
+			managedClustersMock.EXPECT().IsDone(context.TODO(), azureautorest.Future{}).Return(tc.done, tc.err)
+
+			s := &Service{
+				Client: managedClustersMock,
+			}
+
+			done, err := s.IsDone(context.TODO(), azureautorest.Future{})
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+			} else {
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+			var subnetErr *ErrSubnetExhausted
+			g.Expect(errors.As(err, &subnetErr)).To(Equal(tc.expectedSubnet))
+			g.Expect(done).To(Equal(tc.expectedDone))
+		})
+	}
+}
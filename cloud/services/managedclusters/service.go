@@ -18,16 +18,45 @@ package managedclusters
 
 import (
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/go-logr/logr"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/agentpools"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/availabilityzones"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/groups"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/locations"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/subnets"
 )
 
 // Service provides operations on azure resources
 type Service struct {
 	Client
+	SubnetsClient    subnets.Client
+	LocationsClient  locations.Client
+	AgentPoolsClient agentpools.Client
+
+	// ResourceSkusClient lists the VM sizes offered in a location.
+	ResourceSkusClient availabilityzones.Client
+
+	// GroupsClient checks, and optionally creates, the cluster's resource group.
+	GroupsClient groups.Client
+
+	// Logger logs the service's operations. Defaults to a klog backed logger.
+	Logger logr.Logger
+
+	// MaxRetries is how many times a request throttled by Azure is retried before failing.
+	MaxRetries int
 }
 
 // NewService creates a new service.
 func NewService(authorizer autorest.Authorizer, subscriptionID string) *Service {
 	return &Service{
-		Client: NewClient(subscriptionID, authorizer),
+		Client:             NewClient(subscriptionID, authorizer),
+		SubnetsClient:      subnets.NewClient(subscriptionID, authorizer),
+		LocationsClient:    locations.NewClient(subscriptionID, authorizer),
+		AgentPoolsClient:   agentpools.NewClient(subscriptionID, authorizer),
+		ResourceSkusClient: availabilityzones.NewClient(subscriptionID, authorizer),
+		GroupsClient:       groups.NewClient(subscriptionID, authorizer),
+		Logger:             klogr.New(),
+		MaxRetries:         defaultMaxThrottleRetries,
 	}
 }
@@ -0,0 +1,795 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package managedclusters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-06-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	infrav1exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
+)
+
+var (
+	// clusterNameCharactersRegex matches the characters AKS accepts in a managed cluster name.
+	// Underscores are allowed in the name and removed from the default DNS prefix.
+	clusterNameCharactersRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+
+	// poolNameRegex matches the names AKS accepts for agent pools, before length limits are applied.
+	poolNameRegex = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+	// publicIPIDRegex and publicIPPrefixIDRegex match the resource IDs of public IPs and public IP prefixes.
+	publicIPIDRegex       = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/publicIPAddresses/[^/]+$`)
+	publicIPPrefixIDRegex = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/publicIPPrefixes/[^/]+$`)
+
+	// versionRegex matches the Kubernetes versions accepted by the AzureManagedControlPlane API.
+	versionRegex = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)([-0-9a-zA-Z_\.+]*)?$`)
+)
+
+const (
+	// privateEndpointNetworkPoliciesDisabled is the subnet setting required to place private endpoints in a subnet.
+	privateEndpointNetworkPoliciesDisabled = "Disabled"
+
+	// defaultServiceCIDR is the service CIDR AKS uses when none is set.
+	defaultServiceCIDR = "10.0.0.0/16"
+
+	// maxLinuxPoolNameLength and maxWindowsPoolNameLength are the longest agent pool names AKS accepts per OS type.
+	maxLinuxPoolNameLength   = 12
+	maxWindowsPoolNameLength = 6
+
+	// maxManagedOutboundIPCount and maxAllocatedOutboundPorts are the upper limits of a load balancer profile.
+	maxManagedOutboundIPCount = 100
+	maxAllocatedOutboundPorts = 64000
+
+	// minIdleTimeoutInMinutes and maxIdleTimeoutInMinutes bound the outbound flow idle timeout of a load balancer profile.
+	minIdleTimeoutInMinutes = 4
+	maxIdleTimeoutInMinutes = 120
+
+	// maxClusterNameLength is the longest managed cluster name AKS accepts.
+	maxClusterNameLength = 63
+
+	// minOSDiskSizeGB and maxOSDiskSizeGB bound the OS disk size Azure accepts for agent pool nodes.
+	minOSDiskSizeGB = 30
+	maxOSDiskSizeGB = 2048
+
+	// minMaxPods and maxMaxPods bound the maximum number of pods per node AKS accepts for an agent pool.
+	minMaxPods = 10
+	maxMaxPods = 250
+
+	// maxLocationSuggestionDistance is the largest edit distance at which an available region is suggested for an unknown one.
+	maxLocationSuggestionDistance = 2
+
+	// virtualMachinesResourceType is the resource type of VM sizes in the compute SKUs API.
+	virtualMachinesResourceType = "virtualMachines"
+)
+
+// Validate checks the specification against the rules AKS applies to a managed cluster, without calling Azure.
+// Every violation is reported in a single aggregated error.
+func (s *Spec) Validate() error {
+	var errs []error
+	if err := validateName(s.Name); err != nil {
+		errs = append(errs, err)
+	}
+	if s.DNSPrefix != "" && !infrav1exp.IsValidDNSPrefix(s.DNSPrefix) {
+		errs = append(errs, errors.Errorf("invalid DNS prefix '%s': must be at most %d letters, digits and hyphens, and start and end with a letter or digit", s.DNSPrefix, infrav1exp.MaxDNSPrefixLength))
+	}
+	if s.Version != "" && !versionRegex.MatchString(s.Version) {
+		errs = append(errs, errors.Errorf("invalid Kubernetes version '%s': expected format major.minor.patch, for example 1.17.7", s.Version))
+	}
+	if s.NodeResourceGroup != "" && strings.EqualFold(s.NodeResourceGroup, s.ResourceGroup) {
+		errs = append(errs, errors.Errorf("node resource group '%s' must be different from the cluster resource group", s.NodeResourceGroup))
+	}
+
+	plugin := containerservice.Azure
+	if s.NetworkPlugin != nil {
+		plugin = containerservice.NetworkPlugin(*s.NetworkPlugin)
+		if !strings.EqualFold(*s.NetworkPlugin, string(containerservice.Azure)) && !strings.EqualFold(*s.NetworkPlugin, string(containerservice.Kubenet)) {
+			errs = append(errs, errors.Errorf("invalid network plugin: '%s'. Allowed options are '%s' and '%s'", *s.NetworkPlugin, containerservice.Azure, containerservice.Kubenet))
+		}
+	}
+	if err := validateNetworkCIDRs(s.PodCIDR, s.ServiceCIDR, plugin); err != nil {
+		errs = append(errs, err)
+	} else if err := validateDNSServiceIP(s.DNSServiceIP, s.ServiceCIDR); err != nil {
+		errs = append(errs, err)
+	}
+	if s.DockerBridgeCIDR != "" {
+		if err := validateDockerBridgeCIDR(s.DockerBridgeCIDR, s.PodCIDR, s.ServiceCIDR); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.NetworkPolicy != nil {
+		policy, err := parseNetworkPolicy(*s.NetworkPolicy)
+		if err == nil {
+			err = validateNetworkPolicy(policy, plugin)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.OutboundType != nil {
+		if err := validateOutboundType(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.LoadBalancerProfile != nil {
+		sku := containerservice.Standard
+		if s.LoadBalancerSKU != nil {
+			sku = containerservice.LoadBalancerSku(*s.LoadBalancerSKU)
+		}
+		if err := validateLoadBalancerProfile(s.LoadBalancerProfile, sku); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.APIServerAccessProfile != nil {
+		if err := validateAuthorizedIPRanges(s.APIServerAccessProfile.AuthorizedIPRanges, s.EnablePrivateCluster); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.IngressAppGateway != nil {
+		if err := validateIngressAppGateway(s.IngressAppGateway); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateAddonProfiles(s); err != nil {
+		errs = append(errs, err)
+	}
+
+	if s.WindowsProfile != nil {
+		if s.WindowsProfile.AdminUsername == "" || s.WindowsProfile.AdminPassword == "" {
+			errs = append(errs, errors.New("windows profile requires an admin username and password"))
+		}
+	}
+
+	if err := validatePoolNames(s.AgentPools); err != nil {
+		errs = append(errs, err)
+	}
+	for i, pool := range s.AgentPools {
+		if !strings.EqualFold(pool.OSType, string(containerservice.Windows)) {
+			continue
+		}
+		if i == 0 {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: the first agent pool is the system pool and must run %s", pool.Name, containerservice.Linux))
+		}
+		if s.WindowsProfile == nil {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: %s pools require a windows profile", pool.Name, containerservice.Windows))
+		}
+		if !strings.EqualFold(string(plugin), string(containerservice.Azure)) {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: %s pools require the '%s' network plugin", pool.Name, containerservice.Windows, containerservice.Azure))
+		}
+	}
+	for _, pool := range s.AgentPools {
+		if len(pool.AvailabilityZones) > 0 && s.LoadBalancerSKU != nil && !strings.EqualFold(*s.LoadBalancerSKU, string(containerservice.Standard)) {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: availability zones are only supported with the '%s' load balancer SKU, not '%s'", pool.Name, containerservice.Standard, *s.LoadBalancerSKU))
+		}
+	}
+	if err := validatePoolSubnets(s.AgentPools); err != nil {
+		errs = append(errs, err)
+	}
+	if len(s.AgentPools) > 0 && s.AgentPools[0].ScaleSetPriority == scaleSetPrioritySpot {
+		errs = append(errs, errors.Errorf("invalid agent pool %s: the first agent pool is the system pool and can't use %s priority", s.AgentPools[0].Name, scaleSetPrioritySpot))
+	}
+	for _, pool := range s.AgentPools {
+		if err := validatePool(pool); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return kerrors.Flatten(kerrors.NewAggregate(errs))
+}
+
+// validateName checks a managed cluster name against the AKS naming rules.
+func validateName(name string) error {
+	if len(name) == 0 || len(name) > maxClusterNameLength {
+		return errors.Errorf("invalid managed cluster name '%s': must be between 1 and %d characters", name, maxClusterNameLength)
+	}
+	if !clusterNameCharactersRegex.MatchString(name) {
+		return errors.Errorf("invalid managed cluster name '%s': must contain only letters, numbers, underscores and hyphens", name)
+	}
+	if strings.Trim(name, "_-") != name {
+		return errors.Errorf("invalid managed cluster name '%s': must start and end with a letter or number", name)
+	}
+	return nil
+}
+
+// validatePoolNames checks each pool name against the AKS naming rules for its OS type,
+// and that no two pools in the cluster share a name. Every invalid pool is reported.
+func validatePoolNames(pools []PoolSpec) error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, pool := range pools {
+		if err := validatePoolName(pool); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if seen[pool.Name] {
+			errs = append(errs, errors.Errorf("duplicate agent pool name '%s'", pool.Name))
+		}
+		seen[pool.Name] = true
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validatePoolName checks a pool name against the AKS naming rules for the pool's OS type.
+func validatePoolName(pool PoolSpec) error {
+	maxLength := maxLinuxPoolNameLength
+	switch containerservice.OSType(pool.OSType) {
+	case "", containerservice.Linux:
+	case containerservice.Windows:
+		maxLength = maxWindowsPoolNameLength
+	default:
+		return errors.Errorf("invalid OS type '%s' for agent pool %s. Allowed options are '%s' and '%s'", pool.OSType, pool.Name, containerservice.Linux, containerservice.Windows)
+	}
+	if !poolNameRegex.MatchString(pool.Name) {
+		return errors.Errorf("invalid agent pool name '%s': must start with a lowercase letter and contain only lowercase letters and numbers", pool.Name)
+	}
+	if len(pool.Name) > maxLength {
+		return errors.Errorf("invalid agent pool name '%s': must be at most %d characters for %s pools", pool.Name, maxLength, osTypeOrDefault(pool.OSType))
+	}
+	return nil
+}
+
+// validatePool checks the OS disk size, max pods, scale set priority, taints and autoscaling of a pool. Every invalid setting is reported.
+func validatePool(pool PoolSpec) error {
+	var errs []error
+	if pool.Version != "" && !versionRegex.MatchString(pool.Version) {
+		errs = append(errs, errors.Errorf("invalid agent pool %s: invalid Kubernetes version '%s': expected format major.minor.patch, for example 1.17.7", pool.Name, pool.Version))
+	}
+	if err := validateOSDiskSize(pool.OSDiskSizeGB); err != nil {
+		errs = append(errs, errors.Wrapf(err, "invalid agent pool %s", pool.Name))
+	}
+	if pool.MaxPods != nil {
+		if maxPods := *pool.MaxPods; maxPods < minMaxPods || maxPods > maxMaxPods {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: max pods %d must be between %d and %d", pool.Name, maxPods, minMaxPods, maxMaxPods))
+		}
+	}
+	if err := validateScaleSetPriority(pool); err != nil {
+		errs = append(errs, errors.Wrapf(err, "invalid agent pool %s", pool.Name))
+	}
+	for _, taint := range pool.NodeTaints {
+		if err := validateTaint(taint); err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid agent pool %s", pool.Name))
+		}
+	}
+	if err := validateAutoScaling(pool); err != nil {
+		errs = append(errs, errors.Wrapf(err, "invalid agent pool %s", pool.Name))
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateOSDiskSize checks an OS disk size is either 0, for the default size, or within the bounds Azure accepts.
+func validateOSDiskSize(sizeGB int32) error {
+	if sizeGB == 0 || (sizeGB >= minOSDiskSizeGB && sizeGB <= maxOSDiskSizeGB) {
+		return nil
+	}
+	return errors.Errorf("OS disk size %d GB must be between %d and %d GB, or 0 for the default size", sizeGB, minOSDiskSizeGB, maxOSDiskSizeGB)
+}
+
+// validateAutoScaling checks that an autoscaled pool has a node count range of at least one node,
+// and that a range is only set when autoscaling is enabled.
+func validateAutoScaling(pool PoolSpec) error {
+	if pool.EnableAutoScaling == nil || !*pool.EnableAutoScaling {
+		if pool.MinCount != nil || pool.MaxCount != nil {
+			return errors.New("min and max count are only supported with autoscaling enabled")
+		}
+		return nil
+	}
+	if pool.MinCount == nil || pool.MaxCount == nil {
+		return errors.New("min and max count are required with autoscaling enabled")
+	}
+	if min, max := *pool.MinCount, *pool.MaxCount; min < 1 || min > max {
+		return errors.Errorf("invalid autoscaling range %d to %d: min count must be at least 1 and no more than max count", min, max)
+	}
+	return nil
+}
+
+// validateScaleSetPriority checks the priority and eviction policy of a pool.
+// An eviction policy only applies to spot pools.
+func validateScaleSetPriority(pool PoolSpec) error {
+	switch pool.ScaleSetPriority {
+	case "", scaleSetPriorityRegular:
+		if pool.ScaleSetEvictionPolicy != "" {
+			return errors.Errorf("scale set eviction policy '%s' is only supported for %s priority", pool.ScaleSetEvictionPolicy, scaleSetPrioritySpot)
+		}
+	case scaleSetPrioritySpot:
+		switch containerservice.ScaleSetEvictionPolicy(pool.ScaleSetEvictionPolicy) {
+		case "", containerservice.Delete, containerservice.Deallocate:
+		default:
+			return errors.Errorf("invalid scale set eviction policy '%s'. Allowed options are '%s' and '%s'", pool.ScaleSetEvictionPolicy, containerservice.Delete, containerservice.Deallocate)
+		}
+	default:
+		return errors.Errorf("invalid scale set priority '%s'. Allowed options are '%s' and '%s'", pool.ScaleSetPriority, scaleSetPriorityRegular, scaleSetPrioritySpot)
+	}
+	return nil
+}
+
+// validateTaint checks that a taint is of the form key[=value]:Effect, where
+// Effect is one of the effects supported by Kubernetes.
+func validateTaint(taint string) error {
+	parts := strings.Split(taint, ":")
+	if len(parts) != 2 || parts[0] == "" || strings.HasPrefix(parts[0], "=") {
+		return errors.Errorf("invalid taint '%s': expected format key=value:Effect", taint)
+	}
+
+	switch corev1.TaintEffect(parts[1]) {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		return nil
+	default:
+		return errors.Errorf("invalid taint '%s': effect must be one of %s, %s or %s", taint,
+			corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute)
+	}
+}
+
+// validatePoolSubnets checks the subnet IDs of the agent pools. AKS requires either every pool or none to join an existing subnet.
+func validatePoolSubnets(pools []PoolSpec) error {
+	var errs []error
+	withSubnet := 0
+	for _, pool := range pools {
+		if pool.VnetSubnetID == "" {
+			continue
+		}
+		withSubnet++
+		if _, _, _, err := parseSubnetID(pool.VnetSubnetID); err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid agent pool %s", pool.Name))
+		}
+	}
+	if withSubnet > 0 && withSubnet < len(pools) {
+		errs = append(errs, errors.New("either all agent pools or none must set a subnet ID"))
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateNetworkCIDRs checks that a pod CIDR is only set with the kubenet network plugin,
+// since Azure CNI assigns pods addresses from the node subnet, and that the pod and service CIDRs don't overlap.
+func validateNetworkCIDRs(podCIDR, serviceCIDR string, plugin containerservice.NetworkPlugin) error {
+	if podCIDR == "" {
+		return nil
+	}
+	if !strings.EqualFold(string(plugin), string(containerservice.Kubenet)) {
+		return errors.Errorf("pod cidr '%s' is only supported with the '%s' network plugin, not '%s'", podCIDR, containerservice.Kubenet, plugin)
+	}
+	_, podNet, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse pod cidr")
+	}
+	if serviceCIDR == "" {
+		return nil
+	}
+	_, serviceNet, err := net.ParseCIDR(serviceCIDR)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse service cidr")
+	}
+	if podNet.Contains(serviceNet.IP) || serviceNet.Contains(podNet.IP) {
+		return errors.Errorf("pod cidr '%s' and service cidr '%s' must not overlap", podCIDR, serviceCIDR)
+	}
+	return nil
+}
+
+// validateDNSServiceIP checks that a DNS service IP is a host address of the service CIDR, or of the
+// default service CIDR when none is set. Without a DNS service IP, the service CIDR must fit the default one.
+func validateDNSServiceIP(dnsIP, serviceCIDR string) error {
+	if dnsIP == "" {
+		if serviceCIDR == "" {
+			return nil
+		}
+		_, err := dnsServiceIP(serviceCIDR)
+		return err
+	}
+	ip := net.ParseIP(dnsIP).To4()
+	if ip == nil {
+		return errors.Errorf("invalid DNS service IP '%s': must be an IPv4 address", dnsIP)
+	}
+	if serviceCIDR == "" {
+		serviceCIDR = defaultServiceCIDR
+	}
+	_, serviceNet, err := net.ParseCIDR(serviceCIDR)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse service cidr")
+	}
+	if !serviceNet.Contains(ip) {
+		return errors.Errorf("DNS service IP '%s' is not within the service cidr '%s'", dnsIP, serviceCIDR)
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = serviceNet.IP[i] | ^serviceNet.Mask[i]
+	}
+	if ip.Equal(serviceNet.IP) || ip.Equal(broadcast) {
+		return errors.Errorf("DNS service IP '%s' can't be the network or broadcast address of the service cidr '%s'", dnsIP, serviceCIDR)
+	}
+	return nil
+}
+
+// validateDockerBridgeCIDR checks that the docker bridge network doesn't overlap the pod CIDR or the service CIDR,
+// which defaults to the one AKS uses. CIDRs that don't parse are reported by the other network checks.
+func validateDockerBridgeCIDR(bridgeCIDR, podCIDR, serviceCIDR string) error {
+	_, bridgeNet, err := net.ParseCIDR(bridgeCIDR)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse docker bridge cidr")
+	}
+	if serviceCIDR == "" {
+		serviceCIDR = defaultServiceCIDR
+	}
+	for _, cidr := range []string{podCIDR, serviceCIDR} {
+		if cidr == "" {
+			continue
+		}
+		if _, other, err := net.ParseCIDR(cidr); err == nil && (bridgeNet.Contains(other.IP) || other.Contains(bridgeNet.IP)) {
+			return errors.Errorf("docker bridge cidr '%s' must not overlap '%s'", bridgeCIDR, cidr)
+		}
+	}
+	return nil
+}
+
+// validateNetworkPolicy checks the network policy works with the network plugin. Azure network policies
+// are enforced by Azure CNI, so need the azure plugin, while Calico works with either plugin.
+func validateNetworkPolicy(policy containerservice.NetworkPolicy, plugin containerservice.NetworkPlugin) error {
+	if policy == containerservice.NetworkPolicyAzure && !strings.EqualFold(string(plugin), string(containerservice.Azure)) {
+		return errors.Errorf("network policy '%s' is only supported with the '%s' network plugin, not '%s'. Use the '%s' network policy with '%s'",
+			policy, containerservice.Azure, plugin, containerservice.NetworkPolicyCalico, plugin)
+	}
+	return nil
+}
+
+// validateOutboundType checks the outbound type. User defined routing needs the Standard load balancer SKU
+// and existing subnets, whose route tables carry the egress traffic.
+func validateOutboundType(managedClusterSpec *Spec) error {
+	outboundType := *managedClusterSpec.OutboundType
+	switch {
+	case strings.EqualFold(outboundType, string(containerservice.LoadBalancer)):
+		return nil
+	case !strings.EqualFold(outboundType, string(containerservice.UserDefinedRouting)):
+		return errors.Errorf("invalid outbound type: '%s'. Allowed options are '%s' and '%s'", outboundType, containerservice.LoadBalancer, containerservice.UserDefinedRouting)
+	}
+
+	var errs []error
+	if sku := managedClusterSpec.LoadBalancerSKU; sku != nil && !strings.EqualFold(*sku, string(containerservice.Standard)) {
+		errs = append(errs, errors.Errorf("outbound type '%s' is only supported with the '%s' load balancer SKU, not '%s'", containerservice.UserDefinedRouting, containerservice.Standard, *sku))
+	}
+	for _, pool := range managedClusterSpec.AgentPools {
+		if pool.VnetSubnetID == "" {
+			errs = append(errs, errors.Errorf("invalid agent pool %s: outbound type '%s' requires an existing subnet with a route table", pool.Name, containerservice.UserDefinedRouting))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateLoadBalancerProfile checks the outbound settings of a load balancer profile.
+// Outbound settings are only supported by the Standard load balancer SKU.
+func validateLoadBalancerProfile(lb *LoadBalancerProfile, sku containerservice.LoadBalancerSku) error {
+	if !strings.EqualFold(string(sku), string(containerservice.Standard)) {
+		return errors.Errorf("load balancer profile is only supported with the '%s' load balancer SKU, not '%s'", containerservice.Standard, sku)
+	}
+	outboundSettings := 0
+	for _, set := range []bool{lb.ManagedOutboundIPCount != nil, len(lb.OutboundIPs) > 0, len(lb.OutboundIPPrefixes) > 0} {
+		if set {
+			outboundSettings++
+		}
+	}
+	if outboundSettings > 1 {
+		return errors.New("only one of managed outbound IP count, outbound IPs and outbound IP prefixes can be set")
+	}
+	if lb.ManagedOutboundIPCount != nil {
+		if count := *lb.ManagedOutboundIPCount; count < 1 || count > maxManagedOutboundIPCount {
+			return errors.Errorf("invalid managed outbound IP count %d: must be between 1 and %d", count, maxManagedOutboundIPCount)
+		}
+	}
+	for _, id := range lb.OutboundIPs {
+		if !publicIPIDRegex.MatchString(id) {
+			return errors.Errorf("invalid outbound IP '%s': expected a public IP address resource ID", id)
+		}
+	}
+	for _, id := range lb.OutboundIPPrefixes {
+		if !publicIPPrefixIDRegex.MatchString(id) {
+			return errors.Errorf("invalid outbound IP prefix '%s': expected a public IP prefix resource ID", id)
+		}
+	}
+	if lb.AllocatedOutboundPorts != nil {
+		if ports := *lb.AllocatedOutboundPorts; ports < 0 || ports > maxAllocatedOutboundPorts || ports%8 != 0 {
+			return errors.Errorf("invalid allocated outbound ports %d: must be a multiple of 8 between 0 and %d", ports, maxAllocatedOutboundPorts)
+		}
+	}
+	if lb.IdleTimeoutInMinutes != nil {
+		if timeout := *lb.IdleTimeoutInMinutes; timeout < minIdleTimeoutInMinutes || timeout > maxIdleTimeoutInMinutes {
+			return errors.Errorf("invalid idle timeout %d minutes: must be between %d and %d", timeout, minIdleTimeoutInMinutes, maxIdleTimeoutInMinutes)
+		}
+	}
+	return nil
+}
+
+// validateAuthorizedIPRanges checks that each authorized range is an IP address or CIDR, and that ranges
+// aren't set on a private cluster, whose API server has no public endpoint to restrict.
+func validateAuthorizedIPRanges(ranges []string, enablePrivateCluster *bool) error {
+	if len(ranges) > 0 && enablePrivateCluster != nil && *enablePrivateCluster {
+		return errors.New("API server authorized IP ranges are not supported with private clusters")
+	}
+	var errs []error
+	for _, r := range ranges {
+		if net.ParseIP(r) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			errs = append(errs, errors.Errorf("invalid API server authorized IP range '%s': must be an IP address or CIDR", r))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateAddonProfiles checks that every addon is named and that none is also set by a dedicated addon field.
+func validateAddonProfiles(managedClusterSpec *Spec) error {
+	dedicated := map[string]bool{
+		httpApplicationRoutingAddon: managedClusterSpec.EnableHTTPApplicationRouting != nil,
+		azurePolicyAddon:            managedClusterSpec.EnableAzurePolicy != nil,
+		ingressAppGatewayAddon:      managedClusterSpec.IngressAppGateway != nil,
+	}
+	names := make([]string, 0, len(managedClusterSpec.AddonProfiles))
+	for name := range managedClusterSpec.AddonProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		switch {
+		case name == "":
+			errs = append(errs, errors.New("invalid addon profile: name is required"))
+		case dedicated[name]:
+			errs = append(errs, errors.Errorf("invalid addon profile %s: the addon is already configured by its own field", name))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateIngressAppGateway checks that exactly one of an existing application gateway or a subnet CIDR is selected.
+func validateIngressAppGateway(appGateway *IngressAppGateway) error {
+	switch {
+	case appGateway.ApplicationGatewayID != "" && appGateway.SubnetCIDR != "":
+		return errors.New("invalid ingress application gateway: only one of application gateway ID and subnet CIDR can be set")
+	case appGateway.ApplicationGatewayID != "":
+		return nil
+	case appGateway.SubnetCIDR != "":
+		if _, _, err := net.ParseCIDR(appGateway.SubnetCIDR); err != nil {
+			return errors.Wrap(err, "failed to parse ingress application gateway subnet cidr")
+		}
+		return nil
+	default:
+		return errors.New("invalid ingress application gateway: one of application gateway ID and subnet CIDR must be set")
+	}
+}
+
+// validateLocation checks the requested region is available to the subscription,
+// suggesting the closest canonical names when it is not.
+func (s *Service) validateLocation(ctx context.Context, location string) error {
+	requested := normalizeLocation(location)
+	available, err := s.LocationsClient.List(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list available locations")
+	}
+
+	var suggestions []string
+	closest := maxLocationSuggestionDistance
+	for _, l := range available {
+		name := normalizeLocation(to.String(l.Name))
+		if name == requested {
+			return nil
+		}
+		switch distance := levenshtein(name, requested); {
+		case distance < closest:
+			closest = distance
+			suggestions = []string{name}
+		case distance == closest:
+			suggestions = append(suggestions, name)
+		}
+	}
+
+	if len(suggestions) > 0 {
+		return errors.Errorf("location %q is not available to this subscription, did you mean %s?", location, strings.Join(suggestions, ", "))
+	}
+	return errors.Errorf("location %q is not available to this subscription", location)
+}
+
+// validateSubnets fetches the existing subnets the agent pools join and checks that none overlaps the service CIDR.
+// With user defined routing they need a route table, and for private clusters they must be able to host the
+// API server's private endpoint.
+func (s *Service) validateSubnets(ctx context.Context, managedClusterSpec *Spec) error {
+	serviceCIDR := managedClusterSpec.ServiceCIDR
+	if serviceCIDR == "" {
+		serviceCIDR = defaultServiceCIDR
+	}
+	_, serviceNet, err := net.ParseCIDR(serviceCIDR)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse service cidr")
+	}
+	private := managedClusterSpec.EnablePrivateCluster != nil && *managedClusterSpec.EnablePrivateCluster
+	userDefinedRouting := managedClusterSpec.OutboundType != nil &&
+		strings.EqualFold(*managedClusterSpec.OutboundType, string(containerservice.UserDefinedRouting))
+
+	checked := map[string]bool{}
+	for _, pool := range managedClusterSpec.AgentPools {
+		if pool.VnetSubnetID == "" || checked[pool.VnetSubnetID] {
+			continue
+		}
+		checked[pool.VnetSubnetID] = true
+
+		group, vnet, name, err := parseSubnetID(pool.VnetSubnetID)
+		if err != nil {
+			return errors.Wrapf(err, "invalid agent pool %s", pool.Name)
+		}
+		subnet, err := s.SubnetsClient.Get(ctx, group, vnet, name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get subnet %s", pool.VnetSubnetID)
+		}
+		if err := validateSubnetServiceCIDR(subnet, pool.VnetSubnetID, serviceNet); err != nil {
+			return err
+		}
+		if userDefinedRouting && (subnet.SubnetPropertiesFormat == nil || subnet.RouteTable == nil) {
+			return errors.Errorf("subnet %s has no route table, which outbound type '%s' requires", pool.VnetSubnetID, containerservice.UserDefinedRouting)
+		}
+		if private && (subnet.SubnetPropertiesFormat == nil || subnet.PrivateEndpointNetworkPolicies == nil ||
+			!strings.EqualFold(*subnet.PrivateEndpointNetworkPolicies, privateEndpointNetworkPoliciesDisabled)) {
+			return errors.Errorf("subnet %s cannot host the private cluster API server endpoint: "+
+				"set privateEndpointNetworkPolicies to '%s' on the subnet", pool.VnetSubnetID, privateEndpointNetworkPoliciesDisabled)
+		}
+	}
+	return nil
+}
+
+// validateSubnetServiceCIDR checks that none of a subnet's address prefixes overlaps the service CIDR,
+// since AKS routes service addresses inside the cluster and nodes could not reach those addresses in their subnet.
+func validateSubnetServiceCIDR(subnet network.Subnet, id string, serviceNet *net.IPNet) error {
+	if subnet.SubnetPropertiesFormat == nil {
+		return nil
+	}
+	var prefixes []string
+	if subnet.AddressPrefix != nil {
+		prefixes = append(prefixes, *subnet.AddressPrefix)
+	}
+	if subnet.AddressPrefixes != nil {
+		prefixes = append(prefixes, *subnet.AddressPrefixes...)
+	}
+	for _, prefix := range prefixes {
+		_, subnetNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse address prefix of subnet %s", id)
+		}
+		if subnetNet.Contains(serviceNet.IP) || serviceNet.Contains(subnetNet.IP) {
+			return errors.Errorf("service cidr '%s' must not overlap address prefix '%s' of subnet %s", serviceNet, prefix, id)
+		}
+	}
+	return nil
+}
+
+// ValidatePoolSKUs checks the VM size of every agent pool is offered to the subscription in the
+// location, so an unavailable size fails naming the pool rather than deep in ARM.
+func (s *Service) ValidatePoolSKUs(ctx context.Context, location string, pools []PoolSpec) error {
+	filter := fmt.Sprintf("location eq '%s'", normalizeLocation(location))
+
+	// Prefer ListComplete() over List() to automatically traverse pages via iterator.
+	res, err := s.ResourceSkusClient.ListComplete(ctx, filter)
+	if err != nil {
+		return errors.Wrap(err, "failed to list available VM sizes")
+	}
+
+	var skus []compute.ResourceSku
+	for res.NotDone() {
+		skus = append(skus, res.Value())
+		if err := res.NextWithContext(ctx); err != nil {
+			return errors.Wrap(err, "could not iterate VM sizes")
+		}
+	}
+	return validatePoolSKUs(location, pools, skus)
+}
+
+// poolsWithNewSKUs returns the pools whose VM size the existing cluster doesn't already run them with.
+// Every pool is returned when the cluster is created.
+func poolsWithNewSKUs(pools []PoolSpec, existing containerservice.ManagedCluster, isCreate bool) []PoolSpec {
+	if isCreate {
+		return pools
+	}
+	var profiles []containerservice.ManagedClusterAgentPoolProfile
+	if existing.ManagedClusterProperties != nil && existing.AgentPoolProfiles != nil {
+		profiles = *existing.AgentPoolProfiles
+	}
+	var changed []PoolSpec
+	for _, pool := range pools {
+		if pool.SKU == "" {
+			continue
+		}
+		profile, ok := findAgentPoolProfile(profiles, pool.Name)
+		if !ok || !strings.EqualFold(string(profile.VMSize), pool.SKU) {
+			changed = append(changed, pool)
+		}
+	}
+	return changed
+}
+
+// validatePoolSKUs returns an error naming each pool whose VM size is not among the unrestricted
+// virtual machine SKUs. Pools without a size are left for AKS to default.
+func validatePoolSKUs(location string, pools []PoolSpec, skus []compute.ResourceSku) error {
+	available := make(map[string]bool)
+	for _, sku := range skus {
+		if !strings.EqualFold(to.String(sku.ResourceType), virtualMachinesResourceType) || locationRestricted(sku) {
+			continue
+		}
+		available[strings.ToLower(to.String(sku.Name))] = true
+	}
+
+	var unavailable []string
+	for _, pool := range pools {
+		if pool.SKU == "" || available[strings.ToLower(pool.SKU)] {
+			continue
+		}
+		unavailable = append(unavailable, fmt.Sprintf("agent pool %s uses VM size %s", pool.Name, pool.SKU))
+	}
+	if len(unavailable) > 0 {
+		return errors.Errorf("%s, which is not available in location %q", strings.Join(unavailable, "; "), location)
+	}
+	return nil
+}
+
+// locationRestricted reports whether the subscription can't deploy the SKU anywhere in the location.
+func locationRestricted(sku compute.ResourceSku) bool {
+	if sku.Restrictions == nil {
+		return false
+	}
+	for _, restriction := range *sku.Restrictions {
+		if restriction.Type == compute.Location {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MaxDNSPrefixLength is the longest DNS prefix AKS accepts.
+const MaxDNSPrefixLength = 54
+
+var (
+	// invalidDNSPrefixCharacters matches the characters AKS does not accept in a DNS prefix.
+	invalidDNSPrefixCharacters = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+	// dnsPrefixRegex matches a DNS prefix that starts and ends with a letter or digit.
+	dnsPrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+)
+
+// DefaultDNSPrefix derives a DNS prefix from a managed cluster name, by removing the characters AKS does not
+// accept, truncating it to MaxDNSPrefixLength and trimming leading and trailing hyphens.
+func DefaultDNSPrefix(name string) string {
+	prefix := invalidDNSPrefixCharacters.ReplaceAllString(name, "")
+	if len(prefix) > MaxDNSPrefixLength {
+		prefix = prefix[:MaxDNSPrefixLength]
+	}
+	return strings.Trim(prefix, "-")
+}
+
+// IsValidDNSPrefix reports whether AKS accepts prefix as the DNS prefix of a managed cluster.
+func IsValidDNSPrefix(prefix string) bool {
+	return len(prefix) <= MaxDNSPrefixLength && dnsPrefixRegex.MatchString(prefix)
+}
@@ -22,6 +22,12 @@ import (
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
 )
 
+const (
+	// RotateCertificatesAnnotation asks the controller to rotate the certificates of the AKS cluster. The rotation
+	// restarts every node and can take up to 30 minutes. The annotation is removed once the rotation completes.
+	RotateCertificatesAnnotation = "exp.infrastructure.cluster.x-k8s.io/rotate-certificates"
+)
+
 // AzureManagedControlPlaneSpec defines the desired state of AzureManagedControlPlane
 type AzureManagedControlPlaneSpec struct {
 	// Version defines the desired Kubernetes version.
@@ -38,6 +44,11 @@ type AzureManagedControlPlaneSpec struct {
 	// Location is a string matching one of the canonical Azure region names. Examples: "westus2", "eastus".
 	Location string `json:"location"`
 
+	// DNSPrefix is the DNS prefix of the API server's FQDN. Defaults to the control plane name, without the
+	// characters AKS doesn't accept, when the control plane is created. It can't be changed after the cluster is created.
+	// +optional
+	DNSPrefix *string `json:"dnsPrefix,omitempty"`
+
 	// ControlPlaneEndpoint represents the endpoint used to communicate with the control plane.
 	// +optional
 	ControlPlaneEndpoint clusterv1.APIEndpoint `json:"controlPlaneEndpoint"`
@@ -51,6 +62,11 @@ type AzureManagedControlPlaneSpec struct {
 	// +kubebuilder:validation:Enum=Standard;Basic
 	LoadBalancerSKU *string `json:"loadBalancerSku,omitempty"`
 
+	// LoadBalancerProfile tunes the outbound connectivity of the Standard load balancer, for example to avoid SNAT
+	// port exhaustion. Defaults to a single managed outbound IP with ports allocated by AKS.
+	// +optional
+	LoadBalancerProfile *LoadBalancerProfile `json:"loadBalancerProfile,omitempty"`
+
 	// NetworkPlugin used for building Kubernetes network. Possible values include: 'Azure', 'Kubenet'. Defaults to Azure.
 	// +kubebuilder:validation:Enum=Azure;Kubenet
 	NetworkPlugin *string `json:"networkPlugin,omitempty"`
@@ -59,14 +75,138 @@ type AzureManagedControlPlaneSpec struct {
 	// +kubebuilder:validation:Enum=Calico;Azure
 	NetworkPolicy *string `json:"networkPolicy,omitempty"`
 
-	// SSHPublicKey is a string literal containing an ssh public key.
+	// DNSServiceIP is the IP address of the cluster DNS service. It must be a host address of the Cluster's service
+	// CIDR, and defaults to its .10 address. It can't be changed after the cluster is created.
+	// +optional
+	DNSServiceIP *string `json:"dnsServiceIP,omitempty"`
+
+	// DockerBridgeCidr is the address and prefix of the docker bridge on each node, for example 172.17.0.1/16.
+	// It must not overlap the pod and service CIDRs or the node subnets. It can't be changed after the cluster is created.
+	// +optional
+	DockerBridgeCidr *string `json:"dockerBridgeCidr,omitempty"`
+
+	// OutboundType is how the cluster's egress traffic leaves the virtual network. Possible values include: 'loadBalancer',
+	// 'userDefinedRouting'. Defaults to loadBalancer. userDefinedRouting requires every pool to join an existing subnet
+	// with a route table, for example one sending egress to an Azure Firewall.
+	// +kubebuilder:validation:Enum=loadBalancer;userDefinedRouting
+	// +optional
+	OutboundType *string `json:"outboundType,omitempty"`
+
+	// SSHPublicKey is a string literal containing an ssh public key base64 encoded.
 	SSHPublicKey string `json:"sshPublicKey"`
 
+	// WindowsProfile is the administrator account created on Windows nodes. It is required to add Windows
+	// node pools and can't be added to an existing cluster without one.
+	// +optional
+	WindowsProfile *WindowsProfile `json:"windowsProfile,omitempty"`
+
+	// VnetSubnetID is the resource ID of an existing subnet the cluster's nodes join when their machine pool
+	// doesn't set one. AKS requires either every pool or none to use an existing subnet.
+	// +optional
+	VnetSubnetID string `json:"vnetSubnetID,omitempty"`
+
+	// EnablePrivateCluster exposes the API server through a private endpoint in the node subnet instead of a public FQDN.
+	// The control plane endpoint is then the private FQDN, which is only reachable from within the virtual network.
+	// +optional
+	EnablePrivateCluster *bool `json:"enablePrivateCluster,omitempty"`
+
+	// APIServerAccessProfile restricts which addresses can reach the API server.
+	// +optional
+	APIServerAccessProfile *APIServerAccessProfile `json:"apiServerAccessProfile,omitempty"`
+
+	// AddonProfiles are the addons deployed to the cluster. Addons removed from the list are disabled, while
+	// addons the list never contained are left unchanged.
+	// +optional
+	AddonProfiles []AddonProfile `json:"addonProfiles,omitempty"`
+
+	// DiagnosticsProfile streams the cluster's control plane logs to Azure Monitor. Removing it stops the streaming.
+	// +optional
+	DiagnosticsProfile *DiagnosticsProfile `json:"diagnosticsProfile,omitempty"`
+
 	// DefaultPoolRef is the specification for the default pool, without which an AKS cluster cannot be created.
 	// TODO(ace): consider defaulting and making optional pointer?
 	DefaultPoolRef corev1.LocalObjectReference `json:"defaultPoolRef"`
 }
 
+// AddonProfile enables or disables an AKS addon.
+type AddonProfile struct {
+	// Name is the name of the addon, for example "omsagent", "azurepolicy" or "ingressApplicationGateway".
+	Name string `json:"name"`
+
+	// Enabled deploys the addon when true and removes it when false.
+	Enabled bool `json:"enabled"`
+
+	// Config is the addon specific configuration, for example the logAnalyticsWorkspaceResourceID of omsagent.
+	// +optional
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// DiagnosticsProfile contains the destinations and categories of a managed cluster's control plane logs.
+// At least one of WorkspaceID and StorageAccountID is required.
+type DiagnosticsProfile struct {
+	// WorkspaceID is the resource ID of a Log Analytics workspace the logs are sent to.
+	// +optional
+	WorkspaceID string `json:"workspaceID,omitempty"`
+
+	// StorageAccountID is the resource ID of a storage account the logs are archived to.
+	// +optional
+	StorageAccountID string `json:"storageAccountID,omitempty"`
+
+	// Logs are the log categories to stream, for example "kube-apiserver", "kube-audit", "kube-controller-manager",
+	// "kube-scheduler" or "cluster-autoscaler". Defaults to kube-apiserver, kube-audit and kube-controller-manager.
+	// +optional
+	Logs []string `json:"logs,omitempty"`
+}
+
+// APIServerAccessProfile contains the access settings of a managed cluster's API server.
+type APIServerAccessProfile struct {
+	// AuthorizedIPRanges are the IP addresses and CIDRs allowed to reach the API server.
+	// An empty list removes every restriction. It can't be used with private clusters.
+	// +optional
+	AuthorizedIPRanges []string `json:"authorizedIPRanges,omitempty"`
+}
+
+// WindowsProfile contains the administrator account of a managed cluster's Windows nodes.
+type WindowsProfile struct {
+	// AdminUsername is the name of the administrator account.
+	AdminUsername string `json:"adminUsername"`
+
+	// AdminPasswordSecretRef selects the key of a secret, in the control plane's namespace, holding the
+	// administrator password.
+	AdminPasswordSecretRef corev1.SecretKeySelector `json:"adminPasswordSecretRef"`
+}
+
+// LoadBalancerProfile contains the outbound settings of a managed cluster's load balancer.
+// At most one of ManagedOutboundIPCount, OutboundIPs and OutboundIPPrefixes can be set.
+type LoadBalancerProfile struct {
+	// ManagedOutboundIPCount is the number of outbound public IPs AKS creates for the load balancer.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	ManagedOutboundIPCount *int32 `json:"managedOutboundIPCount,omitempty"`
+
+	// OutboundIPs are the resource IDs of existing public IPs used for outbound traffic.
+	// +optional
+	OutboundIPs []string `json:"outboundIPs,omitempty"`
+
+	// OutboundIPPrefixes are the resource IDs of existing public IP prefixes used for outbound traffic.
+	// +optional
+	OutboundIPPrefixes []string `json:"outboundIPPrefixes,omitempty"`
+
+	// AllocatedOutboundPorts is the number of SNAT ports allocated to each node, a multiple of 8.
+	// 0 lets Azure allocate ports based on the size of the backend pool.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=64000
+	// +optional
+	AllocatedOutboundPorts *int32 `json:"allocatedOutboundPorts,omitempty"`
+
+	// IdleTimeoutInMinutes is how long an idle outbound flow is kept open. Defaults to 30 minutes.
+	// +kubebuilder:validation:Minimum=4
+	// +kubebuilder:validation:Maximum=120
+	// +optional
+	IdleTimeoutInMinutes *int32 `json:"idleTimeoutInMinutes,omitempty"`
+}
+
 // AzureManagedControlPlaneStatus defines the observed state of AzureManagedControlPlane
 type AzureManagedControlPlaneStatus struct {
 	// Ready is true when the provider resource is ready.
@@ -78,6 +218,35 @@ type AzureManagedControlPlaneStatus struct {
 	// In the AzureManagedControlPlane implementation, these are identical.
 	// +optional
 	Initialized bool `json:"initialized,omitempty"`
+
+	// Version is the Kubernetes version the AKS cluster is running. It can differ from the spec while an
+	// upgrade is in progress or after the cluster was upgraded outside of Cluster API.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// LongRunningOperation is the create, update or certificate rotation of the AKS cluster still in progress, if
+	// any. The controller polls it on later reconciles instead of waiting for it.
+	// +optional
+	LongRunningOperation *Future `json:"longRunningOperation,omitempty"`
+
+	// ManagedAddons are the names of the addons the spec set when the AKS cluster was last updated. Addons later
+	// removed from the spec are disabled, while addons enabled outside of Cluster API are left alone.
+	// +optional
+	ManagedAddons []string `json:"managedAddons,omitempty"`
+
+	// DiagnosticSettingName is the name of the diagnostic setting created for the diagnostics profile, if any.
+	// The setting is deleted once the profile is removed from the spec.
+	// +optional
+	DiagnosticSettingName string `json:"diagnosticSettingName,omitempty"`
+}
+
+// Future is a long running Azure operation started by the controller.
+type Future struct {
+	// Type is the kind of operation, for example "createOrUpdate".
+	Type string `json:"type"`
+
+	// Data is the serialized state of the Azure SDK future, including the URL the operation is polled on.
+	Data string `json:"data"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,244 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/blang/semver"
+	"golang.org/x/crypto/ssh"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+const (
+	// defaultLoadBalancerSKU and defaultNetworkPlugin are the values AKS uses when none are given.
+	defaultLoadBalancerSKU = "Standard"
+	defaultNetworkPlugin   = "Azure"
+)
+
+var (
+	// log is for logging in this package.
+	azuremanagedcontrolplanelog = logf.Log.WithName("azuremanagedcontrolplane-resource")
+
+	// subnetIDRegex matches the resource ID of a virtual network subnet.
+	subnetIDRegex = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/virtualNetworks/[^/]+/subnets/[^/]+$`)
+)
+
+func (m *AzureManagedControlPlane) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(m).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/mutate-exp-infrastructure-cluster-x-k8s-io-v1alpha3-azuremanagedcontrolplane,mutating=true,failurePolicy=fail,matchPolicy=Equivalent,groups=exp.infrastructure.cluster.x-k8s.io,resources=azuremanagedcontrolplanes,versions=v1alpha3,name=default.azuremanagedcontrolplane.exp.infrastructure.cluster.x-k8s.io,sideEffects=None
+
+var _ webhook.Defaulter = &AzureManagedControlPlane{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (m *AzureManagedControlPlane) Default() {
+	azuremanagedcontrolplanelog.Info("default", "name", m.Name)
+
+	if m.Spec.LoadBalancerSKU == nil {
+		sku := defaultLoadBalancerSKU
+		m.Spec.LoadBalancerSKU = &sku
+	}
+
+	if m.Spec.NetworkPlugin == nil {
+		plugin := defaultNetworkPlugin
+		m.Spec.NetworkPlugin = &plugin
+	}
+
+	// The DNS prefix is only defaulted on create. Clusters created before the default existed keep the prefix
+	// AKS already has, which the controller reads from the cluster.
+	if m.Spec.DNSPrefix == nil && m.ResourceVersion == "" {
+		prefix := DefaultDNSPrefix(m.Name)
+		m.Spec.DNSPrefix = &prefix
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-exp-infrastructure-cluster-x-k8s-io-v1alpha3-azuremanagedcontrolplane,mutating=false,failurePolicy=fail,matchPolicy=Equivalent,groups=exp.infrastructure.cluster.x-k8s.io,resources=azuremanagedcontrolplanes,versions=v1alpha3,name=validation.azuremanagedcontrolplane.exp.infrastructure.cluster.x-k8s.io,sideEffects=None
+
+var _ webhook.Validator = &AzureManagedControlPlane{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedControlPlane) ValidateCreate() error {
+	azuremanagedcontrolplanelog.Info("validate create", "name", m.Name)
+	allErrs := m.validate()
+	if err := m.validateSSHPublicKey(); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	return m.toAggregate(allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedControlPlane) ValidateUpdate(oldRaw runtime.Object) error {
+	azuremanagedcontrolplanelog.Info("validate update", "name", m.Name)
+	// Objects created before a default was added don't have it, so compare against the defaulted old object.
+	old := oldRaw.(*AzureManagedControlPlane).DeepCopy()
+	old.Default()
+	allErrs := m.validate()
+
+	// Keys accepted before the check was added aren't rejected until they are changed.
+	if m.Spec.SSHPublicKey != old.Spec.SSHPublicKey {
+		if err := m.validateSSHPublicKey(); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	immutable := []struct {
+		path     string
+		old, new interface{}
+	}{
+		{path: "location", old: old.Spec.Location, new: m.Spec.Location},
+		{path: "resourceGroup", old: old.Spec.ResourceGroup, new: m.Spec.ResourceGroup},
+		{path: "dnsPrefix", old: old.Spec.DNSPrefix, new: m.Spec.DNSPrefix},
+		{path: "loadBalancerSku", old: old.Spec.LoadBalancerSKU, new: m.Spec.LoadBalancerSKU},
+		{path: "networkPlugin", old: old.Spec.NetworkPlugin, new: m.Spec.NetworkPlugin},
+		{path: "networkPolicy", old: old.Spec.NetworkPolicy, new: m.Spec.NetworkPolicy},
+		{path: "dnsServiceIP", old: old.Spec.DNSServiceIP, new: m.Spec.DNSServiceIP},
+		{path: "dockerBridgeCidr", old: old.Spec.DockerBridgeCidr, new: m.Spec.DockerBridgeCidr},
+		{path: "vnetSubnetID", old: old.Spec.VnetSubnetID, new: m.Spec.VnetSubnetID},
+		{path: "enablePrivateCluster", old: isTrue(old.Spec.EnablePrivateCluster), new: isTrue(m.Spec.EnablePrivateCluster)},
+	}
+	for _, f := range immutable {
+		if !reflect.DeepEqual(f.old, f.new) {
+			allErrs = append(allErrs, fieldImmutable(f.path, f.new))
+		}
+	}
+
+	// The subscription is only immutable once set, since it otherwise comes from the controller's credentials.
+	if old.Spec.SubscriptionID != "" && m.Spec.SubscriptionID != old.Spec.SubscriptionID {
+		allErrs = append(allErrs, fieldImmutable("subscriptionID", m.Spec.SubscriptionID))
+	}
+
+	if oldVersion, err := parseVersion(old.Spec.Version); err == nil {
+		if version, err := parseVersion(m.Spec.Version); err == nil && version.LT(oldVersion) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "version"), m.Spec.Version,
+				fmt.Sprintf("can't downgrade from %s, AKS only supports upgrades", old.Spec.Version)))
+		}
+	}
+
+	return m.toAggregate(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedControlPlane) ValidateDelete() error {
+	azuremanagedcontrolplanelog.Info("validate delete", "name", m.Name)
+	return nil
+}
+
+// validate checks the values AKS would otherwise only reject once the cluster is created or updated.
+func (m *AzureManagedControlPlane) validate() field.ErrorList {
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if _, err := parseVersion(m.Spec.Version); err != nil {
+		allErrs = append(allErrs, field.Invalid(spec.Child("version"), m.Spec.Version, "must be a semantic version such as 1.17.7"))
+	}
+
+	if prefix := m.Spec.DNSPrefix; prefix != nil && !IsValidDNSPrefix(*prefix) {
+		allErrs = append(allErrs, field.Invalid(spec.Child("dnsPrefix"), *prefix,
+			fmt.Sprintf("must be at most %d letters, digits and hyphens, and start and end with a letter or digit", MaxDNSPrefixLength)))
+	}
+
+	if m.Spec.VnetSubnetID != "" && !subnetIDRegex.MatchString(m.Spec.VnetSubnetID) {
+		allErrs = append(allErrs, field.Invalid(spec.Child("vnetSubnetID"), m.Spec.VnetSubnetID, "must be the resource ID of a virtual network subnet"))
+	}
+
+	if policy := m.Spec.NetworkPolicy; policy != nil && strings.EqualFold(*policy, "Azure") &&
+		m.Spec.NetworkPlugin != nil && !strings.EqualFold(*m.Spec.NetworkPlugin, "Azure") {
+		allErrs = append(allErrs, field.Invalid(spec.Child("networkPolicy"), *policy, "the Azure network policy requires the Azure network plugin"))
+	}
+
+	// Whether the DNS service IP is within the service CIDR is checked by the controller, which reads the CIDR from the Cluster.
+	if ip := m.Spec.DNSServiceIP; ip != nil && net.ParseIP(*ip).To4() == nil {
+		allErrs = append(allErrs, field.Invalid(spec.Child("dnsServiceIP"), *ip, "must be an IPv4 address"))
+	}
+
+	if cidr := m.Spec.DockerBridgeCidr; cidr != nil {
+		if _, _, err := net.ParseCIDR(*cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(spec.Child("dockerBridgeCidr"), *cidr, "must be a CIDR such as 172.17.0.1/16"))
+		}
+	}
+
+	if sku := m.Spec.LoadBalancerSKU; sku != nil && strings.EqualFold(*sku, "Basic") {
+		if m.Spec.LoadBalancerProfile != nil {
+			allErrs = append(allErrs, field.Invalid(spec.Child("loadBalancerProfile"), m.Spec.LoadBalancerProfile, "requires the Standard load balancer SKU"))
+		}
+		if outboundType := m.Spec.OutboundType; outboundType != nil && *outboundType == "userDefinedRouting" {
+			allErrs = append(allErrs, field.Invalid(spec.Child("outboundType"), *outboundType, "requires the Standard load balancer SKU"))
+		}
+	}
+
+	if profile := m.Spec.APIServerAccessProfile; profile != nil {
+		path := spec.Child("apiServerAccessProfile", "authorizedIPRanges")
+		if len(profile.AuthorizedIPRanges) > 0 && isTrue(m.Spec.EnablePrivateCluster) {
+			allErrs = append(allErrs, field.Invalid(path, profile.AuthorizedIPRanges, "can't be used with a private cluster"))
+		}
+		for i, ipRange := range profile.AuthorizedIPRanges {
+			if _, _, err := net.ParseCIDR(ipRange); err != nil && net.ParseIP(ipRange) == nil {
+				allErrs = append(allErrs, field.Invalid(path.Index(i), ipRange, "must be an IP address or CIDR"))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateSSHPublicKey checks the SSH public key is a base64 encoded key in authorized_keys format, which is how
+// the controller passes it to AKS.
+func (m *AzureManagedControlPlane) validateSSHPublicKey() *field.Error {
+	decoded, err := base64.StdEncoding.DecodeString(m.Spec.SSHPublicKey)
+	if err == nil {
+		_, _, _, _, err = ssh.ParseAuthorizedKey(decoded)
+	}
+	if err != nil {
+		return field.Invalid(field.NewPath("spec", "sshPublicKey"), m.Spec.SSHPublicKey, "must be a base64 encoded SSH public key in authorized_keys format")
+	}
+	return nil
+}
+
+func (m *AzureManagedControlPlane) toAggregate(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AzureManagedControlPlane").GroupKind(), m.Name, allErrs)
+}
+
+// fieldImmutable reports a change to a spec field AKS doesn't allow to change.
+func fieldImmutable(path string, value interface{}) *field.Error {
+	return field.Invalid(field.NewPath("spec", path), value, "field is immutable")
+}
+
+// parseVersion parses a Kubernetes version, with or without the leading "v".
+func parseVersion(version string) (semver.Version, error) {
+	return semver.Parse(strings.TrimPrefix(version, "v"))
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
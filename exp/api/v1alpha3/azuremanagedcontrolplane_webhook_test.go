@@ -0,0 +1,270 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/onsi/gomega"
+
+	exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
+)
+
+const (
+	// rawSSHPublicKey is an SSH public key in authorized_keys format, and sshPublicKey its base64 encoding.
+	rawSSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"
+	sshPublicKey    = "c3NoLWVkMjU1MTkgQUFBQUMzTnphQzFsWkRJMU5URTVBQUFBSUFBQkFnTUVCUVlIQ0FrS0N3d05EZzhRRVJJVEZCVVdGeGdaR2hzY0hSNGY="
+)
+
+func controlPlane(mutate func(*exp.AzureManagedControlPlaneSpec)) *exp.AzureManagedControlPlane {
+	m := &exp.AzureManagedControlPlane{
+		Spec: exp.AzureManagedControlPlaneSpec{
+			Version:       "1.17.7",
+			ResourceGroup: "my-rg",
+			Location:      "westus2",
+			SSHPublicKey:  sshPublicKey,
+		},
+	}
+	m.Name = "my.cluster-"
+	if mutate != nil {
+		mutate(&m.Spec)
+	}
+	return m
+}
+
+func TestAzureManagedControlPlane_Default(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	m := controlPlane(nil)
+	m.Default()
+	g.Expect(*m.Spec.LoadBalancerSKU).To(gomega.Equal("Standard"))
+	g.Expect(*m.Spec.NetworkPlugin).To(gomega.Equal("Azure"))
+	g.Expect(*m.Spec.DNSPrefix).To(gomega.Equal("mycluster"))
+
+	kubenet, prefix := "Kubenet", "my-prefix"
+	m = controlPlane(func(spec *exp.AzureManagedControlPlaneSpec) {
+		spec.NetworkPlugin = &kubenet
+		spec.DNSPrefix = &prefix
+	})
+	m.Default()
+	g.Expect(*m.Spec.NetworkPlugin).To(gomega.Equal(kubenet))
+	g.Expect(*m.Spec.DNSPrefix).To(gomega.Equal(prefix))
+
+	// An existing control plane keeps the DNS prefix its cluster was created with.
+	m = controlPlane(nil)
+	m.ResourceVersion = "1"
+	m.Default()
+	g.Expect(m.Spec.DNSPrefix).To(gomega.BeNil())
+}
+
+func TestAzureManagedControlPlane_ValidateCreate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	enabled := true
+
+	cases := []struct {
+		Name    string
+		Mutate  func(*exp.AzureManagedControlPlaneSpec)
+		WantErr string
+	}{
+		{
+			Name: "Valid",
+		},
+		{
+			Name:    "InvalidVersion",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.Version = "1.17" },
+			WantErr: "spec.version",
+		},
+		{
+			Name:    "InvalidSSHPublicKey",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.SSHPublicKey = "not a key" },
+			WantErr: "spec.sshPublicKey",
+		},
+		{
+			Name:    "SSHPublicKeyNotBase64Encoded",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.SSHPublicKey = rawSSHPublicKey },
+			WantErr: "spec.sshPublicKey",
+		},
+		{
+			Name:    "InvalidDNSPrefix",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.DNSPrefix = str("-my-prefix") },
+			WantErr: "spec.dnsPrefix",
+		},
+		{
+			Name:    "InvalidVnetSubnetID",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.VnetSubnetID = "my-subnet" },
+			WantErr: "spec.vnetSubnetID",
+		},
+		{
+			Name: "AzureNetworkPolicyWithKubenet",
+			Mutate: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.NetworkPlugin = str("Kubenet")
+				spec.NetworkPolicy = str("Azure")
+			},
+			WantErr: "spec.networkPolicy",
+		},
+		{
+			Name:    "InvalidDNSServiceIP",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.DNSServiceIP = str("10.0.0") },
+			WantErr: "spec.dnsServiceIP",
+		},
+		{
+			Name:    "InvalidDockerBridgeCidr",
+			Mutate:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.DockerBridgeCidr = str("172.17.0.1") },
+			WantErr: "spec.dockerBridgeCidr",
+		},
+		{
+			Name: "LoadBalancerProfileWithBasicSKU",
+			Mutate: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.LoadBalancerSKU = str("Basic")
+				spec.LoadBalancerProfile = &exp.LoadBalancerProfile{}
+			},
+			WantErr: "spec.loadBalancerProfile",
+		},
+		{
+			Name: "InvalidAuthorizedIPRange",
+			Mutate: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.APIServerAccessProfile = &exp.APIServerAccessProfile{AuthorizedIPRanges: []string{"10.0.0.0/8", "10.0.0.0/33"}}
+			},
+			WantErr: "spec.apiServerAccessProfile.authorizedIPRanges[1]",
+		},
+		{
+			Name: "AuthorizedIPRangesOnPrivateCluster",
+			Mutate: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.EnablePrivateCluster = &enabled
+				spec.APIServerAccessProfile = &exp.APIServerAccessProfile{AuthorizedIPRanges: []string{"10.0.0.0/8"}}
+			},
+			WantErr: "spec.apiServerAccessProfile.authorizedIPRanges",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			m := controlPlane(c.Mutate)
+			m.Default()
+			err := m.ValidateCreate()
+			if c.WantErr != "" {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(err.Error()).To(gomega.ContainSubstring(c.WantErr))
+			} else {
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestAzureManagedControlPlane_ValidateUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	cases := []struct {
+		Name    string
+		Old     func(*exp.AzureManagedControlPlaneSpec)
+		New     func(*exp.AzureManagedControlPlaneSpec)
+		WantErr string
+	}{
+		{
+			Name: "Unchanged",
+		},
+		{
+			Name: "Upgrade",
+			New:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.Version = "1.18.4" },
+		},
+		{
+			Name:    "Downgrade",
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.Version = "1.16.10" },
+			WantErr: "spec.version",
+		},
+		{
+			Name:    "LocationChanged",
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.Location = "eastus" },
+			WantErr: "spec.location",
+		},
+		{
+			Name: "VnetSubnetIDAdded",
+			New: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.VnetSubnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+			},
+			WantErr: "spec.vnetSubnetID",
+		},
+		{
+			Name:    "NetworkPluginChanged",
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.NetworkPlugin = str("Kubenet") },
+			WantErr: "spec.networkPlugin",
+		},
+		{
+			Name:    "DNSServiceIPChanged",
+			Old:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.DNSServiceIP = str("10.0.0.10") },
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.DNSServiceIP = str("10.0.0.53") },
+			WantErr: "spec.dnsServiceIP",
+		},
+		{
+			Name:    "DNSPrefixSet",
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.DNSPrefix = str("my-prefix") },
+			WantErr: "spec.dnsPrefix",
+		},
+		{
+			// Keys accepted before they were validated are only checked once changed.
+			Name: "UnchangedInvalidSSHPublicKey",
+			Old:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.SSHPublicKey = rawSSHPublicKey },
+		},
+		{
+			Name:    "SSHPublicKeyChangedToInvalid",
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.SSHPublicKey = rawSSHPublicKey },
+			WantErr: "spec.sshPublicKey",
+		},
+		{
+			Name: "SSHPublicKeyChanged",
+			New: func(spec *exp.AzureManagedControlPlaneSpec) {
+				spec.SSHPublicKey = base64.StdEncoding.EncodeToString([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIB8eHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgEA"))
+			},
+		},
+		{
+			Name: "SubscriptionIDSet",
+			New:  func(spec *exp.AzureManagedControlPlaneSpec) { spec.SubscriptionID = "123" },
+		},
+		{
+			Name:    "SubscriptionIDChanged",
+			Old:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.SubscriptionID = "123" },
+			New:     func(spec *exp.AzureManagedControlPlaneSpec) { spec.SubscriptionID = "456" },
+			WantErr: "spec.subscriptionID",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			// The old object was created before defaulting, the new one went through the defaulting webhook.
+			old := controlPlane(c.Old)
+			old.ResourceVersion = "1"
+			m := controlPlane(c.Old)
+			m.ResourceVersion = "1"
+			if c.New != nil {
+				c.New(&m.Spec)
+			}
+			m.Default()
+			err := m.ValidateUpdate(old)
+			if c.WantErr != "" {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(err.Error()).To(gomega.ContainSubstring(c.WantErr))
+			} else {
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+	}
+}
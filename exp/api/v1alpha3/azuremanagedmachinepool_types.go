@@ -30,6 +30,54 @@ type AzureManagedMachinePoolSpec struct {
 	// If you specify 0, it will apply the default osDisk size according to the vmSize specified.
 	OSDiskSizeGB *int32 `json:"osDiskSizeGB,omitempty"`
 
+	// OSType is the operating system of the pool's nodes. Windows pool names are limited to 6 characters.
+	// Defaults to Linux.
+	// +kubebuilder:validation:Enum=Linux;Windows
+	// +optional
+	OSType *string `json:"osType,omitempty"`
+
+	// EnableAutoScaling lets the AKS cluster autoscaler manage the pool's node count between MinCount and MaxCount.
+	// The machine pool's replicas are then only the initial node count.
+	// +optional
+	EnableAutoScaling *bool `json:"enableAutoScaling,omitempty"`
+
+	// MinCount is the minimum node count of an autoscaled pool.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinCount *int32 `json:"minCount,omitempty"`
+
+	// MaxCount is the maximum node count of an autoscaled pool.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxCount *int32 `json:"maxCount,omitempty"`
+
+	// VnetSubnetID is the resource ID of an existing subnet the pool's nodes join, instead of a subnet in a virtual
+	// network managed by AKS. Defaults to the control plane's VnetSubnetID. It is immutable after the pool is created.
+	// +optional
+	VnetSubnetID string `json:"vnetSubnetID,omitempty"`
+
+	// MaxPods is the maximum number of pods per node. With Azure CNI every pod takes an address in the node
+	// subnet, so it controls the pool's IP consumption. Defaults to 30 with Azure CNI and 110 with kubenet.
+	// It is immutable after the pool is created.
+	// +kubebuilder:validation:Minimum=10
+	// +kubebuilder:validation:Maximum=250
+	// +optional
+	MaxPods *int32 `json:"maxPods,omitempty"`
+
+	// EnableNodePublicIP assigns each node in the pool its own public IP address, for workloads that clients
+	// connect to directly. Defaults to false. It is immutable after the pool is created.
+	// +optional
+	EnableNodePublicIP *bool `json:"enableNodePublicIP,omitempty"`
+
+	// AvailabilityZones are the zones the pool's nodes are spread across, for example "1", "2" and "3".
+	// They are immutable after the pool is created.
+	// +optional
+	AvailabilityZones []string `json:"availabilityZones,omitempty"`
+
+	// NodeTaints are the taints added to the pool's nodes, in the form key=value:Effect.
+	// +optional
+	NodeTaints []string `json:"nodeTaints,omitempty"`
+
 	// ProviderIDList is the unique identifier as specified by the cloud provider.
 	// +optional
 	ProviderIDList []string `json:"providerIDList,omitempty"`
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"fmt"
+	"reflect"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+const (
+	// minMaxPods and maxMaxPods bound the maximum number of pods per node AKS accepts for an agent pool.
+	minMaxPods = 10
+	maxMaxPods = 250
+)
+
+// log is for logging in this package.
+var azuremanagedmachinepoollog = logf.Log.WithName("azuremanagedmachinepool-resource")
+
+func (m *AzureManagedMachinePool) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(m).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-exp-infrastructure-cluster-x-k8s-io-v1alpha3-azuremanagedmachinepool,mutating=false,failurePolicy=fail,matchPolicy=Equivalent,groups=exp.infrastructure.cluster.x-k8s.io,resources=azuremanagedmachinepools,versions=v1alpha3,name=validation.azuremanagedmachinepool.exp.infrastructure.cluster.x-k8s.io,sideEffects=None
+
+var _ webhook.Validator = &AzureManagedMachinePool{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedMachinePool) ValidateCreate() error {
+	azuremanagedmachinepoollog.Info("validate create", "name", m.Name)
+	if err := m.validateMaxPods(); err != nil {
+		return apierrors.NewInvalid(GroupVersion.WithKind("AzureManagedMachinePool").GroupKind(), m.Name, field.ErrorList{err})
+	}
+	return nil
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedMachinePool) ValidateUpdate(oldRaw runtime.Object) error {
+	azuremanagedmachinepoollog.Info("validate update", "name", m.Name)
+	old := oldRaw.(*AzureManagedMachinePool)
+	var allErrs field.ErrorList
+
+	if err := m.validateMaxPods(); err != nil {
+		allErrs = append(allErrs, err)
+	}
+
+	if m.Spec.SKU != old.Spec.SKU {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "sku"), m.Spec.SKU, "field is immutable"))
+	}
+
+	if !reflect.DeepEqual(m.Spec.OSDiskSizeGB, old.Spec.OSDiskSizeGB) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "osDiskSizeGB"), m.Spec.OSDiskSizeGB, "field is immutable"))
+	}
+
+	if !reflect.DeepEqual(m.Spec.MaxPods, old.Spec.MaxPods) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "maxPods"), m.Spec.MaxPods, "field is immutable"))
+	}
+
+	// AKS can't move an existing agent pool to other zones.
+	if (len(m.Spec.AvailabilityZones) > 0 || len(old.Spec.AvailabilityZones) > 0) &&
+		!reflect.DeepEqual(m.Spec.AvailabilityZones, old.Spec.AvailabilityZones) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "availabilityZones"), m.Spec.AvailabilityZones, "field is immutable"))
+	}
+
+	if m.Spec.VnetSubnetID != old.Spec.VnetSubnetID {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "vnetSubnetID"), m.Spec.VnetSubnetID, "field is immutable"))
+	}
+
+	if !reflect.DeepEqual(m.Spec.EnableNodePublicIP, old.Spec.EnableNodePublicIP) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "enableNodePublicIP"), m.Spec.EnableNodePublicIP, "field is immutable"))
+	}
+
+	if !reflect.DeepEqual(m.Spec.OSType, old.Spec.OSType) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "osType"), m.Spec.OSType, "field is immutable"))
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AzureManagedMachinePool").GroupKind(), m.Name, allErrs)
+}
+
+// validateMaxPods checks that the maximum number of pods per node is within the AKS limits.
+func (m *AzureManagedMachinePool) validateMaxPods() *field.Error {
+	if m.Spec.MaxPods == nil {
+		return nil
+	}
+	if maxPods := *m.Spec.MaxPods; maxPods < minMaxPods || maxPods > maxMaxPods {
+		return field.Invalid(field.NewPath("spec", "maxPods"), maxPods, fmt.Sprintf("must be between %d and %d", minMaxPods, maxMaxPods))
+	}
+	return nil
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (m *AzureManagedMachinePool) ValidateDelete() error {
+	azuremanagedmachinepoollog.Info("validate delete", "name", m.Name)
+	return nil
+}
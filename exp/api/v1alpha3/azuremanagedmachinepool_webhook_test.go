@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3_test
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+
+	exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
+)
+
+func TestAzureManagedMachinePool_ValidateUpdate(t *testing.T) {
+	pool := func(zones ...string) *exp.AzureManagedMachinePool {
+		return &exp.AzureManagedMachinePool{
+			Spec: exp.AzureManagedMachinePoolSpec{
+				SKU:               "Standard_D2s_v3",
+				AvailabilityZones: zones,
+			},
+		}
+	}
+
+	cases := []struct {
+		Name    string
+		Old     *exp.AzureManagedMachinePool
+		New     *exp.AzureManagedMachinePool
+		WantErr bool
+	}{
+		{
+			Name: "NoZones",
+			Old:  pool(),
+			New:  pool(),
+		},
+		{
+			Name: "SameZones",
+			Old:  pool("1", "2", "3"),
+			New:  pool("1", "2", "3"),
+		},
+		{
+			Name:    "ZonesChanged",
+			Old:     pool("1", "2"),
+			New:     pool("1", "2", "3"),
+			WantErr: true,
+		},
+		{
+			Name:    "ZonesAdded",
+			Old:     pool(),
+			New:     pool("1"),
+			WantErr: true,
+		},
+		{
+			Name:    "ZonesRemoved",
+			Old:     pool("1"),
+			New:     pool(),
+			WantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			err := c.New.ValidateUpdate(c.Old)
+			if c.WantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(err.Error()).To(gomega.ContainSubstring("spec.availabilityZones"))
+			} else {
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+	}
+}
+
+func TestAzureManagedMachinePool_ValidateUpdateOSType(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	windows := "Windows"
+	old := &exp.AzureManagedMachinePool{Spec: exp.AzureManagedMachinePoolSpec{SKU: "Standard_D2s_v3"}}
+	pool := old.DeepCopy()
+	g.Expect(pool.ValidateUpdate(old)).To(gomega.Succeed())
+
+	pool.Spec.OSType = &windows
+	err := pool.ValidateUpdate(old)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("spec.osType"))
+}
+
+func TestAzureManagedMachinePool_ValidateUpdateVnetSubnetID(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	old := &exp.AzureManagedMachinePool{Spec: exp.AzureManagedMachinePoolSpec{SKU: "Standard_D2s_v3"}}
+	pool := old.DeepCopy()
+	g.Expect(pool.ValidateUpdate(old)).To(gomega.Succeed())
+
+	pool.Spec.VnetSubnetID = "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.Network/virtualNetworks/my-vnet/subnets/my-subnet"
+	err := pool.ValidateUpdate(old)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("spec.vnetSubnetID"))
+}
+
+func TestAzureManagedMachinePool_ValidateMaxPods(t *testing.T) {
+	pool := func(maxPods *int32) *exp.AzureManagedMachinePool {
+		return &exp.AzureManagedMachinePool{
+			Spec: exp.AzureManagedMachinePoolSpec{
+				SKU:     "Standard_D2s_v3",
+				MaxPods: maxPods,
+			},
+		}
+	}
+	maxPods := func(n int32) *int32 { return &n }
+
+	cases := []struct {
+		Name    string
+		Pool    *exp.AzureManagedMachinePool
+		WantErr bool
+	}{
+		{
+			Name: "Unset",
+			Pool: pool(nil),
+		},
+		{
+			Name: "Minimum",
+			Pool: pool(maxPods(10)),
+		},
+		{
+			Name: "Maximum",
+			Pool: pool(maxPods(250)),
+		},
+		{
+			Name:    "TooFew",
+			Pool:    pool(maxPods(9)),
+			WantErr: true,
+		},
+		{
+			Name:    "TooMany",
+			Pool:    pool(maxPods(251)),
+			WantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			err := c.Pool.ValidateCreate()
+			if c.WantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(err.Error()).To(gomega.ContainSubstring("spec.maxPods"))
+			} else {
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+	}
+
+	t.Run("Immutable", func(t *testing.T) {
+		g := gomega.NewGomegaWithT(t)
+		err := pool(maxPods(50)).ValidateUpdate(pool(maxPods(30)))
+		g.Expect(err).To(gomega.HaveOccurred())
+		g.Expect(err.Error()).To(gomega.ContainSubstring("field is immutable"))
+	})
+}
+
+func TestAzureManagedMachinePool_ValidateUpdateEnableNodePublicIP(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	enabled := true
+	old := &exp.AzureManagedMachinePool{Spec: exp.AzureManagedMachinePoolSpec{SKU: "Standard_D2s_v3"}}
+	pool := old.DeepCopy()
+	g.Expect(pool.ValidateUpdate(old)).To(gomega.Succeed())
+
+	pool.Spec.EnableNodePublicIP = &enabled
+	err := pool.ValidateUpdate(old)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("spec.enableNodePublicIP"))
+}
+
+func TestAzureManagedMachinePool_ValidateUpdateSKU(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	old := &exp.AzureManagedMachinePool{Spec: exp.AzureManagedMachinePoolSpec{SKU: "Standard_D2s_v3"}}
+	pool := old.DeepCopy()
+	g.Expect(pool.ValidateUpdate(old)).To(gomega.Succeed())
+
+	pool.Spec.SKU = "Standard_D4s_v3"
+	err := pool.ValidateUpdate(old)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("spec.sku"))
+}
+
+func TestAzureManagedMachinePool_ValidateUpdateOSDiskSizeGB(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	size := int32(128)
+	old := &exp.AzureManagedMachinePool{Spec: exp.AzureManagedMachinePoolSpec{SKU: "Standard_D2s_v3"}}
+	pool := old.DeepCopy()
+	g.Expect(pool.ValidateUpdate(old)).To(gomega.Succeed())
+
+	pool.Spec.OSDiskSizeGB = &size
+	err := pool.ValidateUpdate(old)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("spec.osDiskSizeGB"))
+}
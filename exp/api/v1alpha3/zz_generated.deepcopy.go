@@ -26,6 +26,48 @@ import (
 	"sigs.k8s.io/cluster-api/errors"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddonProfile) DeepCopyInto(out *AddonProfile) {
+	*out = *in
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddonProfile.
+func (in *AddonProfile) DeepCopy() *AddonProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(AddonProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *APIServerAccessProfile) DeepCopyInto(out *APIServerAccessProfile) {
+	*out = *in
+	if in.AuthorizedIPRanges != nil {
+		in, out := &in.AuthorizedIPRanges, &out.AuthorizedIPRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new APIServerAccessProfile.
+func (in *APIServerAccessProfile) DeepCopy() *APIServerAccessProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(APIServerAccessProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureMachinePool) DeepCopyInto(out *AzureMachinePool) {
 	*out = *in
@@ -260,7 +302,7 @@ func (in *AzureManagedControlPlane) DeepCopyInto(out *AzureManagedControlPlane)
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureManagedControlPlane.
@@ -316,6 +358,11 @@ func (in *AzureManagedControlPlaneList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureManagedControlPlaneSpec) DeepCopyInto(out *AzureManagedControlPlaneSpec) {
 	*out = *in
+	if in.DNSPrefix != nil {
+		in, out := &in.DNSPrefix, &out.DNSPrefix
+		*out = new(string)
+		**out = **in
+	}
 	out.ControlPlaneEndpoint = in.ControlPlaneEndpoint
 	if in.AdditionalTags != nil {
 		in, out := &in.AdditionalTags, &out.AdditionalTags
@@ -329,6 +376,11 @@ func (in *AzureManagedControlPlaneSpec) DeepCopyInto(out *AzureManagedControlPla
 		*out = new(string)
 		**out = **in
 	}
+	if in.LoadBalancerProfile != nil {
+		in, out := &in.LoadBalancerProfile, &out.LoadBalancerProfile
+		*out = new(LoadBalancerProfile)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.NetworkPlugin != nil {
 		in, out := &in.NetworkPlugin, &out.NetworkPlugin
 		*out = new(string)
@@ -339,6 +391,48 @@ func (in *AzureManagedControlPlaneSpec) DeepCopyInto(out *AzureManagedControlPla
 		*out = new(string)
 		**out = **in
 	}
+	if in.DNSServiceIP != nil {
+		in, out := &in.DNSServiceIP, &out.DNSServiceIP
+		*out = new(string)
+		**out = **in
+	}
+	if in.DockerBridgeCidr != nil {
+		in, out := &in.DockerBridgeCidr, &out.DockerBridgeCidr
+		*out = new(string)
+		**out = **in
+	}
+	if in.OutboundType != nil {
+		in, out := &in.OutboundType, &out.OutboundType
+		*out = new(string)
+		**out = **in
+	}
+	if in.WindowsProfile != nil {
+		in, out := &in.WindowsProfile, &out.WindowsProfile
+		*out = new(WindowsProfile)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.EnablePrivateCluster != nil {
+		in, out := &in.EnablePrivateCluster, &out.EnablePrivateCluster
+		*out = new(bool)
+		**out = **in
+	}
+	if in.APIServerAccessProfile != nil {
+		in, out := &in.APIServerAccessProfile, &out.APIServerAccessProfile
+		*out = new(APIServerAccessProfile)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AddonProfiles != nil {
+		in, out := &in.AddonProfiles, &out.AddonProfiles
+		*out = make([]AddonProfile, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DiagnosticsProfile != nil {
+		in, out := &in.DiagnosticsProfile, &out.DiagnosticsProfile
+		*out = new(DiagnosticsProfile)
+		(*in).DeepCopyInto(*out)
+	}
 	out.DefaultPoolRef = in.DefaultPoolRef
 }
 
@@ -355,6 +449,16 @@ func (in *AzureManagedControlPlaneSpec) DeepCopy() *AzureManagedControlPlaneSpec
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureManagedControlPlaneStatus) DeepCopyInto(out *AzureManagedControlPlaneStatus) {
 	*out = *in
+	if in.LongRunningOperation != nil {
+		in, out := &in.LongRunningOperation, &out.LongRunningOperation
+		*out = new(Future)
+		**out = **in
+	}
+	if in.ManagedAddons != nil {
+		in, out := &in.ManagedAddons, &out.ManagedAddons
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureManagedControlPlaneStatus.
@@ -434,6 +538,46 @@ func (in *AzureManagedMachinePoolSpec) DeepCopyInto(out *AzureManagedMachinePool
 		*out = new(int32)
 		**out = **in
 	}
+	if in.OSType != nil {
+		in, out := &in.OSType, &out.OSType
+		*out = new(string)
+		**out = **in
+	}
+	if in.EnableAutoScaling != nil {
+		in, out := &in.EnableAutoScaling, &out.EnableAutoScaling
+		*out = new(bool)
+		**out = **in
+	}
+	if in.MinCount != nil {
+		in, out := &in.MinCount, &out.MinCount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxCount != nil {
+		in, out := &in.MaxCount, &out.MaxCount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxPods != nil {
+		in, out := &in.MaxPods, &out.MaxPods
+		*out = new(int32)
+		**out = **in
+	}
+	if in.EnableNodePublicIP != nil {
+		in, out := &in.EnableNodePublicIP, &out.EnableNodePublicIP
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AvailabilityZones != nil {
+		in, out := &in.AvailabilityZones, &out.AvailabilityZones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NodeTaints != nil {
+		in, out := &in.NodeTaints, &out.NodeTaints
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.ProviderIDList != nil {
 		in, out := &in.ProviderIDList, &out.ProviderIDList
 		*out = make([]string, len(*in))
@@ -476,6 +620,81 @@ func (in *AzureManagedMachinePoolStatus) DeepCopy() *AzureManagedMachinePoolStat
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiagnosticsProfile) DeepCopyInto(out *DiagnosticsProfile) {
+	*out = *in
+	if in.Logs != nil {
+		in, out := &in.Logs, &out.Logs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiagnosticsProfile.
+func (in *DiagnosticsProfile) DeepCopy() *DiagnosticsProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(DiagnosticsProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Future) DeepCopyInto(out *Future) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Future.
+func (in *Future) DeepCopy() *Future {
+	if in == nil {
+		return nil
+	}
+	out := new(Future)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LoadBalancerProfile) DeepCopyInto(out *LoadBalancerProfile) {
+	*out = *in
+	if in.ManagedOutboundIPCount != nil {
+		in, out := &in.ManagedOutboundIPCount, &out.ManagedOutboundIPCount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.OutboundIPs != nil {
+		in, out := &in.OutboundIPs, &out.OutboundIPs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.OutboundIPPrefixes != nil {
+		in, out := &in.OutboundIPPrefixes, &out.OutboundIPPrefixes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllocatedOutboundPorts != nil {
+		in, out := &in.AllocatedOutboundPorts, &out.AllocatedOutboundPorts
+		*out = new(int32)
+		**out = **in
+	}
+	if in.IdleTimeoutInMinutes != nil {
+		in, out := &in.IdleTimeoutInMinutes, &out.IdleTimeoutInMinutes
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LoadBalancerProfile.
+func (in *LoadBalancerProfile) DeepCopy() *LoadBalancerProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(LoadBalancerProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VMSS) DeepCopyInto(out *VMSS) {
 	*out = *in
@@ -523,3 +742,19 @@ func (in *VMSSVM) DeepCopy() *VMSSVM {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WindowsProfile) DeepCopyInto(out *WindowsProfile) {
+	*out = *in
+	in.AdminPasswordSecretRef.DeepCopyInto(&out.AdminPasswordSecretRef)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WindowsProfile.
+func (in *WindowsProfile) DeepCopy() *WindowsProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(WindowsProfile)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -55,18 +55,34 @@ func newAzureManagedMachinePoolReconciler(scope *scope.ManagedControlPlaneScope)
 func (r *azureManagedMachinePoolReconciler) Reconcile(ctx context.Context, scope *scope.ManagedControlPlaneScope) error {
 	scope.Logger.Info("reconciling machine pool")
 	agentPoolSpec := &agentpools.Spec{
-		Name:          scope.InfraMachinePool.Name,
-		ResourceGroup: scope.ControlPlane.Spec.ResourceGroup,
-		Cluster:       scope.ControlPlane.Name,
-		SKU:           scope.InfraMachinePool.Spec.SKU,
-		Replicas:      1,
-		Version:       scope.MachinePool.Spec.Template.Spec.Version,
+		Name:               scope.InfraMachinePool.Name,
+		ResourceGroup:      scope.ControlPlane.Spec.ResourceGroup,
+		Cluster:            scope.ControlPlane.Name,
+		SKU:                scope.InfraMachinePool.Spec.SKU,
+		Replicas:           1,
+		Version:            scope.MachinePool.Spec.Template.Spec.Version,
+		EnableAutoScaling:  scope.InfraMachinePool.Spec.EnableAutoScaling,
+		MinCount:           scope.InfraMachinePool.Spec.MinCount,
+		MaxCount:           scope.InfraMachinePool.Spec.MaxCount,
+		AvailabilityZones:  scope.InfraMachinePool.Spec.AvailabilityZones,
+		NodeTaints:         scope.InfraMachinePool.Spec.NodeTaints,
+		MaxPods:            scope.InfraMachinePool.Spec.MaxPods,
+		EnableNodePublicIP: scope.InfraMachinePool.Spec.EnableNodePublicIP,
 	}
 
 	if scope.InfraMachinePool.Spec.OSDiskSizeGB != nil {
 		agentPoolSpec.OSDiskSizeGB = *scope.InfraMachinePool.Spec.OSDiskSizeGB
 	}
 
+	if scope.InfraMachinePool.Spec.OSType != nil {
+		agentPoolSpec.OSType = *scope.InfraMachinePool.Spec.OSType
+	}
+
+	agentPoolSpec.VnetSubnetID = scope.InfraMachinePool.Spec.VnetSubnetID
+	if agentPoolSpec.VnetSubnetID == "" {
+		agentPoolSpec.VnetSubnetID = scope.ControlPlane.Spec.VnetSubnetID
+	}
+
 	if scope.MachinePool.Spec.Replicas != nil {
 		agentPoolSpec.Replicas = *scope.MachinePool.Spec.Replicas
 	}
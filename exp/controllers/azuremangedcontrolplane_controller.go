@@ -18,15 +18,18 @@ package controllers
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/tools/record"
 	infrav1 "sigs.k8s.io/cluster-api-provider-azure/api/v1alpha3"
 	infrav1exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
 
 	"sigs.k8s.io/cluster-api-provider-azure/cloud/scope"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/managedclusters"
 	"sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -35,6 +38,13 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// kubeconfigRefreshInterval is how often a ready control plane is reconciled to refresh its kubeconfig secret,
+// so credentials rotated or expired outside of the controller don't leave the secret stale.
+const kubeconfigRefreshInterval = 10 * time.Minute
+
+// operationPollInterval is how often an AKS operation started by the controller is polled until it completes.
+const operationPollInterval = 30 * time.Second
+
 // AzureManagedControlPlaneReconciler reconciles a AzureManagedControlPlane object
 type AzureManagedControlPlaneReconciler struct {
 	client.Client
@@ -146,6 +156,17 @@ func (r *AzureManagedControlPlaneReconciler) reconcileNormal(ctx context.Context
 	}
 
 	if err := newAzureManagedControlPlaneReconciler(scope).Reconcile(ctx, scope); err != nil {
+		if errors.Is(err, errOperationInProgress) {
+			scope.Logger.V(2).Info("Managed cluster operation in progress, requeueing")
+			return reconcile.Result{RequeueAfter: operationPollInterval}, nil
+		}
+		// Retrying won't help until the user expands the subnet, so surface it and wait for a spec change.
+		var subnetErr *managedclusters.ErrSubnetExhausted
+		if errors.As(err, &subnetErr) {
+			scope.Logger.Info("Subnet exhausted", "subnetID", subnetErr.SubnetID)
+			r.Recorder.Eventf(scope.ControlPlane, corev1.EventTypeWarning, "SubnetExhausted", "%s", subnetErr.Error())
+			return reconcile.Result{}, nil
+		}
 		return reconcile.Result{}, errors.Wrapf(err, "error creating AzureManagedControlPlane %s/%s", scope.ControlPlane.Namespace, scope.ControlPlane.Name)
 	}
 
@@ -153,7 +174,7 @@ func (r *AzureManagedControlPlaneReconciler) reconcileNormal(ctx context.Context
 	scope.ControlPlane.Status.Ready = true
 	scope.ControlPlane.Status.Initialized = true
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: kubeconfigRefreshInterval}, nil
 }
 
 func (r *AzureManagedControlPlaneReconciler) reconcileDelete(ctx context.Context, scope *scope.ManagedControlPlaneScope) (reconcile.Result, error) {
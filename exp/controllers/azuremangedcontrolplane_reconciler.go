@@ -18,14 +18,19 @@ package controllers
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	azureautorest "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	azure "sigs.k8s.io/cluster-api-provider-azure/cloud"
 	"sigs.k8s.io/cluster-api-provider-azure/cloud/scope"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/diagnosticsettings"
 	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/managedclusters"
 	infrav1exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
@@ -34,32 +39,105 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+const (
+	// createOrUpdateOperation is the type of the operation creating or updating the AKS cluster.
+	createOrUpdateOperation = "createOrUpdate"
+	// rotateCertificatesOperation is the type of the operation rotating the certificates of the AKS cluster.
+	rotateCertificatesOperation = "rotateCertificates"
+)
+
+// errOperationInProgress is returned while an AKS operation started by the controller is still running.
+var errOperationInProgress = errors.New("managed cluster operation in progress")
+
+// managedClusterService is a CredentialGetter which can also create or update a managed cluster and rotate its
+// certificates without waiting for AKS.
+type managedClusterService interface {
+	azure.CredentialGetter
+	RotateClusterCertificatesAsync(ctx context.Context, group, name string) (*azureautorest.Future, error)
+	ReconcileAsync(ctx context.Context, spec *managedclusters.Spec, existing *containerservice.ManagedCluster) (managedclusters.ReconcileResult, *azureautorest.Future, error)
+	IsDone(ctx context.Context, future azureautorest.Future) (bool, error)
+}
+
 // azureManagedControlPlaneReconciler are list of services required by cluster controller
 type azureManagedControlPlaneReconciler struct {
-	kubeclient         client.Client
-	managedClustersSvc azure.CredentialGetter
+	kubeclient            client.Client
+	managedClustersSvc    managedClusterService
+	diagnosticSettingsSvc azure.Service
 }
 
 // newAzureManagedControlPlaneReconciler populates all the services based on input scope
 func newAzureManagedControlPlaneReconciler(scope *scope.ManagedControlPlaneScope) *azureManagedControlPlaneReconciler {
 	return &azureManagedControlPlaneReconciler{
-		kubeclient:         scope.Client,
-		managedClustersSvc: managedclusters.NewService(scope.AzureClients.Authorizer, scope.AzureClients.SubscriptionID),
+		kubeclient:            scope.Client,
+		managedClustersSvc:    managedclusters.NewService(scope.AzureClients.Authorizer, scope.AzureClients.SubscriptionID),
+		diagnosticSettingsSvc: diagnosticsettings.NewService(scope.AzureClients.Authorizer, scope.AzureClients.SubscriptionID),
 	}
 }
 
 // Reconcile reconciles all the services in pre determined order
 func (r *azureManagedControlPlaneReconciler) Reconcile(ctx context.Context, scope *scope.ManagedControlPlaneScope) error {
+	decodedSSHPublicKey, err := base64.StdEncoding.DecodeString(scope.ControlPlane.Spec.SSHPublicKey)
+	if err != nil {
+		return errors.Wrapf(err, "failed to base64 decode ssh public key")
+	}
+
 	managedClusterSpec := &managedclusters.Spec{
-		Name:            scope.ControlPlane.Name,
-		ResourceGroup:   scope.ControlPlane.Spec.ResourceGroup,
-		Location:        scope.ControlPlane.Spec.Location,
-		Tags:            scope.ControlPlane.Spec.AdditionalTags,
-		Version:         scope.ControlPlane.Spec.Version,
-		LoadBalancerSKU: scope.ControlPlane.Spec.LoadBalancerSKU,
-		NetworkPlugin:   scope.ControlPlane.Spec.NetworkPlugin,
-		NetworkPolicy:   scope.ControlPlane.Spec.NetworkPolicy,
-		SSHPublicKey:    scope.ControlPlane.Spec.SSHPublicKey,
+		Name:                 scope.ControlPlane.Name,
+		ResourceGroup:        scope.ControlPlane.Spec.ResourceGroup,
+		Location:             scope.ControlPlane.Spec.Location,
+		Tags:                 scope.ControlPlane.Spec.AdditionalTags,
+		Version:              scope.ControlPlane.Spec.Version,
+		LoadBalancerSKU:      scope.ControlPlane.Spec.LoadBalancerSKU,
+		NetworkPlugin:        scope.ControlPlane.Spec.NetworkPlugin,
+		NetworkPolicy:        scope.ControlPlane.Spec.NetworkPolicy,
+		OutboundType:         scope.ControlPlane.Spec.OutboundType,
+		SSHPublicKey:         string(decodedSSHPublicKey),
+		EnablePrivateCluster: scope.ControlPlane.Spec.EnablePrivateCluster,
+	}
+	if scope.ControlPlane.Spec.DNSPrefix != nil {
+		managedClusterSpec.DNSPrefix = *scope.ControlPlane.Spec.DNSPrefix
+	}
+	if scope.ControlPlane.Spec.DNSServiceIP != nil {
+		managedClusterSpec.DNSServiceIP = *scope.ControlPlane.Spec.DNSServiceIP
+	}
+	if scope.ControlPlane.Spec.DockerBridgeCidr != nil {
+		managedClusterSpec.DockerBridgeCIDR = *scope.ControlPlane.Spec.DockerBridgeCidr
+	}
+
+	if profile := scope.ControlPlane.Spec.LoadBalancerProfile; profile != nil {
+		managedClusterSpec.LoadBalancerProfile = &managedclusters.LoadBalancerProfile{
+			ManagedOutboundIPCount: profile.ManagedOutboundIPCount,
+			OutboundIPs:            profile.OutboundIPs,
+			OutboundIPPrefixes:     profile.OutboundIPPrefixes,
+			AllocatedOutboundPorts: profile.AllocatedOutboundPorts,
+			IdleTimeoutInMinutes:   profile.IdleTimeoutInMinutes,
+		}
+	}
+
+	if profile := scope.ControlPlane.Spec.APIServerAccessProfile; profile != nil {
+		managedClusterSpec.APIServerAccessProfile = &managedclusters.APIServerAccessProfile{
+			AuthorizedIPRanges: profile.AuthorizedIPRanges,
+		}
+	}
+
+	// Only the addons the spec sets, now or on an earlier reconcile, are managed. Others are left to whoever enabled them.
+	if len(scope.ControlPlane.Spec.AddonProfiles) > 0 {
+		managedClusterSpec.AddonProfiles = map[string]managedclusters.AddonProfile{}
+		for _, addon := range scope.ControlPlane.Spec.AddonProfiles {
+			managedClusterSpec.AddonProfiles[addon.Name] = managedclusters.AddonProfile{
+				Enabled: addon.Enabled,
+				Config:  addon.Config,
+			}
+		}
+	}
+	managedClusterSpec.PreviousAddons = scope.ControlPlane.Status.ManagedAddons
+
+	if profile := scope.ControlPlane.Spec.WindowsProfile; profile != nil {
+		windowsProfile, err := r.getWindowsProfile(ctx, scope, profile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get windows profile")
+		}
+		managedClusterSpec.WindowsProfile = windowsProfile
 	}
 
 	scope.Logger.V(2).Info("Reconciling managed cluster")
@@ -72,6 +150,16 @@ func (r *azureManagedControlPlaneReconciler) Reconcile(ctx context.Context, scop
 		return errors.Wrapf(err, "failed to reconcile control plane endpoint")
 	}
 
+	scope.Logger.V(2).Info("Reconciling diagnostic settings")
+	if err := r.reconcileDiagnosticSettings(ctx, scope); err != nil {
+		return errors.Wrapf(err, "failed to reconcile diagnostic settings")
+	}
+
+	scope.Logger.V(2).Info("Reconciling certificate rotation")
+	if err := r.reconcileCertificateRotation(ctx, scope, managedClusterSpec); err != nil {
+		return errors.Wrapf(err, "failed to rotate cluster certificates")
+	}
+
 	scope.Logger.V(2).Info("Reconciling kubeconfig")
 	if err := r.reconcileKubeconfig(ctx, scope, managedClusterSpec); err != nil {
 		return errors.Wrapf(err, "failed to reconcile kubeconfig secret")
@@ -82,16 +170,20 @@ func (r *azureManagedControlPlaneReconciler) Reconcile(ctx context.Context, scop
 
 // Delete reconciles all the services in pre determined order
 func (r *azureManagedControlPlaneReconciler) Delete(ctx context.Context, scope *scope.ManagedControlPlaneScope) error {
+	// Deleting a managed cluster only needs to know where it lives.
 	managedClusterSpec := &managedclusters.Spec{
-		Name:            scope.ControlPlane.Name,
-		ResourceGroup:   scope.ControlPlane.Spec.ResourceGroup,
-		Location:        scope.ControlPlane.Spec.Location,
-		Tags:            scope.ControlPlane.Spec.AdditionalTags,
-		Version:         scope.ControlPlane.Spec.Version,
-		LoadBalancerSKU: scope.ControlPlane.Spec.LoadBalancerSKU,
-		NetworkPlugin:   scope.ControlPlane.Spec.NetworkPlugin,
-		NetworkPolicy:   scope.ControlPlane.Spec.NetworkPolicy,
-		SSHPublicKey:    scope.ControlPlane.Spec.SSHPublicKey,
+		Name:          scope.ControlPlane.Name,
+		ResourceGroup: scope.ControlPlane.Spec.ResourceGroup,
+	}
+
+	// Diagnostic settings outlive the resource they belong to, and would be picked up by a new cluster of the same name.
+	if name := scope.ControlPlane.Status.DiagnosticSettingName; name != "" {
+		diagnosticSettingSpec := diagnosticSettingSpec(scope)
+		diagnosticSettingSpec.Name = name
+		if err := r.diagnosticSettingsSvc.Delete(ctx, diagnosticSettingSpec); err != nil {
+			return errors.Wrapf(err, "failed to delete diagnostic settings of managed cluster %s", scope.ControlPlane.Name)
+		}
+		scope.ControlPlane.Status.DiagnosticSettingName = ""
 	}
 
 	if err := r.managedClustersSvc.Delete(ctx, managedClusterSpec); err != nil {
@@ -101,7 +193,43 @@ func (r *azureManagedControlPlaneReconciler) Delete(ctx context.Context, scope *
 	return nil
 }
 
+// getWindowsProfile reads the Windows administrator password from the secret referenced by the control plane.
+func (r *azureManagedControlPlaneReconciler) getWindowsProfile(ctx context.Context, scope *scope.ManagedControlPlaneScope, profile *infrav1exp.WindowsProfile) (*managedclusters.WindowsProfile, error) {
+	ref := profile.AdminPasswordSecretRef
+	passwordSecret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: scope.ControlPlane.Namespace, Name: ref.Name}
+	if err := r.kubeclient.Get(ctx, key, passwordSecret); err != nil {
+		return nil, errors.Wrapf(err, "failed to get secret %s", key)
+	}
+	password, ok := passwordSecret.Data[ref.Key]
+	if !ok {
+		return nil, errors.Errorf("secret %s has no key %s", key, ref.Key)
+	}
+	return &managedclusters.WindowsProfile{
+		AdminUsername: profile.AdminUsername,
+		AdminPassword: string(password),
+	}, nil
+}
+
 func (r *azureManagedControlPlaneReconciler) reconcileManagedCluster(ctx context.Context, scope *scope.ManagedControlPlaneScope, managedClusterSpec *managedclusters.Spec) error {
+	// An operation started by an earlier reconcile has to finish before the cluster is changed again.
+	if operation := scope.ControlPlane.Status.LongRunningOperation; operation != nil {
+		done, err := r.isOperationDone(ctx, operation)
+		if err != nil {
+			// Forget the operation, so the next reconcile starts over from the cluster's current state.
+			scope.ControlPlane.Status.LongRunningOperation = nil
+			return err
+		}
+		if !done {
+			return errOperationInProgress
+		}
+		scope.ControlPlane.Status.LongRunningOperation = nil
+		if operation.Type == rotateCertificatesOperation {
+			// The deferred patch of the control plane persists the removal, so the rotation isn't repeated.
+			delete(scope.ControlPlane.Annotations, infrav1exp.RotateCertificatesAnnotation)
+		}
+	}
+
 	if net := scope.Cluster.Spec.ClusterNetwork; net != nil {
 		if net.Services != nil {
 			// A user may provide zero or one CIDR blocks. If they provide an empty array,
@@ -127,7 +255,7 @@ func (r *azureManagedControlPlaneReconciler) reconcileManagedCluster(ctx context
 
 	_, err := r.managedClustersSvc.Get(ctx, managedClusterSpec)
 	// Transient or other failure not due to 404
-	if err != nil && !azure.ResourceNotFound(err) {
+	if err != nil && !errors.Is(err, managedclusters.ErrManagedClusterNotFound) {
 		return errors.Wrapf(err, "failed to fetch existing managed cluster")
 	}
 
@@ -135,18 +263,32 @@ func (r *azureManagedControlPlaneReconciler) reconcileManagedCluster(ctx context
 	// Configure the default pool, rest will be handled by machinepool controller
 	// We do this here because AKS will only let us mutate agent pools via managed
 	// clusters API at create time, not update.
-	if azure.ResourceNotFound(err) {
+	if errors.Is(err, managedclusters.ErrManagedClusterNotFound) {
 		defaultPoolSpec := managedclusters.PoolSpec{
-			Name:         scope.InfraMachinePool.Name,
-			SKU:          scope.InfraMachinePool.Spec.SKU,
-			Replicas:     1,
-			OSDiskSizeGB: 0,
+			Name:               scope.InfraMachinePool.Name,
+			SKU:                scope.InfraMachinePool.Spec.SKU,
+			Replicas:           1,
+			OSDiskSizeGB:       0,
+			EnableAutoScaling:  scope.InfraMachinePool.Spec.EnableAutoScaling,
+			MinCount:           scope.InfraMachinePool.Spec.MinCount,
+			MaxCount:           scope.InfraMachinePool.Spec.MaxCount,
+			AvailabilityZones:  scope.InfraMachinePool.Spec.AvailabilityZones,
+			NodeTaints:         scope.InfraMachinePool.Spec.NodeTaints,
+			MaxPods:            scope.InfraMachinePool.Spec.MaxPods,
+			EnableNodePublicIP: scope.InfraMachinePool.Spec.EnableNodePublicIP,
 		}
 
 		// Set optional values
 		if scope.InfraMachinePool.Spec.OSDiskSizeGB != nil {
 			defaultPoolSpec.OSDiskSizeGB = *scope.InfraMachinePool.Spec.OSDiskSizeGB
 		}
+		if scope.InfraMachinePool.Spec.OSType != nil {
+			defaultPoolSpec.OSType = *scope.InfraMachinePool.Spec.OSType
+		}
+		defaultPoolSpec.VnetSubnetID = scope.InfraMachinePool.Spec.VnetSubnetID
+		if defaultPoolSpec.VnetSubnetID == "" {
+			defaultPoolSpec.VnetSubnetID = scope.ControlPlane.Spec.VnetSubnetID
+		}
 		if scope.MachinePool.Spec.Replicas != nil {
 			defaultPoolSpec.Replicas = *scope.MachinePool.Spec.Replicas
 		}
@@ -155,11 +297,56 @@ func (r *azureManagedControlPlaneReconciler) reconcileManagedCluster(ctx context
 		managedClusterSpec.AgentPools = []managedclusters.PoolSpec{defaultPoolSpec}
 	}
 
-	// Send to Azure for create/update.
-	if err := r.managedClustersSvc.Reconcile(ctx, managedClusterSpec); err != nil {
+	// Send to Azure for create/update, without holding the reconcile while AKS provisions the cluster.
+	_, future, err := r.managedClustersSvc.ReconcileAsync(ctx, managedClusterSpec, nil)
+	if err != nil {
 		return errors.Wrapf(err, "failed to reconcile managed cluster %s", scope.ControlPlane.Name)
 	}
-	return nil
+	scope.ControlPlane.Status.ManagedAddons = addonNames(managedClusterSpec.AddonProfiles)
+	if future == nil {
+		return nil
+	}
+	return setOperation(scope, createOrUpdateOperation, future)
+}
+
+// setOperation persists an operation started by the controller in the control plane status, so later reconciles
+// poll it instead of waiting for it, and returns errOperationInProgress.
+func setOperation(scope *scope.ManagedControlPlaneScope, operationType string, future *azureautorest.Future) error {
+	data, err := json.Marshal(future)
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize %s operation", operationType)
+	}
+	scope.ControlPlane.Status.LongRunningOperation = &infrav1exp.Future{
+		Type: operationType,
+		Data: string(data),
+	}
+	return errOperationInProgress
+}
+
+// addonNames returns the sorted names of the addons, or nil when there are none.
+func addonNames(addons map[string]managedclusters.AddonProfile) []string {
+	if len(addons) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(addons))
+	for name := range addons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isOperationDone polls an operation persisted in the control plane status. A failed operation is an error.
+func (r *azureManagedControlPlaneReconciler) isOperationDone(ctx context.Context, operation *infrav1exp.Future) (bool, error) {
+	var future azureautorest.Future
+	if err := json.Unmarshal([]byte(operation.Data), &future); err != nil {
+		return false, errors.Wrapf(err, "failed to deserialize %s operation", operation.Type)
+	}
+	done, err := r.managedClustersSvc.IsDone(ctx, future)
+	if err != nil {
+		return false, errors.Wrapf(err, "%s operation failed", operation.Type)
+	}
+	return done, nil
 }
 
 func (r *azureManagedControlPlaneReconciler) reconcileEndpoint(ctx context.Context, scope *scope.ManagedControlPlaneScope, managedClusterSpec *managedclusters.Spec) error {
@@ -174,20 +361,86 @@ func (r *azureManagedControlPlaneReconciler) reconcileEndpoint(ctx context.Conte
 		return fmt.Errorf("expected containerservice ManagedCluster object")
 	}
 
+	// Private clusters are reached through their private FQDN.
+	fqdn := managedclusters.APIServerFQDN(managedCluster)
+	if fqdn == "" {
+		return errors.Errorf("managed cluster %s has no FQDN yet", managedClusterSpec.Name)
+	}
+
 	old := scope.ControlPlane.DeepCopyObject()
 
 	scope.ControlPlane.Spec.ControlPlaneEndpoint = clusterv1.APIEndpoint{
-		Host: *managedCluster.ManagedClusterProperties.Fqdn,
+		Host: fqdn,
 		Port: 443,
 	}
 
+	// The patch refreshes the control plane from the API server, which drops status changes not persisted yet.
+	status := scope.ControlPlane.Status.DeepCopy()
 	if err := r.kubeclient.Patch(ctx, scope.ControlPlane, client.MergeFrom(old)); err != nil {
 		return errors.Wrapf(err, "failed to set control plane endpoint")
 	}
+	scope.ControlPlane.Status = *status
+
+	// Report the version AKS is running, which can differ from the spec after an upgrade outside the controller.
+	if managedCluster.KubernetesVersion != nil {
+		scope.ControlPlane.Status.Version = *managedCluster.KubernetesVersion
+	}
 
 	return nil
 }
 
+// reconcileDiagnosticSettings streams the control plane logs to the destinations of the diagnostics profile,
+// or stops streaming them once the profile is removed.
+func (r *azureManagedControlPlaneReconciler) reconcileDiagnosticSettings(ctx context.Context, scope *scope.ManagedControlPlaneScope) error {
+	diagnosticSettingSpec := diagnosticSettingSpec(scope)
+	profile := scope.ControlPlane.Spec.DiagnosticsProfile
+	if profile == nil {
+		// Only delete a setting this control plane created, rather than send a delete on every reconcile.
+		if scope.ControlPlane.Status.DiagnosticSettingName == "" {
+			return nil
+		}
+		diagnosticSettingSpec.Name = scope.ControlPlane.Status.DiagnosticSettingName
+		if err := r.diagnosticSettingsSvc.Delete(ctx, diagnosticSettingSpec); err != nil {
+			return err
+		}
+		scope.ControlPlane.Status.DiagnosticSettingName = ""
+		return nil
+	}
+
+	diagnosticSettingSpec.WorkspaceID = profile.WorkspaceID
+	diagnosticSettingSpec.StorageAccountID = profile.StorageAccountID
+	diagnosticSettingSpec.Logs = profile.Logs
+	if err := r.diagnosticSettingsSvc.Reconcile(ctx, diagnosticSettingSpec); err != nil {
+		return err
+	}
+	scope.ControlPlane.Status.DiagnosticSettingName = diagnosticSettingSpec.Name
+	return nil
+}
+
+// diagnosticSettingSpec returns the spec of the diagnostic setting owned by the control plane, without its destinations.
+func diagnosticSettingSpec(scope *scope.ManagedControlPlaneScope) *diagnosticsettings.Spec {
+	return &diagnosticsettings.Spec{
+		Name: scope.ControlPlane.Name,
+		ResourceURI: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ContainerService/managedClusters/%s",
+			scope.AzureClients.SubscriptionID, scope.ControlPlane.Spec.ResourceGroup, scope.ControlPlane.Name),
+	}
+}
+
+// reconcileCertificateRotation starts rotating the cluster certificates when the control plane asks for it. Later
+// reconciles poll the rotation like any other operation, remove the annotation once it completes and only then
+// refresh the kubeconfig with the new credentials.
+func (r *azureManagedControlPlaneReconciler) reconcileCertificateRotation(ctx context.Context, scope *scope.ManagedControlPlaneScope, managedClusterSpec *managedclusters.Spec) error {
+	if _, ok := scope.ControlPlane.Annotations[infrav1exp.RotateCertificatesAnnotation]; !ok {
+		return nil
+	}
+
+	future, err := r.managedClustersSvc.RotateClusterCertificatesAsync(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
+	if err != nil {
+		return err
+	}
+	return setOperation(scope, rotateCertificatesOperation, future)
+}
+
 func (r *azureManagedControlPlaneReconciler) reconcileKubeconfig(ctx context.Context, scope *scope.ManagedControlPlaneScope, managedClusterSpec *managedclusters.Spec) error {
 	// Always fetch credentials in case of rotation
 	data, err := r.managedClustersSvc.GetCredentials(ctx, managedClusterSpec.ResourceGroup, managedClusterSpec.Name)
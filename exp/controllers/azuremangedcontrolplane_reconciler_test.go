@@ -0,0 +1,490 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2020-02-01/containerservice"
+	azureautorest "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/scope"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/diagnosticsettings"
+	"sigs.k8s.io/cluster-api-provider-azure/cloud/services/managedclusters"
+	infrav1exp "sigs.k8s.io/cluster-api-provider-azure/exp/api/v1alpha3"
+)
+
+// fakeManagedClusterService reports a fixed state for the operation in progress and records whether
+// the managed cluster was reconciled and its certificates rotated.
+type fakeManagedClusterService struct {
+	done        bool
+	doneErr     error
+	future      *azureautorest.Future
+	reconciled  bool
+	rotateErr   error
+	rotated     bool
+	credentials []byte
+}
+
+func (f *fakeManagedClusterService) Get(ctx context.Context, spec interface{}) (interface{}, error) {
+	return containerservice.ManagedCluster{}, nil
+}
+
+func (f *fakeManagedClusterService) Reconcile(ctx context.Context, spec interface{}) error {
+	return nil
+}
+
+func (f *fakeManagedClusterService) Delete(ctx context.Context, spec interface{}) error {
+	return nil
+}
+
+func (f *fakeManagedClusterService) GetCredentials(ctx context.Context, group, name string) ([]byte, error) {
+	return f.credentials, nil
+}
+
+func (f *fakeManagedClusterService) RotateClusterCertificatesAsync(ctx context.Context, group, name string) (*azureautorest.Future, error) {
+	f.rotated = true
+	if f.rotateErr != nil {
+		return nil, f.rotateErr
+	}
+	return &azureautorest.Future{}, nil
+}
+
+func (f *fakeManagedClusterService) ReconcileAsync(ctx context.Context, spec *managedclusters.Spec, existing *containerservice.ManagedCluster) (managedclusters.ReconcileResult, *azureautorest.Future, error) {
+	f.reconciled = true
+	return managedclusters.Updated, f.future, nil
+}
+
+func (f *fakeManagedClusterService) IsDone(ctx context.Context, future azureautorest.Future) (bool, error) {
+	return f.done, f.doneErr
+}
+
+func TestReconcileManagedClusterOperation(t *testing.T) {
+	// operation is a create or update persisted by an earlier reconcile.
+	operation := &infrav1exp.Future{
+		Type: createOrUpdateOperation,
+		Data: `{"method":"PUT"}`,
+	}
+
+	cases := []struct {
+		Name              string
+		Operation         *infrav1exp.Future
+		Service           *fakeManagedClusterService
+		ExpectInProgress  bool
+		ExpectSubnetError bool
+		ExpectOperation   bool
+		ExpectReconciled  bool
+	}{
+		{
+			Name:             "InProgress",
+			Operation:        operation,
+			Service:          &fakeManagedClusterService{},
+			ExpectInProgress: true,
+			ExpectOperation:  true,
+		},
+		{
+			Name:             "Done",
+			Operation:        operation,
+			Service:          &fakeManagedClusterService{done: true},
+			ExpectReconciled: true,
+		},
+		{
+			Name:      "Failed",
+			Operation: operation,
+			Service: &fakeManagedClusterService{
+				done:    true,
+				doneErr: errors.New("managed cluster operation failed: Code=\"ControlPlaneAddOnsNotReady\""),
+			},
+		},
+		{
+			Name:      "SubnetExhausted",
+			Operation: operation,
+			Service: &fakeManagedClusterService{
+				done: true,
+				doneErr: errors.Wrap(&managedclusters.ErrSubnetExhausted{Err: errors.New("Code=\"SubnetIsFull\"")},
+					"managed cluster operation failed"),
+			},
+			ExpectSubnetError: true,
+		},
+		{
+			Name:             "NewOperation",
+			Service:          &fakeManagedClusterService{future: &azureautorest.Future{}},
+			ExpectInProgress: true,
+			ExpectOperation:  true,
+			ExpectReconciled: true,
+		},
+		{
+			Name:             "NoOperation",
+			Service:          &fakeManagedClusterService{},
+			ExpectReconciled: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"},
+				Spec:       infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg"},
+				Status:     infrav1exp.AzureManagedControlPlaneStatus{LongRunningOperation: c.Operation.DeepCopy()},
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      &clusterv1.Cluster{},
+				ControlPlane: controlPlane,
+			}
+			r := &azureManagedControlPlaneReconciler{managedClustersSvc: c.Service}
+
+			err := r.reconcileManagedCluster(context.TODO(), mcpScope, &managedclusters.Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			switch {
+			case c.ExpectInProgress:
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeTrue())
+			case c.Service.doneErr != nil:
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeFalse())
+			default:
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+
+			var subnetErr *managedclusters.ErrSubnetExhausted
+			g.Expect(errors.As(err, &subnetErr)).To(gomega.Equal(c.ExpectSubnetError))
+			if c.ExpectOperation {
+				g.Expect(controlPlane.Status.LongRunningOperation).NotTo(gomega.BeNil())
+				g.Expect(controlPlane.Status.LongRunningOperation.Type).To(gomega.Equal(createOrUpdateOperation))
+			} else {
+				g.Expect(controlPlane.Status.LongRunningOperation).To(gomega.BeNil())
+			}
+			g.Expect(c.Service.reconciled).To(gomega.Equal(c.ExpectReconciled))
+		})
+	}
+}
+
+func TestReconcileManagedClusterRotation(t *testing.T) {
+	cases := []struct {
+		Name             string
+		Service          *fakeManagedClusterService
+		ExpectInProgress bool
+		ExpectAnnotation bool
+	}{
+		{
+			Name:             "InProgress",
+			Service:          &fakeManagedClusterService{},
+			ExpectInProgress: true,
+			ExpectAnnotation: true,
+		},
+		{
+			Name:    "Done",
+			Service: &fakeManagedClusterService{done: true},
+		},
+		{
+			// A failed rotation keeps the annotation, so it is started again.
+			Name: "Failed",
+			Service: &fakeManagedClusterService{
+				done:    true,
+				doneErr: errors.New("managed cluster operation failed: Code=\"InternalServerError\""),
+			},
+			ExpectAnnotation: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "my-cluster",
+					Namespace:   "default",
+					Annotations: map[string]string{infrav1exp.RotateCertificatesAnnotation: ""},
+				},
+				Spec: infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg"},
+				Status: infrav1exp.AzureManagedControlPlaneStatus{
+					LongRunningOperation: &infrav1exp.Future{Type: rotateCertificatesOperation, Data: `{"method":"POST"}`},
+				},
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      &clusterv1.Cluster{},
+				ControlPlane: controlPlane,
+			}
+			r := &azureManagedControlPlaneReconciler{managedClustersSvc: c.Service}
+
+			err := r.reconcileManagedCluster(context.TODO(), mcpScope, &managedclusters.Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			if c.ExpectInProgress {
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeTrue())
+				g.Expect(controlPlane.Status.LongRunningOperation).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeFalse())
+				g.Expect(controlPlane.Status.LongRunningOperation).To(gomega.BeNil())
+			}
+			_, annotated := controlPlane.Annotations[infrav1exp.RotateCertificatesAnnotation]
+			g.Expect(annotated).To(gomega.Equal(c.ExpectAnnotation))
+		})
+	}
+}
+
+func TestReconcileCertificateRotation(t *testing.T) {
+	cases := []struct {
+		Name             string
+		Annotated        bool
+		Service          *fakeManagedClusterService
+		ExpectRotated    bool
+		ExpectInProgress bool
+		ExpectErr        bool
+	}{
+		{
+			Name:    "NotRequested",
+			Service: &fakeManagedClusterService{},
+		},
+		{
+			Name:             "Requested",
+			Annotated:        true,
+			Service:          &fakeManagedClusterService{},
+			ExpectRotated:    true,
+			ExpectInProgress: true,
+		},
+		{
+			Name:          "StartFailed",
+			Annotated:     true,
+			Service:       &fakeManagedClusterService{rotateErr: errors.New("failed to rotate certificates of managed cluster my-cluster")},
+			ExpectRotated: true,
+			ExpectErr:     true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"},
+				Spec:       infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg"},
+			}
+			if c.Annotated {
+				controlPlane.Annotations = map[string]string{infrav1exp.RotateCertificatesAnnotation: ""}
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      &clusterv1.Cluster{},
+				ControlPlane: controlPlane,
+			}
+			r := &azureManagedControlPlaneReconciler{managedClustersSvc: c.Service}
+
+			err := r.reconcileCertificateRotation(context.TODO(), mcpScope, &managedclusters.Spec{Name: "my-cluster", ResourceGroup: "my-rg"})
+			switch {
+			case c.ExpectInProgress:
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeTrue())
+				g.Expect(controlPlane.Status.LongRunningOperation).NotTo(gomega.BeNil())
+				g.Expect(controlPlane.Status.LongRunningOperation.Type).To(gomega.Equal(rotateCertificatesOperation))
+			case c.ExpectErr:
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(errors.Is(err, errOperationInProgress)).To(gomega.BeFalse())
+				g.Expect(controlPlane.Status.LongRunningOperation).To(gomega.BeNil())
+			default:
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+				g.Expect(controlPlane.Status.LongRunningOperation).To(gomega.BeNil())
+			}
+			g.Expect(c.Service.rotated).To(gomega.Equal(c.ExpectRotated))
+			// The annotation is only removed once the rotation completes.
+			_, annotated := controlPlane.Annotations[infrav1exp.RotateCertificatesAnnotation]
+			g.Expect(annotated).To(gomega.Equal(c.Annotated))
+		})
+	}
+}
+
+func TestReconcileKubeconfig(t *testing.T) {
+	cluster := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"}}
+	staleSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secret.Name(cluster.Name, secret.Kubeconfig), Namespace: "default"},
+		Data:       map[string][]byte{secret.KubeconfigDataName: []byte("stale")},
+	}
+
+	cases := []struct {
+		Name     string
+		Existing []runtime.Object
+	}{
+		{
+			Name: "Created",
+		},
+		{
+			// Every periodic reconcile replaces the secret with the current credentials.
+			Name:     "Refreshed",
+			Existing: []runtime.Object{staleSecret.DeepCopy()},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			scheme := runtime.NewScheme()
+			g.Expect(corev1.AddToScheme(scheme)).To(gomega.Succeed())
+			kubeclient := fake.NewFakeClientWithScheme(scheme, c.Existing...)
+
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"},
+				Spec:       infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg"},
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      cluster,
+				ControlPlane: controlPlane,
+			}
+			r := &azureManagedControlPlaneReconciler{
+				kubeclient:         kubeclient,
+				managedClustersSvc: &fakeManagedClusterService{credentials: []byte("current")},
+			}
+
+			g.Expect(r.reconcileKubeconfig(context.TODO(), mcpScope, &managedclusters.Spec{Name: "my-cluster", ResourceGroup: "my-rg"})).To(gomega.Succeed())
+
+			kubeconfig := &corev1.Secret{}
+			key := types.NamespacedName{Name: secret.Name(cluster.Name, secret.Kubeconfig), Namespace: "default"}
+			g.Expect(kubeclient.Get(context.TODO(), key, kubeconfig)).To(gomega.Succeed())
+			g.Expect(kubeconfig.Data[secret.KubeconfigDataName]).To(gomega.Equal([]byte("current")))
+		})
+	}
+}
+
+// fakeDiagnosticSettingsService records the diagnostic settings reconciled and deleted.
+type fakeDiagnosticSettingsService struct {
+	reconciled []string
+	deleted    []string
+}
+
+func (f *fakeDiagnosticSettingsService) Reconcile(ctx context.Context, spec interface{}) error {
+	f.reconciled = append(f.reconciled, spec.(*diagnosticsettings.Spec).Name)
+	return nil
+}
+
+func (f *fakeDiagnosticSettingsService) Delete(ctx context.Context, spec interface{}) error {
+	f.deleted = append(f.deleted, spec.(*diagnosticsettings.Spec).Name)
+	return nil
+}
+
+func TestReconcileDiagnosticSettings(t *testing.T) {
+	profile := &infrav1exp.DiagnosticsProfile{WorkspaceID: "/subscriptions/123/resourceGroups/my-rg/providers/Microsoft.OperationalInsights/workspaces/my-workspace"}
+
+	cases := []struct {
+		Name            string
+		Profile         *infrav1exp.DiagnosticsProfile
+		CreatedSetting  string
+		ExpectReconcile bool
+		ExpectDelete    bool
+		ExpectSetting   string
+	}{
+		{
+			Name:            "Created",
+			Profile:         profile,
+			ExpectReconcile: true,
+			ExpectSetting:   "my-cluster",
+		},
+		{
+			Name:            "Updated",
+			Profile:         profile,
+			CreatedSetting:  "my-cluster",
+			ExpectReconcile: true,
+			ExpectSetting:   "my-cluster",
+		},
+		{
+			Name:           "ProfileRemoved",
+			CreatedSetting: "my-cluster",
+			ExpectDelete:   true,
+		},
+		{
+			Name: "NoProfile",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"},
+				Spec:       infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg", DiagnosticsProfile: c.Profile},
+				Status:     infrav1exp.AzureManagedControlPlaneStatus{DiagnosticSettingName: c.CreatedSetting},
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      &clusterv1.Cluster{},
+				ControlPlane: controlPlane,
+			}
+			svc := &fakeDiagnosticSettingsService{}
+			r := &azureManagedControlPlaneReconciler{diagnosticSettingsSvc: svc}
+
+			g.Expect(r.reconcileDiagnosticSettings(context.TODO(), mcpScope)).To(gomega.Succeed())
+			g.Expect(len(svc.reconciled) == 1).To(gomega.Equal(c.ExpectReconcile))
+			g.Expect(len(svc.deleted) == 1).To(gomega.Equal(c.ExpectDelete))
+			g.Expect(controlPlane.Status.DiagnosticSettingName).To(gomega.Equal(c.ExpectSetting))
+		})
+	}
+}
+
+func TestDeleteDiagnosticSettings(t *testing.T) {
+	cases := []struct {
+		Name           string
+		CreatedSetting string
+		ExpectDeleted  []string
+	}{
+		{
+			Name:           "Created",
+			CreatedSetting: "my-cluster",
+			ExpectDeleted:  []string{"my-cluster"},
+		},
+		{
+			Name: "NotCreated",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			controlPlane := &infrav1exp.AzureManagedControlPlane{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "default"},
+				Spec:       infrav1exp.AzureManagedControlPlaneSpec{ResourceGroup: "my-rg"},
+				Status:     infrav1exp.AzureManagedControlPlaneStatus{DiagnosticSettingName: c.CreatedSetting},
+			}
+			mcpScope := &scope.ManagedControlPlaneScope{
+				Logger:       log.Log.Logger,
+				Cluster:      &clusterv1.Cluster{},
+				ControlPlane: controlPlane,
+			}
+			svc := &fakeDiagnosticSettingsService{}
+			r := &azureManagedControlPlaneReconciler{
+				managedClustersSvc:    &fakeManagedClusterService{},
+				diagnosticSettingsSvc: svc,
+			}
+
+			g.Expect(r.Delete(context.TODO(), mcpScope)).To(gomega.Succeed())
+			g.Expect(svc.deleted).To(gomega.Equal(c.ExpectDeleted))
+			g.Expect(controlPlane.Status.DiagnosticSettingName).To(gomega.BeEmpty())
+		})
+	}
+}